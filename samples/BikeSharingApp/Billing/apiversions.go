@@ -0,0 +1,245 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// apiVersion is a route group under /api/<Name>. Handlers only know the internal models; the version
+// translates the request and response bodies whose shape differs from them.
+type apiVersion struct {
+	Name string
+	// Deprecated is when the version was superseded, zero while it's current
+	Deprecated time.Time
+	// Sunset is when a deprecated version stops being served
+	Sunset time.Time
+	// Successor is the version clients should move to
+	Successor string
+	// mappers translate the internal models that have another shape in this version, keyed by their type
+	mappers map[reflect.Type]modelMapper
+}
+
+// modelMapper translates an internal model to and from its shape in an API version
+type modelMapper struct {
+	// example is the zero value of the versioned shape, which the OpenAPI specification describes
+	example     interface{}
+	toVersion   func(internal interface{}) interface{}
+	fromVersion func(versioned interface{}) (interface{}, error)
+}
+
+// apiVersions lists every served version, oldest first. The unversioned routes under /api are the first.
+var apiVersions = []apiVersion{
+	{
+		Name:       "v1",
+		Deprecated: time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC),
+		Sunset:     time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+		Successor:  "v2",
+	},
+	{
+		Name: "v2",
+		mappers: map[reflect.Type]modelMapper{
+			reflect.TypeOf(Invoice{}): {
+				example:     InvoiceV2{},
+				toVersion:   func(internal interface{}) interface{} { return NewInvoiceV2(internal.(Invoice)) },
+				fromVersion: func(versioned interface{}) (interface{}, error) { return versioned.(InvoiceV2).Invoice() },
+			},
+			reflect.TypeOf(RefundRequest{}): {
+				example:     RefundRequestV2{},
+				toVersion:   func(internal interface{}) interface{} { return NewRefundRequestV2(internal.(RefundRequest)) },
+				fromVersion: func(versioned interface{}) (interface{}, error) { return versioned.(RefundRequestV2).RefundRequest() },
+			},
+		},
+	},
+}
+
+// apiVersionKey is the request context key of the API version serving the request
+type apiVersionKey struct{}
+
+// requestAPIVersion returns the API version serving req
+func requestAPIVersion(req *http.Request) apiVersion {
+	if version, ok := req.Context().Value(apiVersionKey{}).(apiVersion); ok {
+		return version
+	}
+	return apiVersions[0]
+}
+
+// route returns the route serving the internal route under prefix in this version
+func (version apiVersion) route(internal apiRoute, prefix string) apiRoute {
+	versioned := internal
+	versioned.Path = prefix + strings.TrimPrefix(internal.Path, apiPrefix)
+	versioned.Deprecated = !version.Deprecated.IsZero()
+	if internal.Request != nil {
+		versioned.Request = version.exampleFor(internal.Request)
+	}
+	versioned.Responses = map[int]interface{}{}
+	for status, body := range internal.Responses {
+		versioned.Responses[status] = version.exampleFor(body)
+	}
+	versioned.Handler = version.middleware(internal, internal.Handler)
+	return versioned
+}
+
+// exampleFor returns the versioned shape of an example body of an internal model, or of a slice of them
+func (version apiVersion) exampleFor(internal interface{}) interface{} {
+	if internal == nil {
+		return nil
+	}
+	if stream, ok := internal.(ndjsonStream); ok {
+		return ndjsonStream{Record: version.exampleFor(stream.Record)}
+	}
+	internalType := reflect.TypeOf(internal)
+	if mapper, ok := version.mappers[internalType]; ok {
+		return mapper.example
+	}
+	if internalType.Kind() == reflect.Slice {
+		if mapper, ok := version.mappers[internalType.Elem()]; ok {
+			return reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(mapper.example)), 0, 0).Interface()
+		}
+	}
+	return internal
+}
+
+// toVersion translates an internal model, or a slice of them, to this version
+func (version apiVersion) toVersion(internal interface{}) interface{} {
+	value := reflect.ValueOf(internal)
+	if mapper, ok := version.mappers[value.Type()]; ok {
+		return mapper.toVersion(internal)
+	}
+	if value.Kind() == reflect.Slice {
+		if mapper, ok := version.mappers[value.Type().Elem()]; ok {
+			versioned := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(mapper.example)), value.Len(), value.Len())
+			for i := 0; i < value.Len(); i++ {
+				versioned.Index(i).Set(reflect.ValueOf(mapper.toVersion(value.Index(i).Interface())))
+			}
+			return versioned.Interface()
+		}
+	}
+	return internal
+}
+
+// middleware serves the internal route in this version: it adds the deprecation headers, and translates
+// the request body to the internal model and the response body back
+func (version apiVersion) middleware(internal apiRoute, next http.Handler) http.Handler {
+	var requestMapper *modelMapper
+	if internal.Request != nil {
+		if mapper, ok := version.mappers[reflect.TypeOf(internal.Request)]; ok {
+			requestMapper = &mapper
+		}
+	}
+	mapsResponses := false
+	for _, body := range internal.Responses {
+		if _, ok := body.(ndjsonStream); ok {
+			// Streams aren't buffered, their handlers translate each record with requestAPIVersion
+			continue
+		}
+		if body != nil && reflect.TypeOf(version.exampleFor(body)) != reflect.TypeOf(body) {
+			mapsResponses = true
+		}
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !version.Deprecated.IsZero() {
+			version.writeDeprecationHeaders(rw, req)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), apiVersionKey{}, version))
+
+		if requestMapper != nil {
+			body, err := version.requestToInternal(*requestMapper, req)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(rw, "%s\n", err.Error())
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		if !mapsResponses {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		response := newBufferedResponse()
+		next.ServeHTTP(response, req)
+		version.writeResponse(rw, response, internal.Responses[response.status])
+	})
+}
+
+// writeDeprecationHeaders announces the deprecation (RFC 9745), the sunset (RFC 8594) and the successor
+func (version apiVersion) writeDeprecationHeaders(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Deprecation", fmt.Sprintf("@%d", version.Deprecated.Unix()))
+	if !version.Sunset.IsZero() {
+		rw.Header().Set("Sunset", version.Sunset.Format(http.TimeFormat))
+	}
+	if version.Successor != "" {
+		path := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, apiPrefix), "/"+version.Name)
+		rw.Header().Add("Link", fmt.Sprintf("<%s/%s%s>; rel=\"successor-version\"", apiPrefix, version.Successor, path))
+	}
+}
+
+// requestToInternal reads the versioned request body and returns it encoded as the internal model
+func (version apiVersion) requestToInternal(mapper modelMapper, req *http.Request) ([]byte, error) {
+	versioned := reflect.New(reflect.TypeOf(mapper.example))
+	if err := json.NewDecoder(req.Body).Decode(versioned.Interface()); err != nil {
+		return nil, err
+	}
+	internal, err := mapper.fromVersion(versioned.Elem().Interface())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(internal)
+}
+
+// writeResponse writes the buffered response, translating its body if example shows it's an internal model
+func (version apiVersion) writeResponse(rw http.ResponseWriter, response *bufferedResponse, example interface{}) {
+	for name, values := range response.header {
+		rw.Header()[name] = values
+	}
+	body := response.body.Bytes()
+	if example != nil && reflect.TypeOf(version.exampleFor(example)) != reflect.TypeOf(example) {
+		internal := reflect.New(reflect.TypeOf(example))
+		err := json.Unmarshal(body, internal.Interface())
+		if err == nil {
+			body, err = json.Marshal(version.toVersion(internal.Elem().Interface()))
+			body = append(body, '\n')
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(rw, "Couldn't translate the response to API %s: %v\n", version.Name, err)
+			return
+		}
+	}
+	rw.WriteHeader(response.status)
+	rw.Write(body)
+}
+
+// bufferedResponse holds a response so that its body can be translated before it's written
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+}
+
+func (response *bufferedResponse) Header() http.Header {
+	return response.header
+}
+
+func (response *bufferedResponse) WriteHeader(status int) {
+	response.status = status
+}
+
+func (response *bufferedResponse) Write(data []byte) (int, error) {
+	return response.body.Write(data)
+}
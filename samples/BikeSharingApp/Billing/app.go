@@ -0,0 +1,351 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Clock tells the time. It is injected so that time dependent behavior can be controlled.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the Clock backed by the system time
+var SystemClock Clock = systemClock{}
+
+// App is the Billing service. Building one has no side effects; nothing happens until Run is called.
+type App struct {
+	Store    Store
+	Payments PaymentProcessor
+	Logger   *Logger
+	Clock    Clock
+
+	configMutex sync.RWMutex
+	config      Config
+
+	health   *HealthMonitor
+	breaker  *CircuitBreaker
+	inFlight *InFlightTracker
+}
+
+// NewApp creates a Billing service serving the given store
+func NewApp(config Config, store Store, logger *Logger, clock Clock) *App {
+	return &App{
+		config:   config,
+		Store:    store,
+		Payments: loggingPaymentProcessor{logger},
+		Logger:   logger,
+		Clock:    clock,
+		health:   NewHealthMonitor(clock),
+		breaker:  NewCircuitBreaker("DbConnection", config.MongoDbBreakerThreshold, logger),
+		inFlight: &InFlightTracker{},
+	}
+}
+
+// Config returns the configuration currently in effect
+func (app *App) Config() Config {
+	app.configMutex.RLock()
+	defer app.configMutex.RUnlock()
+	return app.config
+}
+
+// Reload applies the reloadable settings of config to the running service. Other settings are
+// only read at startup and are left untouched.
+func (app *App) Reload(config Config) {
+	app.configMutex.Lock()
+	app.config = app.config.withReloadedSettings(config)
+	reloaded := app.config
+	app.configMutex.Unlock()
+
+	app.breaker.SetThreshold(reloaded.MongoDbBreakerThreshold)
+	app.Logger.Log("Reloaded configuration: %s", reloaded.Redacted())
+}
+
+// apiPrefix is where the routes behind the circuit breaker and request timeout live
+const apiPrefix = "/api"
+
+// routes lists every Billing endpoint. The OpenAPI specification is generated from it.
+func (app *App) routes() []apiRoute {
+	invoiceResponses := map[int]interface{}{http.StatusOK: Invoice{}, http.StatusBadRequest: nil, http.StatusNotFound: nil}
+	promotionResponses := map[int]interface{}{http.StatusOK: Promotion{}, http.StatusBadRequest: nil, http.StatusNotFound: nil, http.StatusConflict: nil}
+	invoicesResponses := map[int]interface{}{http.StatusOK: []Invoice{}, http.StatusNotFound: nil}
+	vendorResponses := map[int]interface{}{http.StatusOK: Vendor{}, http.StatusBadRequest: nil, http.StatusNotFound: nil}
+	customerResponses := map[int]interface{}{http.StatusOK: Customer{}, http.StatusBadRequest: nil, http.StatusNotFound: nil}
+	payoutsResponses := map[int]interface{}{http.StatusOK: []Payout{}, http.StatusBadRequest: nil}
+	asOfParameter := queryParameter("asOf", "Only entries posted before this RFC 3339 time, or until the end of this YYYY-MM-DD day")
+	payoutResponses := map[int]interface{}{http.StatusOK: Payout{}, http.StatusBadRequest: nil, http.StatusNotFound: nil, http.StatusConflict: nil}
+
+	return []apiRoute{
+		{Method: http.MethodGet, Path: "/hello", Summary: "Says hello",
+			Handler: app.endpointNoContext(HelloHandler), Responses: map[int]interface{}{http.StatusOK: helloResponse{}}},
+		{Method: http.MethodGet, Path: "/healthz", Summary: "Reports that the process is alive",
+			Handler: app.endpointNoContext(app.LivenessHandler), Responses: map[int]interface{}{http.StatusOK: map[string]string{}}},
+		{Method: http.MethodGet, Path: "/readyz", Summary: "Reports the status of each dependency",
+			Handler:   app.endpointNoContext(app.ReadinessHandler),
+			Responses: map[int]interface{}{http.StatusOK: readinessResponse{}, http.StatusServiceUnavailable: readinessResponse{}}},
+		{Method: http.MethodPost, Path: "/api/invoice", Summary: "Creates an invoice, discounted by its promo code if any",
+			Handler: app.endpoint(app.NewInvoiceHandler), Request: Invoice{},
+			// 502 when the payment processor fails to charge it, 503 when its jurisdiction has no tax rules
+			Responses: map[int]interface{}{http.StatusOK: Invoice{}, http.StatusBadRequest: nil, http.StatusNotFound: nil, http.StatusConflict: nil,
+				http.StatusBadGateway: nil, http.StatusServiceUnavailable: nil}},
+		{Method: http.MethodGet, Path: "/api/invoice/{id}", Summary: "Gets an invoice",
+			Handler: app.endpoint(app.GetInvoiceHandler), Responses: invoiceResponses},
+		{Method: http.MethodGet, Path: "/api/invoice/number/{number}", Summary: "Gets an invoice or credit note by its number",
+			Handler: app.endpoint(app.GetInvoiceByNumberHandler), Responses: invoiceResponses},
+		{Method: http.MethodPost, Path: "/api/invoice/{id}/refund", Summary: "Refunds all or part of an invoice, returning its credit note",
+			Handler: app.endpoint(app.RefundInvoiceHandler), Request: RefundRequest{},
+			Responses: map[int]interface{}{
+				http.StatusOK: Invoice{}, http.StatusBadRequest: nil, http.StatusNotFound: nil, http.StatusConflict: nil, http.StatusBadGateway: nil,
+			}},
+		{Method: http.MethodPost, Path: "/api/customer", Summary: "Creates a customer",
+			Handler: app.endpoint(app.NewCustomerHandler), Request: Customer{}, Responses: customerResponses},
+		{Method: http.MethodPatch, Path: "/api/customer", Summary: "Updates the customer with the given userId",
+			Handler: app.endpoint(app.UpdateCustomerHandler), Request: Customer{}, Responses: customerResponses},
+		{Method: http.MethodGet, Path: "/api/customer/{userID}", Summary: "Gets a customer",
+			Handler: app.endpoint(app.GetCustomerByUserIdHandler), Responses: customerResponses},
+		{Method: http.MethodGet, Path: "/api/customer/{userID}/invoices", Summary: "Lists a customer's invoices",
+			Handler: app.endpoint(app.GetInvoicesForCustomerHandler), Responses: invoicesResponses},
+		{Method: http.MethodPost, Path: "/api/vendor", Summary: "Creates a vendor",
+			Handler: app.endpoint(app.NewVendorHandler), Request: Vendor{}, Responses: vendorResponses},
+		{Method: http.MethodPatch, Path: "/api/vendor", Summary: "Updates the vendor with the given userId",
+			Handler: app.endpoint(app.UpdateVendorHandler), Request: Vendor{}, Responses: vendorResponses},
+		{Method: http.MethodGet, Path: "/api/vendor/{userID}", Summary: "Gets a vendor",
+			Handler: app.endpoint(app.GetVendorByUserIdHandler), Responses: vendorResponses},
+		{Method: http.MethodGet, Path: "/api/vendor/{userID}/invoices", Summary: "Lists a vendor's invoices",
+			Handler: app.endpoint(app.GetInvoicesForVendorHandler), Responses: invoicesResponses},
+		{Method: http.MethodGet, Path: "/api/vendor/{userID}/statement", Summary: "Renders a vendor's monthly statement as CSV",
+			Handler: app.streamingEndpoint(app.GetVendorStatementHandler),
+			Query: []OpenAPIParameter{
+				requiredQueryParameter("period", "The month, formatted YYYY-MM, whose invoices the statement lists"),
+				queryParameter("format", "The statement's format, csv is the only one and the default"),
+				queryParameter("currency", "The ISO 4217 currency of the statement's amounts, by default the vendor's"),
+			},
+			Responses: map[int]interface{}{
+				http.StatusOK:         fileDocument{ContentTypes: []string{csvContentType}},
+				http.StatusBadRequest: nil, http.StatusNotFound: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodGet, Path: "/api/reservation/{resID}/invoice", Summary: "Gets the invoice of a reservation",
+			Handler: app.endpoint(app.GetInvoiceForReservationIdHandler), Responses: invoiceResponses},
+		{Method: http.MethodPost, Path: "/api/payouts", Summary: "Groups the invoices not in a payout yet into a pending payout per vendor",
+			Handler: app.endpoint(app.NewPayoutsHandler),
+			Query: []OpenAPIParameter{
+				queryParameter("before", "Only invoices created before this RFC 3339 time, by default now"),
+				queryParameter("vendorId", "Only the vendor's invoices"),
+			},
+			Responses: map[int]interface{}{http.StatusOK: []Payout{}, http.StatusBadRequest: nil, http.StatusConflict: nil}},
+		{Method: http.MethodGet, Path: "/api/payouts", Summary: "Lists payouts",
+			Handler: app.endpoint(app.GetPayoutsHandler),
+			Query: []OpenAPIParameter{
+				queryParameter("status", "Only payouts in this state: pending, submitted, settled or failed"),
+				queryParameter("vendorId", "Only the vendor's payouts"),
+			},
+			Responses: payoutsResponses},
+		{Method: http.MethodGet, Path: "/api/payout/{id}", Summary: "Gets a payout",
+			Handler: app.endpoint(app.GetPayoutHandler), Responses: payoutResponses},
+		{Method: http.MethodPost, Path: "/api/payout/{id}/approve", Summary: "Submits a pending payout",
+			Handler: app.endpoint(app.ApprovePayoutHandler), Responses: payoutResponses},
+		{Method: http.MethodPost, Path: "/api/payout/{id}/settle", Summary: "Records that a submitted payout was paid",
+			Handler: app.endpoint(app.SettlePayoutHandler), Responses: payoutResponses},
+		{Method: http.MethodPost, Path: "/api/payout/{id}/fail", Summary: "Records that a payout failed, releasing its invoices",
+			Handler:   app.endpoint(app.FailPayoutHandler),
+			Query:     []OpenAPIParameter{queryParameter("reason", "Why the payout failed")},
+			Responses: payoutResponses},
+		{Method: http.MethodPost, Path: "/api/payouts/file", Summary: "Generates the NACHA or pain.001 file paying out submitted payouts",
+			Handler: app.streamingEndpoint(app.NewPayoutFileHandler), Request: PayoutFileRequest{},
+			Responses: map[int]interface{}{
+				http.StatusOK:         fileDocument{ContentTypes: []string{nachaContentType, pain001ContentType}},
+				http.StatusBadRequest: nil, http.StatusNotFound: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/api/exchangerates", Summary: "Adds an exchange rate taking effect on a date",
+			Handler: app.endpoint(app.NewExchangeRateHandler), Request: ExchangeRate{},
+			Responses: map[int]interface{}{http.StatusOK: ExchangeRate{}, http.StatusBadRequest: nil, http.StatusConflict: nil}},
+		{Method: http.MethodGet, Path: "/api/exchangerates", Summary: "Lists the exchange rates of the rates file and the API",
+			Handler: app.endpoint(app.GetExchangeRatesHandler),
+			Query: []OpenAPIParameter{
+				queryParameter("from", "Only rates converting from this currency"),
+				queryParameter("to", "Only rates converting to this currency"),
+				queryParameter("date", "Only the rate of each pair in effect on this YYYY-MM-DD date"),
+			},
+			Responses: map[int]interface{}{http.StatusOK: []ExchangeRate{}, http.StatusBadRequest: nil}},
+		{Method: http.MethodPost, Path: "/api/promotions", Summary: "Creates a promotion",
+			Handler: app.endpoint(app.NewPromotionHandler), Request: Promotion{}, Responses: promotionResponses},
+		{Method: http.MethodGet, Path: "/api/promotions", Summary: "Lists promotions",
+			Handler: app.endpoint(app.GetPromotionsHandler), Responses: map[int]interface{}{http.StatusOK: []Promotion{}}},
+		{Method: http.MethodGet, Path: "/api/promotion/{code}", Summary: "Gets a promotion",
+			Handler: app.endpoint(app.GetPromotionHandler), Responses: promotionResponses},
+		{Method: http.MethodGet, Path: "/api/ledger/account/{account}", Summary: "Gets an account's balance in each currency",
+			Handler:   app.endpoint(app.GetAccountBalanceHandler),
+			Query:     []OpenAPIParameter{asOfParameter},
+			Responses: map[int]interface{}{http.StatusOK: []AccountBalance{}, http.StatusBadRequest: nil}},
+		{Method: http.MethodGet, Path: "/api/ledger/balances", Summary: "Lists the balance of every account, a trial balance",
+			Handler:   app.endpoint(app.GetBalancesHandler),
+			Query:     []OpenAPIParameter{asOfParameter},
+			Responses: map[int]interface{}{http.StatusOK: []AccountBalance{}, http.StatusBadRequest: nil}},
+		{Method: http.MethodGet, Path: "/api/ledger/entries", Summary: "Lists journal entries in the order they were posted",
+			Handler: app.endpoint(app.GetJournalEntriesHandler),
+			Query: []OpenAPIParameter{
+				queryParameter("account", "Only entries posting to this account"),
+				queryParameter("reference", "Only entries recording this invoice, credit note or payout"),
+				asOfParameter,
+			},
+			Responses: map[int]interface{}{http.StatusOK: []JournalEntry{}, http.StatusBadRequest: nil}},
+		{Method: http.MethodPost, Path: "/api/ledger/sync", Summary: "Posts the journal entries missing for stored invoices and settled payouts",
+			Handler:   app.endpoint(app.SyncLedgerHandler),
+			Timeout:   Config.exportTimeout,
+			Responses: map[int]interface{}{http.StatusOK: LedgerSyncResult{}}},
+		{Method: http.MethodGet, Path: "/api/export/invoices", Summary: "Streams invoices as newline delimited JSON, oldest first",
+			Handler: app.streamingEndpoint(app.ExportInvoicesHandler),
+			Query: []OpenAPIParameter{
+				queryParameter("from", "Only invoices created at or after this RFC 3339 time"),
+				queryParameter("to", "Only invoices created before this RFC 3339 time"),
+				queryParameter("userId", "Only the customer's invoices"),
+				queryParameter("vendorId", "Only the vendor's invoices"),
+				queryParameter("cursor", "Resume after the invoice with this id, the last line received"),
+				queryParameter("limit", "Most invoices to return"),
+			},
+			Timeout:   Config.exportTimeout,
+			Responses: map[int]interface{}{http.StatusOK: ndjsonStream{Record: Invoice{}}, http.StatusBadRequest: nil}},
+	}
+}
+
+// versionRoutes serves each /api route under every API version, as well as unversioned as the first
+func versionRoutes(routes []apiRoute) []apiRoute {
+	var versioned []apiRoute
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, apiPrefix+"/") {
+			versioned = append(versioned, route)
+			continue
+		}
+		versioned = append(versioned, apiVersions[0].route(route, apiPrefix))
+		for _, version := range apiVersions {
+			versioned = append(versioned, version.route(route, apiPrefix+"/"+version.Name))
+		}
+	}
+	return versioned
+}
+
+// Handler returns the HTTP handler serving every Billing endpoint
+func (app *App) Handler() http.Handler {
+	routes := app.routes()
+	for i := range routes {
+		if handler, ok := routes[i].Handler.(endpoint); ok {
+			routes[i].RequiresRequestID = handler.requireContext
+		}
+		if strings.HasPrefix(routes[i].Path, apiPrefix+"/") {
+			// The circuit breaker fails these fast while the database is unreachable, and failed
+			// database work is a 500, or a 504 once the request times out
+			responses := map[int]interface{}{
+				http.StatusInternalServerError: nil,
+				http.StatusServiceUnavailable:  nil,
+				http.StatusGatewayTimeout:      nil,
+			}
+			for status, body := range routes[i].Responses {
+				responses[status] = body
+			}
+			routes[i].Responses = responses
+		}
+	}
+	routes = versionRoutes(routes)
+	spec := NewOpenAPISpec("Billing", "1.0.0", routes)
+
+	r := mux.NewRouter()
+	r.Handle("/openapi.json", OpenAPIHandler(spec)).Methods(http.MethodGet)
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.Use(app.breaker.Middleware)
+	for _, route := range routes {
+		handler := app.requestValidationMiddleware(spec, route, route.Handler)
+		if strings.HasPrefix(route.Path, apiPrefix+"/") {
+			handler = app.requestTimeoutMiddleware(route, handler)
+			api.Handle(strings.TrimPrefix(route.Path, apiPrefix), handler).Methods(route.Method)
+		} else {
+			r.Handle(route.Path, handler).Methods(route.Method)
+		}
+	}
+
+	return app.inFlight.Middleware(r)
+}
+
+// requestTimeoutMiddleware bounds the request's context, and so its database work, by the route's timeout
+func (app *App) requestTimeoutMiddleware(route apiRoute, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		config := app.Config()
+		timeout := config.RequestTimeout
+		if route.Timeout != nil {
+			timeout = route.Timeout(config)
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// Run serves HTTP until ctx is cancelled or the webserver fails, then drains in-flight requests.
+// The store stays open; call Close once Run returns.
+func (app *App) Run(ctx context.Context) error {
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	defer stopMonitor()
+	go app.monitorStoreHealth(monitorCtx)
+
+	config := app.Config()
+	srv := &http.Server{
+		Handler:      app.Handler(),
+		Addr:         fmt.Sprintf("0.0.0.0:%d", config.ListenPort),
+		WriteTimeout: config.WriteTimeout,
+		ReadTimeout:  config.ReadTimeout,
+	}
+	serverErrChan := make(chan error, 1)
+	go func() {
+		app.Logger.Log("Listening on %d...", config.ListenPort)
+		serverErrChan <- srv.ListenAndServe()
+	}()
+
+	var serverErr error
+	select {
+	case <-ctx.Done():
+	case serverErr = <-serverErrChan:
+		app.Logger.LogErrFormat("Webserver shutdown unexpectedly!: %v", serverErr)
+	}
+
+	app.shutdown(srv)
+	return serverErr
+}
+
+// shutdown reports not-ready and drains in-flight requests
+func (app *App) shutdown(srv *http.Server) {
+	config := app.Config()
+	app.Logger.Log("Shutting down!")
+	app.health.SetShuttingDown()
+	if config.ShutdownDelay > 0 {
+		app.Logger.Log("Waiting %v for readiness to propagate", config.ShutdownDelay)
+		time.Sleep(config.ShutdownDelay)
+	}
+
+	app.Logger.Log("Draining %d in-flight requests", app.inFlight.Count())
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		app.Logger.LogErrFormat("Webserver didn't drain within %v, %d requests still in flight: %v", config.ShutdownTimeout, app.inFlight.Count(), err)
+	} else {
+		app.Logger.Log("All handlers done.")
+	}
+}
+
+// Close releases the store. Call it once Run has returned.
+func (app *App) Close() {
+	app.Store.Shutdown()
+}
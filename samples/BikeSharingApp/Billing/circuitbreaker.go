@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+const (
+	circuitClosed = "closed"
+	circuitOpen   = "open"
+)
+
+// CircuitBreaker opens after a number of consecutive failures and closes again on the next success
+type CircuitBreaker struct {
+	Name             string
+	failureThreshold int
+	logger           *Logger
+
+	mutex               sync.RWMutex
+	consecutiveFailures int
+	open                bool
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker that opens after failureThreshold consecutive failures
+func NewCircuitBreaker(name string, failureThreshold int, logger *Logger) *CircuitBreaker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	return &CircuitBreaker{Name: name, failureThreshold: failureThreshold, logger: logger}
+}
+
+// SetThreshold changes the number of consecutive failures that opens the circuit
+func (breaker *CircuitBreaker) SetThreshold(failureThreshold int) {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.failureThreshold = failureThreshold
+}
+
+// Allow returns false while the circuit is open
+func (breaker *CircuitBreaker) Allow() bool {
+	breaker.mutex.RLock()
+	defer breaker.mutex.RUnlock()
+	return !breaker.open
+}
+
+// State returns circuitOpen or circuitClosed
+func (breaker *CircuitBreaker) State() string {
+	if breaker.Allow() {
+		return circuitClosed
+	}
+	return circuitOpen
+}
+
+// RecordSuccess closes the circuit
+func (breaker *CircuitBreaker) RecordSuccess() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.open {
+		breaker.logger.Log("Circuit '%s' closed", breaker.Name)
+	}
+	breaker.consecutiveFailures = 0
+	breaker.open = false
+}
+
+// RecordFailure counts a failure, opening the circuit once the threshold is reached
+func (breaker *CircuitBreaker) RecordFailure() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.consecutiveFailures++
+	if !breaker.open && breaker.consecutiveFailures >= breaker.failureThreshold {
+		breaker.logger.LogErrFormat("Circuit '%s' opened after %d consecutive failures", breaker.Name, breaker.consecutiveFailures)
+		breaker.open = true
+	}
+}
+
+// Middleware fails requests fast with a 503 while the circuit is open
+func (breaker *CircuitBreaker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !breaker.Allow() {
+			http.Error(rw, "Service unavailable: database is unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
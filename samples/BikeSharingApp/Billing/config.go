@@ -0,0 +1,537 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// configFileEnvName and configFileFlagName name the YAML or JSON file to read settings from
+	configFileEnvName  = "config_file"
+	configFileFlagName = "config"
+
+	redactedValue = "REDACTED"
+)
+
+// Config holds everything needed to build and run the Billing service
+type Config struct {
+	ListenPort   int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// RequestTimeout is the deadline given to each API request, and so to its database work
+	RequestTimeout time.Duration
+	// ExportTimeout is the deadline given to each export, which streams for longer than other requests
+	ExportTimeout time.Duration
+	// ValidateRequests checks request bodies against the OpenAPI specification before handling them
+	ValidateRequests bool
+
+	// Pricing is the rule set new invoices' amounts are calculated with, in PricingCurrency
+	Pricing         PricingRules
+	PricingCurrency string
+	// InvoiceNumberPrefix starts the invoice numbers of vendors without a prefix of their own
+	InvoiceNumberPrefix string
+	// PostedAmounts is postedAmountsIgnore or postedAmountsReject
+	PostedAmounts string
+	// PayoutPlatformFeeBps is the platform fee deducted from payouts, in basis points of their gross amount
+	PayoutPlatformFeeBps int
+	// PayoutOriginator is the account payout files pay from
+	PayoutOriginator PayoutOriginator
+	// TaxRulesFile is the YAML or JSON file TaxRules are read from, empty for none
+	TaxRulesFile string
+	// TaxRules are read from TaxRulesFile whenever the configuration is loaded
+	TaxRules TaxRules
+	// BaseCurrency is what vendors without a currency of their own are paid and reported in
+	BaseCurrency string
+	// ExchangeRatesFile is the YAML or JSON file ExchangeRates are read from, empty for none
+	ExchangeRatesFile string
+	// ExchangeRates are read from ExchangeRatesFile whenever the configuration is loaded. Rates can
+	// also be added through the API.
+	ExchangeRates ExchangeRates
+
+	MongoDbConnectionString string
+	MongoDbName             string
+	// MongoDbPoolLimit is the most sockets opened to each MongoDb server
+	MongoDbPoolLimit int
+	// MongoDbReconnect is the backoff used when dialing and when pings fail
+	MongoDbReconnect BackoffPolicy
+	// MongoDbBreakerThreshold is the number of consecutive failed pings that opens the circuit
+	MongoDbBreakerThreshold int
+
+	// ShutdownDelay gives load balancers time to notice /readyz failing before the listener closes
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds how long in-flight requests are given to finish
+	ShutdownTimeout time.Duration
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		ListenPort:     80,
+		ReadTimeout:    15 * time.Second,
+		WriteTimeout:   15 * time.Second,
+		RequestTimeout: 10 * time.Second,
+		ExportTimeout:  5 * time.Minute,
+
+		Pricing: PricingRules{
+			UnlockFee:     100,
+			PerMinute:     15,
+			DailyCap:      2500,
+			MinimumCharge: 200,
+		},
+		PricingCurrency:      invoiceCurrency,
+		InvoiceNumberPrefix:  "INV",
+		PostedAmounts:        postedAmountsIgnore,
+		PayoutPlatformFeeBps: 1000,
+		BaseCurrency:         invoiceCurrency,
+
+		MongoDbConnectionString: "mongodb://databases-mongo",
+		MongoDbName:             "billing",
+		MongoDbPoolLimit:        4096,
+		MongoDbReconnect: BackoffPolicy{
+			InitialInterval: 500 * time.Millisecond,
+			MaxInterval:     30 * time.Second,
+			Multiplier:      2,
+			Jitter:          0.2,
+			MaxAttempts:     10,
+		},
+		MongoDbBreakerThreshold: 2,
+
+		ShutdownDelay:   5 * time.Second,
+		ShutdownTimeout: 20 * time.Second,
+	}
+}
+
+// configSetting is a single configuration key. The same name is used in the config file, as the
+// environment variable and as the command line flag.
+type configSetting struct {
+	name  string
+	usage string
+	get   func(config *Config) string
+	set   func(config *Config, value string) error
+	// secret settings are redacted when the configuration is printed
+	secret bool
+	// reloadable settings are re-read on SIGHUP
+	reloadable bool
+}
+
+func (setting configSetting) reloadOnHangup() configSetting {
+	setting.reloadable = true
+	return setting
+}
+
+func (setting configSetting) redacted() configSetting {
+	setting.secret = true
+	return setting
+}
+
+func stringSetting(name, usage string, field func(config *Config) *string) configSetting {
+	return configSetting{
+		name:  name,
+		usage: usage,
+		get:   func(config *Config) string { return *field(config) },
+		set: func(config *Config, value string) error {
+			*field(config) = value
+			return nil
+		},
+	}
+}
+
+func intSetting(name, usage string, field func(config *Config) *int) configSetting {
+	return configSetting{
+		name:  name,
+		usage: usage,
+		get:   func(config *Config) string { return strconv.Itoa(*field(config)) },
+		set: func(config *Config, value string) (err error) {
+			*field(config), err = strconv.Atoi(value)
+			return
+		},
+	}
+}
+
+func floatSetting(name, usage string, field func(config *Config) *float64) configSetting {
+	return configSetting{
+		name:  name,
+		usage: usage,
+		get:   func(config *Config) string { return strconv.FormatFloat(*field(config), 'g', -1, 64) },
+		set: func(config *Config, value string) (err error) {
+			*field(config), err = strconv.ParseFloat(value, 64)
+			return
+		},
+	}
+}
+
+func boolSetting(name, usage string, field func(config *Config) *bool) configSetting {
+	return configSetting{
+		name:  name,
+		usage: usage,
+		get:   func(config *Config) string { return strconv.FormatBool(*field(config)) },
+		set: func(config *Config, value string) (err error) {
+			*field(config), err = strconv.ParseBool(value)
+			return
+		},
+	}
+}
+
+// moneySetting is an amount written as a decimal, e.g. 1.50, and held in its currency's minor unit
+func moneySetting(name, usage string, field func(config *Config) *int64) configSetting {
+	return configSetting{
+		name:  name,
+		usage: usage,
+		get:   func(config *Config) string { return formatMinorUnits(*field(config)) },
+		set: func(config *Config, value string) (err error) {
+			*field(config), err = parseMinorUnits(value)
+			return
+		},
+	}
+}
+
+// parseMinorUnits parses a decimal amount with at most two decimals, e.g. -1.5, into cents
+func parseMinorUnits(value string) (int64, error) {
+	digits := strings.TrimPrefix(value, "-")
+	units, cents := digits, ""
+	if point := strings.Index(digits, "."); point >= 0 {
+		units, cents = digits[:point], digits[point+1:]
+	}
+	if units == "" || len(cents) > 2 || strings.Trim(units+cents, "0123456789") != "" {
+		return 0, fmt.Errorf("'%s' must be an amount with at most two decimals", value)
+	}
+	amount, err := strconv.ParseInt(units+(cents + "00")[:2], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if digits != value {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+func durationSetting(name, usage string, field func(config *Config) *time.Duration) configSetting {
+	return configSetting{
+		name:  name,
+		usage: usage,
+		get:   func(config *Config) string { return field(config).String() },
+		set: func(config *Config, value string) (err error) {
+			*field(config), err = time.ParseDuration(value)
+			return
+		},
+	}
+}
+
+var configSettings = []configSetting{
+	intSetting("listen_port", "Port the HTTP server listens on",
+		func(config *Config) *int { return &config.ListenPort }),
+	durationSetting("read_timeout", "Maximum duration for reading a request",
+		func(config *Config) *time.Duration { return &config.ReadTimeout }),
+	durationSetting("write_timeout", "Maximum duration for writing a response",
+		func(config *Config) *time.Duration { return &config.WriteTimeout }),
+	durationSetting("request_timeout", "Deadline for each API request, including its MongoDb queries",
+		func(config *Config) *time.Duration { return &config.RequestTimeout }).reloadOnHangup(),
+	durationSetting("export_timeout", "Deadline for each export, after which its stream is cut",
+		func(config *Config) *time.Duration { return &config.ExportTimeout }).reloadOnHangup(),
+	boolSetting("validate_requests", "Reject request bodies that don't match /openapi.json with a 400",
+		func(config *Config) *bool { return &config.ValidateRequests }).reloadOnHangup(),
+	moneySetting("pricing_unlock_fee", "Amount charged once per ride",
+		func(config *Config) *int64 { return &config.Pricing.UnlockFee }).reloadOnHangup(),
+	moneySetting("pricing_per_minute", "Amount charged for every started minute of a ride",
+		func(config *Config) *int64 { return &config.Pricing.PerMinute }).reloadOnHangup(),
+	moneySetting("pricing_daily_cap", "Most the minutes of each started 24 hours of a ride cost, 0 for no cap",
+		func(config *Config) *int64 { return &config.Pricing.DailyCap }).reloadOnHangup(),
+	moneySetting("pricing_minimum_charge", "Least a ride costs",
+		func(config *Config) *int64 { return &config.Pricing.MinimumCharge }).reloadOnHangup(),
+	stringSetting("pricing_currency", "ISO 4217 currency of the pricing amounts, and so of new invoices",
+		func(config *Config) *string { return &config.PricingCurrency }).reloadOnHangup(),
+	stringSetting("invoice_number_prefix", "Prefix of the invoice numbers of vendors without their own, e.g. INV",
+		func(config *Config) *string { return &config.InvoiceNumberPrefix }).reloadOnHangup(),
+	stringSetting("posted_amounts", "What to do with amounts posted with invoices: ignore or reject",
+		func(config *Config) *string { return &config.PostedAmounts }).reloadOnHangup(),
+	intSetting("payout_platform_fee_bps", "Platform fee deducted from vendor payouts, in basis points (1/100 %)",
+		func(config *Config) *int { return &config.PayoutPlatformFeeBps }).reloadOnHangup(),
+	stringSetting("payout_originator_name", "Name payout files are sent by",
+		func(config *Config) *string { return &config.PayoutOriginator.Name }).reloadOnHangup(),
+	stringSetting("payout_originator_id", "NACHA company identification payout files are sent by",
+		func(config *Config) *string { return &config.PayoutOriginator.ID }).reloadOnHangup(),
+	stringSetting("payout_originator_routing_number", "ABA routing number of the account payouts are paid from",
+		func(config *Config) *string { return &config.PayoutOriginator.RoutingNumber }).reloadOnHangup(),
+	stringSetting("payout_originator_account_number", "Number of the account payouts are paid from",
+		func(config *Config) *string { return &config.PayoutOriginator.AccountNumber }).redacted().reloadOnHangup(),
+	stringSetting("payout_bank_name", "Name of the bank payout files are sent to",
+		func(config *Config) *string { return &config.PayoutOriginator.BankName }).reloadOnHangup(),
+	stringSetting("tax_rules_file", "YAML or JSON file of the tax rules of each jurisdiction",
+		func(config *Config) *string { return &config.TaxRulesFile }).reloadOnHangup(),
+	stringSetting("base_currency", "ISO 4217 currency vendors without their own are paid and reported in",
+		func(config *Config) *string { return &config.BaseCurrency }).reloadOnHangup(),
+	stringSetting("exchange_rates_file", "YAML or JSON file of exchange rates by effective date",
+		func(config *Config) *string { return &config.ExchangeRatesFile }).reloadOnHangup(),
+	stringSetting("mongo_connectionstring", "MongoDb connection string",
+		func(config *Config) *string { return &config.MongoDbConnectionString }).redacted(),
+	stringSetting("mongo_dbname", "MongoDb database name",
+		func(config *Config) *string { return &config.MongoDbName }),
+	intSetting("mongo_pool_limit", "Most sockets opened to each MongoDb server",
+		func(config *Config) *int { return &config.MongoDbPoolLimit }),
+	intSetting("mongo_connect_maxattempts", "Attempts to dial MongoDb at startup, 0 retries forever",
+		func(config *Config) *int { return &config.MongoDbReconnect.MaxAttempts }).reloadOnHangup(),
+	durationSetting("mongo_backoff_initial", "First interval between MongoDb connection attempts",
+		func(config *Config) *time.Duration { return &config.MongoDbReconnect.InitialInterval }).reloadOnHangup(),
+	durationSetting("mongo_backoff_max", "Longest interval between MongoDb connection attempts",
+		func(config *Config) *time.Duration { return &config.MongoDbReconnect.MaxInterval }).reloadOnHangup(),
+	floatSetting("mongo_backoff_multiplier", "Growth factor between MongoDb connection attempts",
+		func(config *Config) *float64 { return &config.MongoDbReconnect.Multiplier }).reloadOnHangup(),
+	floatSetting("mongo_backoff_jitter", "Fraction (0-1) of each backoff interval that is randomized",
+		func(config *Config) *float64 { return &config.MongoDbReconnect.Jitter }).reloadOnHangup(),
+	intSetting("mongo_breaker_threshold", "Consecutive failed MongoDb pings before requests fail fast",
+		func(config *Config) *int { return &config.MongoDbBreakerThreshold }).reloadOnHangup(),
+	durationSetting("shutdown_delay", "Time between reporting not-ready and closing the listener",
+		func(config *Config) *time.Duration { return &config.ShutdownDelay }).reloadOnHangup(),
+	durationSetting("shutdown_timeout", "Time in-flight requests are given to finish on shutdown",
+		func(config *Config) *time.Duration { return &config.ShutdownTimeout }).reloadOnHangup(),
+}
+
+// LoadConfig builds the configuration from, in increasing order of precedence, the defaults,
+// the config file, the environment and the command line arguments
+func LoadConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+
+	flagSet := flag.NewFlagSet("billing", flag.ContinueOnError)
+	configFile := flagSet.String(configFileFlagName, os.Getenv(configFileEnvName), "YAML or JSON file to read settings from")
+	for _, setting := range configSettings {
+		flagSet.String(setting.name, "", setting.usage)
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return config, err
+	}
+
+	if *configFile != "" {
+		fileValues, err := readConfigFile(*configFile)
+		if err != nil {
+			return config, err
+		}
+		if err := applyConfigValues(&config, fileValues, fmt.Sprintf("config file '%s'", *configFile)); err != nil {
+			return config, err
+		}
+	}
+
+	envValues := map[string]string{}
+	for _, setting := range configSettings {
+		if value := os.Getenv(setting.name); value != "" {
+			envValues[setting.name] = value
+		}
+	}
+	if err := applyConfigValues(&config, envValues, "environment"); err != nil {
+		return config, err
+	}
+
+	flagValues := map[string]string{}
+	flagSet.Visit(func(f *flag.Flag) {
+		if f.Name != configFileFlagName {
+			flagValues[f.Name] = f.Value.String()
+		}
+	})
+	if err := applyConfigValues(&config, flagValues, "command line"); err != nil {
+		return config, err
+	}
+
+	if config.TaxRulesFile != "" {
+		rules, err := LoadTaxRules(config.TaxRulesFile)
+		if err != nil {
+			return config, err
+		}
+		config.TaxRules = rules
+	}
+	if config.ExchangeRatesFile != "" {
+		rates, err := LoadExchangeRates(config.ExchangeRatesFile)
+		if err != nil {
+			return config, err
+		}
+		config.ExchangeRates = rates
+	}
+
+	return config, config.Validate()
+}
+
+// readConfigFile reads a flat YAML or JSON document of setting names to values
+func readConfigFile(path string) (map[string]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading config file: %v", err)
+	}
+
+	// JSON is valid YAML, so one parser handles both
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(contents, &document); err != nil {
+		return nil, fmt.Errorf("Parsing config file '%s': %v", path, err)
+	}
+
+	values := make(map[string]string, len(document))
+	for name, value := range document {
+		switch value.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return nil, fmt.Errorf("Config file '%s': '%s' must be a single value", path, name)
+		}
+		values[name] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+func applyConfigValues(config *Config, values map[string]string, source string) error {
+	for name, value := range values {
+		setting, ok := findConfigSetting(name)
+		if !ok {
+			return fmt.Errorf("%s: unknown setting '%s'", source, name)
+		}
+		if err := setting.set(config, value); err != nil {
+			return fmt.Errorf("%s: %s: %v", source, name, err)
+		}
+	}
+	return nil
+}
+
+func findConfigSetting(name string) (configSetting, bool) {
+	for _, setting := range configSettings {
+		if setting.name == name {
+			return setting, true
+		}
+	}
+	return configSetting{}, false
+}
+
+// exportTimeout is the deadline of an export: export_timeout, unless the server's write timeout cuts
+// the response first
+func (config Config) exportTimeout() time.Duration {
+	if config.WriteTimeout > 0 && config.WriteTimeout < config.ExportTimeout {
+		return config.WriteTimeout
+	}
+	return config.ExportTimeout
+}
+
+// Validate returns a non-nil error listing every invalid setting
+func (config Config) Validate() error {
+	var errorSlice []string
+
+	if config.ListenPort < 1 || config.ListenPort > 65535 {
+		errorSlice = append(errorSlice, "listen_port must be between 1 and 65535")
+	}
+	if config.ReadTimeout < 0 || config.WriteTimeout < 0 {
+		errorSlice = append(errorSlice, "read_timeout and write_timeout must not be negative")
+	}
+	if config.RequestTimeout <= 0 {
+		errorSlice = append(errorSlice, "request_timeout must be positive")
+	}
+	if config.ExportTimeout <= 0 {
+		errorSlice = append(errorSlice, "export_timeout must be positive")
+	}
+	if config.Pricing.UnlockFee < 0 || config.Pricing.PerMinute < 0 || config.Pricing.DailyCap < 0 || config.Pricing.MinimumCharge < 0 {
+		errorSlice = append(errorSlice, "pricing_unlock_fee, pricing_per_minute, pricing_daily_cap and pricing_minimum_charge must not be negative")
+	}
+	if !validCurrency(config.PricingCurrency) || !validCurrency(config.BaseCurrency) {
+		errorSlice = append(errorSlice, "pricing_currency and base_currency must be ISO 4217 codes with two decimals, e.g. USD")
+	}
+	if !invoicePrefixPattern.MatchString(config.InvoiceNumberPrefix) {
+		errorSlice = append(errorSlice, "invoice_number_prefix must be 2 to 10 uppercase letters or digits")
+	}
+	if config.PostedAmounts != postedAmountsIgnore && config.PostedAmounts != postedAmountsReject {
+		errorSlice = append(errorSlice, fmt.Sprintf("posted_amounts must be %s or %s", postedAmountsIgnore, postedAmountsReject))
+	}
+	if config.PayoutPlatformFeeBps < 0 || config.PayoutPlatformFeeBps > basisPoints {
+		errorSlice = append(errorSlice, "payout_platform_fee_bps must be between 0 and 10000")
+	}
+	if config.PayoutOriginator.RoutingNumber != "" && !isRoutingNumber(config.PayoutOriginator.RoutingNumber) {
+		errorSlice = append(errorSlice, "payout_originator_routing_number must be an ABA routing number")
+	}
+	if config.MongoDbConnectionString == "" {
+		errorSlice = append(errorSlice, "Must specify mongo_connectionstring")
+	}
+	if config.MongoDbName == "" {
+		errorSlice = append(errorSlice, "Must specify mongo_dbname")
+	}
+	if config.MongoDbPoolLimit < 1 {
+		errorSlice = append(errorSlice, "mongo_pool_limit must be at least 1")
+	}
+	if config.MongoDbReconnect.MaxAttempts < 0 {
+		errorSlice = append(errorSlice, "mongo_connect_maxattempts must not be negative")
+	}
+	if config.MongoDbReconnect.InitialInterval <= 0 || config.MongoDbReconnect.MaxInterval < config.MongoDbReconnect.InitialInterval {
+		errorSlice = append(errorSlice, "mongo_backoff_initial must be positive and not more than mongo_backoff_max")
+	}
+	if config.MongoDbReconnect.Multiplier < 1 {
+		errorSlice = append(errorSlice, "mongo_backoff_multiplier must be at least 1")
+	}
+	if config.MongoDbReconnect.Jitter < 0 || config.MongoDbReconnect.Jitter > 1 {
+		errorSlice = append(errorSlice, "mongo_backoff_jitter must be between 0 and 1")
+	}
+	if config.MongoDbBreakerThreshold < 1 {
+		errorSlice = append(errorSlice, "mongo_breaker_threshold must be at least 1")
+	}
+	if config.ShutdownDelay < 0 || config.ShutdownTimeout < 0 {
+		errorSlice = append(errorSlice, "shutdown_delay and shutdown_timeout must not be negative")
+	}
+
+	if len(errorSlice) > 0 {
+		errorBytes, err := json.Marshal(errorSlice)
+		if err != nil {
+			return AddMyInfoToErr(err)
+		}
+
+		return errors.New(string(errorBytes))
+	}
+
+	return nil
+}
+
+// Redacted returns the configuration as JSON with secrets hidden, for logging
+func (config Config) Redacted() string {
+	values := make(map[string]string, len(configSettings))
+	for _, setting := range configSettings {
+		value := setting.get(&config)
+		if setting.secret {
+			value = redactSecret(value)
+		}
+		values[setting.name] = value
+	}
+
+	// Marshalling a map sorts its keys, keeping the output stable
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return string(encoded)
+}
+
+// redactSecret hides a secret, keeping the scheme and hosts of URLs readable
+func redactSecret(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return redactedValue
+	}
+	if parsed.User != nil {
+		parsed.User = url.UserPassword(redactedValue, redactedValue)
+	}
+	parsed.RawQuery = ""
+	return parsed.String()
+}
+
+// withReloadedSettings returns a copy of config with the SIGHUP-reloadable settings taken from reloaded
+func (config Config) withReloadedSettings(reloaded Config) Config {
+	for _, setting := range configSettings {
+		if setting.reloadable {
+			// The value came from a validated Config, so it parses
+			setting.set(&config, setting.get(&reloaded))
+		}
+	}
+	// The tax rules and exchange rates were re-read along with their files
+	config.TaxRules = reloaded.TaxRules
+	config.ExchangeRates = reloaded.ExchangeRates
+	return config
+}
@@ -10,10 +10,12 @@ import (
 
 type Customer struct {
 	ID       string `bson:"id" json:"id"`
-	UserID   string `bson:"userId" json:"userId"`
-	CCNumber string `bson:"ccNumber" json:"ccNumber"`
-	CCExpiry string `bson:"ccExpiry" json:"ccExpiry"`
-	CCCCV    string `bson:"ccCCV" json:"ccCCV"`
+	UserID   string `bson:"userId" json:"userId" openapi:"required"`
+	CCNumber string `bson:"ccNumber" json:"ccNumber" openapi:"required"`
+	CCExpiry string `bson:"ccExpiry" json:"ccExpiry" openapi:"required"`
+	CCCCV    string `bson:"ccCCV" json:"ccCCV" openapi:"required"`
+	// Jurisdiction is where the customer is taxed when their vendor has no jurisdiction, e.g. DE or US-WA
+	Jurisdiction string `bson:"jurisdiction,omitempty" json:"jurisdiction,omitempty"`
 }
 
 // Serialize serializes a customer to JSON
@@ -48,6 +50,9 @@ func ValidateCustomer(cust Customer) error {
 	if cust.CCCCV == zeroString {
 		errorSlice = append(errorSlice, "Must specify CCCCV string")
 	}
+	if cust.Jurisdiction != zeroString && !jurisdictionPattern.MatchString(cust.Jurisdiction) {
+		errorSlice = append(errorSlice, "Jurisdiction must be an ISO 3166 code, e.g. DE or US-WA")
+	}
 
 	if len(errorSlice) > 0 {
 		errorBytes, err := json.Marshal(errorSlice)
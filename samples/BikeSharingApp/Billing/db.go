@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -16,15 +17,111 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Store is the persistence used by the Billing handlers
+type Store interface {
+	// AddInvoice returns an error satisfying mgo.IsDup if the invoice's reservation already has an invoice,
+	// or its number is taken
+	AddInvoice(context *RequestContext, inv Invoice) (bson.ObjectId, error)
+	GetCustomerInvoices(context *RequestContext, userID string) ([]Invoice, error)
+	GetVendorInvoices(context *RequestContext, userID string) ([]Invoice, error)
+	GetInvoiceById(context *RequestContext, ID string) (Invoice, bool, error)
+	GetInvoiceForReservationId(context *RequestContext, reservationId string) (Invoice, bool, error)
+	GetInvoiceByNumber(context *RequestContext, number string) (Invoice, bool, error)
+	// NextInvoiceNumber takes the lowest number given back to the series, or else its next number,
+	// counting from 1. Concurrent callers never get the same number.
+	NextInvoiceNumber(context *RequestContext, series string) (int64, error)
+	// ReleaseInvoiceNumber gives back a number whose invoice wasn't added, so that it's taken again
+	ReleaseInvoiceNumber(context *RequestContext, series string, number int64) error
+	// ReserveInvoiceRefund adds amount cents to what was refunded of the invoice, unless that would exceed
+	// total. It returns false when it would.
+	ReserveInvoiceRefund(context *RequestContext, ID string, amount, total int64) (bool, error)
+	// ReleaseInvoiceRefund takes back a reserved refund that didn't happen
+	ReleaseInvoiceRefund(context *RequestContext, ID string, amount int64) error
+	// SetInvoicePaymentReference records the payment processor's reference of the invoice's charge
+	SetInvoicePaymentReference(context *RequestContext, ID, reference string) error
+	// SetInvoiceRefundReference records the payment processor's reference of the credit note's refund
+	SetInvoiceRefundReference(context *RequestContext, ID, reference string) error
+	// ExportInvoices calls each with the invoices matching filter, oldest first, stopping once each fails
+	ExportInvoices(context *RequestContext, filter InvoiceExportFilter, each func(Invoice) error) error
+
+	AddVendor(context *RequestContext, ven Vendor) (bson.ObjectId, error)
+	UpdateVendorByUserId(context *RequestContext, ven Vendor) error
+	GetVendorByUserId(context *RequestContext, userID string) (Vendor, bool, error)
+
+	AddCustomer(context *RequestContext, cust Customer) (bson.ObjectId, error)
+	UpdateCustomerByUserId(context *RequestContext, cust Customer) error
+	GetCustomerByUserId(context *RequestContext, userID string) (Customer, bool, error)
+
+	// GetPayableVendors returns the vendors with invoices created before before that aren't in a payout
+	GetPayableVendors(context *RequestContext, before time.Time) ([]string, error)
+	// ClaimPayoutInvoices adds the vendor's invoices created before before that aren't in a payout to
+	// the payout, returning them. An invoice is only ever claimed by one payout.
+	ClaimPayoutInvoices(context *RequestContext, vendorID string, before time.Time, payoutID bson.ObjectId) ([]Invoice, error)
+	// ReleasePayoutInvoices removes the payout's invoices from it, so that another can claim them
+	ReleasePayoutInvoices(context *RequestContext, payoutID bson.ObjectId) error
+	AddPayout(context *RequestContext, payout Payout) error
+	GetPayouts(context *RequestContext, filter PayoutFilter) ([]Payout, error)
+	GetPayoutById(context *RequestContext, ID string) (Payout, bool, error)
+	// UpdatePayout replaces the payout, returning false if its status is no longer fromStatus
+	UpdatePayout(context *RequestContext, payout Payout, fromStatus string) (bool, error)
+	// AddPromotion adds the promotion, returning false if its code is taken
+	AddPromotion(context *RequestContext, promo Promotion) (bool, error)
+	GetPromotions(context *RequestContext) ([]Promotion, error)
+	GetPromotionByCode(context *RequestContext, code string) (Promotion, bool, error)
+	// RedeemPromotion counts a redemption of the promotion by the customer, returning false if that would
+	// exceed either of its limits
+	RedeemPromotion(context *RequestContext, promo Promotion, customerID string) (bool, error)
+	// ReleasePromotion takes back a redemption whose invoice wasn't added
+	ReleasePromotion(context *RequestContext, promo Promotion, customerID string) error
+	// AddExchangeRate adds the rate, returning false if its pair already has one taking effect that day
+	AddExchangeRate(context *RequestContext, rate ExchangeRate) (bool, error)
+	// GetExchangeRates returns the rates added through the API. Empty currencies don't filter.
+	GetExchangeRates(context *RequestContext, from, to string) ([]ExchangeRate, error)
+	// GetExchangeRate returns the pair's rate added through the API in effect on day, YYYY-MM-DD
+	GetExchangeRate(context *RequestContext, from, to, day string) (ExchangeRate, bool, error)
+	// PostJournalEntry adds the entry, returning false if an entry with its ID was already posted
+	PostJournalEntry(context *RequestContext, entry JournalEntry) (bool, error)
+	// GetJournalEntries returns the entries matching filter in the order they were posted
+	GetJournalEntries(context *RequestContext, filter JournalEntryFilter) ([]JournalEntry, error)
+	// GetAccountBalances sums the debits and credits of the account, or of every account when empty, in
+	// each currency. Entries posted at or after before aren't counted, unless it's zero.
+	GetAccountBalances(context *RequestContext, account string, before time.Time) ([]AccountBalance, error)
+
+	Ping() error
+	Refresh()
+	Shutdown()
+}
+
+// MongoDbConnection is the MongoDb backed Store. Each operation runs on its own session copied
+// from the pool, so concurrent requests don't serialize on one socket.
 type MongoDbConnection struct {
-	Name       string
+	Name      string
+	session   *mgo.Session
+	dbName    string
+	closeOnce sync.Once
+	logger    *Logger
+}
+
+// dbRequest is a session copied from the pool for one operation of a request
+type dbRequest struct {
+	ctx        context.Context
 	session    *mgo.Session
-	dbName     string
 	invoiceDb  *mgo.Collection
 	vendorDb   *mgo.Collection
 	customerDb *mgo.Collection
-	shutdownWg *sync.WaitGroup
-	isShutdown bool
+	payoutDb   *mgo.Collection
+	promoDb    *mgo.Collection
+	// redemptionDb counts each customer's redemptions of promotions limited per customer
+	redemptionDb *mgo.Collection
+	rateDb       *mgo.Collection
+	// invoiceNumberDb holds the last number taken in each invoice number series
+	invoiceNumberDb *mgo.Collection
+	ledgerDb        *mgo.Collection
+}
+
+// Close returns the request's socket to the pool
+func (request *dbRequest) Close() {
+	request.session.Close()
 }
 
 type invoiceDbEntity struct {
@@ -42,24 +139,125 @@ type customerDbEntity struct {
 	Customer Customer      `bson:"customer" json:"customer"`
 }
 
+type payoutDbEntity struct {
+	ID     bson.ObjectId `bson:"_id" json:"_id"`
+	Payout Payout        `bson:"payout" json:"payout"`
+}
+
+// journalEntryDbEntity is keyed by the entry's kind and reference, so that each event is posted once
+type journalEntryDbEntity struct {
+	ID    string       `bson:"_id" json:"_id"`
+	Entry JournalEntry `bson:"entry" json:"entry"`
+}
+
+// invoiceNumberDbEntity counts the numbers taken in an invoice number series. Free lists, in ascending
+// order, the numbers given back before a later one was taken, which are taken again first.
+type invoiceNumberDbEntity struct {
+	Series string  `bson:"_id" json:"_id"`
+	Last   int64   `bson:"last" json:"last"`
+	Free   []int64 `bson:"free,omitempty" json:"free,omitempty"`
+}
+
+// exchangeRateDbEntity is keyed by the rate's pair and effective date, so that a pair has one rate a day
+type exchangeRateDbEntity struct {
+	ID   string       `bson:"_id" json:"_id"`
+	Rate ExchangeRate `bson:"rate" json:"rate"`
+}
+
+// promotionDbEntity is keyed by the promotion's code, which keeps codes unique
+type promotionDbEntity struct {
+	Code      string    `bson:"_id" json:"_id"`
+	Promotion Promotion `bson:"promotion" json:"promotion"`
+}
+
+// InvoiceExportFilter selects the invoices to export. Zero fields don't filter.
+type InvoiceExportFilter struct {
+	CustomerID string
+	VendorID   string
+	// From and To bound when the invoices were created, to the second. To is excluded.
+	From time.Time
+	To   time.Time
+	// After resumes an export after the invoice with this ID
+	After bson.ObjectId
+	// Limit is the most invoices to export
+	Limit int
+}
+
+// exportBatchSize is how many documents an export fetches from MongoDb at a time
+const exportBatchSize = 500
+
 const (
 	InvoiceCollection  = "Invoice"
 	VendorCollection   = "Vendor"
 	CustomerCollection = "Customer"
+	PayoutCollection   = "Payout"
+
+	PromotionCollection           = "Promotion"
+	PromotionRedemptionCollection = "PromotionRedemption"
+	ExchangeRateCollection        = "ExchangeRate"
+	InvoiceNumberCollection       = "InvoiceNumber"
+	LedgerCollection              = "Ledger"
 )
 
+const mongoDialTimeout = 10 * time.Second
+
+// invoiceReservationIndex names the unique index of the reservations' invoices
+const invoiceReservationIndex = "invoice.reservationId_invoice"
+
+// copySession copies a session from the pool for an operation of the request. The request's deadline
+// bounds the session's socket timeouts and, server side, the time queries may run.
+func (dbConn *MongoDbConnection) copySession(requestContext *RequestContext) *dbRequest {
+	session := dbConn.session.Copy()
+	ctx := requestContext.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			// Already expired, the operation will fail with the context's error
+			timeout = time.Millisecond
+		}
+		session.SetSocketTimeout(timeout)
+		session.SetSyncTimeout(timeout)
+	}
+
+	db := session.DB(dbConn.dbName)
+	return &dbRequest{
+		ctx:        ctx,
+		session:    session,
+		invoiceDb:  db.C(InvoiceCollection),
+		vendorDb:   db.C(VendorCollection),
+		customerDb: db.C(CustomerCollection),
+		payoutDb:   db.C(PayoutCollection),
+
+		promoDb:      db.C(PromotionCollection),
+		redemptionDb: db.C(PromotionRedemptionCollection),
+		rateDb:       db.C(ExchangeRateCollection),
+
+		invoiceNumberDb: db.C(InvoiceNumberCollection),
+		ledgerDb:        db.C(LedgerCollection),
+	}
+}
+
 func (dbConn *MongoDbConnection) AddInvoice(context *RequestContext, inv Invoice) (bson.ObjectId, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
 	objectID := bson.NewObjectId()
-	err := insertDb(dbConn.invoiceDb, invoiceDbEntity{objectID, inv})
-	if err != nil {
+	err := insertDb(request.ctx, request.invoiceDb, invoiceDbEntity{objectID, inv})
+	if err != nil && !mgo.IsDup(err) {
 		err = fmt.Errorf("Inserting Invoice: %v", err)
 	}
 	return objectID, err
 }
 
 func getInvoicesWithQuery(dbConn *MongoDbConnection, context *RequestContext, query bson.M) ([]Invoice, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
 	var userInvoiceEntities []invoiceDbEntity
-	err := findQueryDb(dbConn.invoiceDb, query, &userInvoiceEntities)
+	err := findQueryDb(request.ctx, request.invoiceDb, query, &userInvoiceEntities)
 	if err != nil {
 		return nil, fmt.Errorf("Querying for user invoices: %v", err)
 	}
@@ -86,8 +284,10 @@ func (dbConn *MongoDbConnection) GetVendorInvoices(context *RequestContext, user
 }
 
 func (dbConn *MongoDbConnection) GetInvoiceById(context *RequestContext, ID string) (Invoice, bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
 	var invEntity invoiceDbEntity
-	err := findByIDDb(dbConn.invoiceDb, ID, &invEntity)
+	err := findByIDDb(request.ctx, request.invoiceDb, ID, &invEntity)
 	if err != nil {
 		switch err {
 		case mgo.ErrNotFound:
@@ -102,7 +302,8 @@ func (dbConn *MongoDbConnection) GetInvoiceById(context *RequestContext, ID stri
 }
 
 func (dbConn *MongoDbConnection) GetInvoiceForReservationId(context *RequestContext, reservationId string) (Invoice, bool, error) {
-	invoices, err := getInvoicesWithQuery(dbConn, context, bson.M{"invoice.reservationId": reservationId})
+	// The reservation's credit notes share its reservationId
+	invoices, err := getInvoicesWithQuery(dbConn, context, bson.M{"invoice.reservationId": reservationId, "invoice.kind": bson.M{"$ne": invoiceKindCreditNote}})
 	if err != nil {
 		return Invoice{}, false, err
 	}
@@ -113,9 +314,192 @@ func (dbConn *MongoDbConnection) GetInvoiceForReservationId(context *RequestCont
 	return invoices[0], true, err
 }
 
+func (dbConn *MongoDbConnection) GetInvoiceByNumber(context *RequestContext, number string) (Invoice, bool, error) {
+	invoices, err := getInvoicesWithQuery(dbConn, context, bson.M{"invoice.number": number})
+	if err != nil {
+		return Invoice{}, false, err
+	}
+	if len(invoices) == 0 {
+		return Invoice{}, false, nil
+	}
+
+	return invoices[0], true, nil
+}
+
+func (dbConn *MongoDbConnection) NextInvoiceNumber(context *RequestContext, series string) (int64, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	// Popping the lowest free number reads it atomically from the document before the change
+	var entity invoiceNumberDbEntity
+	reuse := mgo.Change{Update: bson.M{"$pop": bson.M{"free": -1}}}
+	err := runWithContext(request.ctx, func() error {
+		_, err := request.invoiceNumberDb.Find(bson.M{"_id": series, "free.0": bson.M{"$exists": true}}).Apply(reuse, &entity)
+		return err
+	})
+	if err == nil {
+		return entity.Free[0], nil
+	}
+	if err != mgo.ErrNotFound {
+		return 0, fmt.Errorf("Taking a free invoice number: %v", err)
+	}
+
+	// findAndModify increments and reads the counter atomically. Two replicas starting a series at once
+	// may both try to insert its counter; the one that loses retries, incrementing the winner's.
+	change := mgo.Change{Update: bson.M{"$inc": bson.M{"last": 1}}, Upsert: true, ReturnNew: true}
+	for attempt := 0; attempt < 2; attempt++ {
+		err = runWithContext(request.ctx, func() error {
+			_, err := request.invoiceNumberDb.FindId(series).Apply(change, &entity)
+			return err
+		})
+		if !mgo.IsDup(err) {
+			break
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Taking the next invoice number: %v", err)
+	}
+	return entity.Last, nil
+}
+
+func (dbConn *MongoDbConnection) ReleaseInvoiceNumber(context *RequestContext, series string, number int64) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	// The last number is given back to the counter, so that numbers stay in order where they can
+	err := runWithContext(request.ctx, func() error {
+		return request.invoiceNumberDb.Update(bson.M{"_id": series, "last": number}, bson.M{"$inc": bson.M{"last": -1}})
+	})
+	if err == mgo.ErrNotFound {
+		// A later number was taken meanwhile, so the number waits in the free list to be taken again
+		err = runWithContext(request.ctx, func() error {
+			return request.invoiceNumberDb.UpdateId(series, bson.M{"$push": bson.M{"free": bson.M{"$each": []int64{number}, "$sort": 1}}})
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("Releasing invoice number: %v", err)
+	}
+	return nil
+}
+
+func (dbConn *MongoDbConnection) ReserveInvoiceRefund(context *RequestContext, ID string, amount, total int64) (bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	// Matching and incrementing in one update keeps concurrent refunds from both passing the check
+	selector := bson.M{
+		"_id": bson.ObjectIdHex(ID),
+		"$or": []bson.M{
+			{"invoice.refunded": bson.M{"$exists": false}},
+			{"invoice.refunded": bson.M{"$lte": total - amount}},
+		},
+	}
+	err := runWithContext(request.ctx, func() error {
+		return request.invoiceDb.Update(selector, bson.M{"$inc": bson.M{"invoice.refunded": amount}})
+	})
+	switch err {
+	case nil:
+		return true, nil
+	case mgo.ErrNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Reserving Invoice refund: %v", err)
+	}
+}
+
+func (dbConn *MongoDbConnection) ReleaseInvoiceRefund(context *RequestContext, ID string, amount int64) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	err := runWithContext(request.ctx, func() error {
+		return request.invoiceDb.UpdateId(bson.ObjectIdHex(ID), bson.M{"$inc": bson.M{"invoice.refunded": -amount}})
+	})
+	if err != nil {
+		return fmt.Errorf("Releasing Invoice refund: %v", err)
+	}
+	return nil
+}
+
+func (dbConn *MongoDbConnection) SetInvoicePaymentReference(context *RequestContext, ID, reference string) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	err := runWithContext(request.ctx, func() error {
+		return request.invoiceDb.UpdateId(bson.ObjectIdHex(ID), bson.M{"$set": bson.M{"invoice.paymentReference": reference}})
+	})
+	if err != nil {
+		return fmt.Errorf("Setting Invoice payment reference: %v", err)
+	}
+	return nil
+}
+
+func (dbConn *MongoDbConnection) SetInvoiceRefundReference(context *RequestContext, ID, reference string) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	err := runWithContext(request.ctx, func() error {
+		return request.invoiceDb.UpdateId(bson.ObjectIdHex(ID), bson.M{"$set": bson.M{"invoice.refundReference": reference}})
+	})
+	if err != nil {
+		return fmt.Errorf("Setting Invoice refund reference: %v", err)
+	}
+	return nil
+}
+
+func (dbConn *MongoDbConnection) ExportInvoices(context *RequestContext, filter InvoiceExportFilter, each func(Invoice) error) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	query := bson.M{}
+	if filter.CustomerID != "" {
+		query["invoice.customerId"] = filter.CustomerID
+	}
+	if filter.VendorID != "" {
+		query["invoice.vendorId"] = filter.VendorID
+	}
+	// ObjectIds start with their creation time, so they order the invoices by it
+	ids := bson.M{}
+	if !filter.From.IsZero() {
+		ids["$gte"] = bson.NewObjectIdWithTime(filter.From)
+	}
+	if !filter.To.IsZero() {
+		ids["$lt"] = bson.NewObjectIdWithTime(filter.To)
+	}
+	if filter.After != "" {
+		ids["$gt"] = filter.After
+	}
+	if len(ids) > 0 {
+		query["_id"] = ids
+	}
+
+	// Only one batch is held in memory at a time. Fetching the next is bounded by the socket timeout.
+	iter := request.invoiceDb.Find(query).Sort("_id").Limit(filter.Limit).Batch(exportBatchSize).
+		SetMaxTime(maxQueryTime(request.ctx)).Iter()
+	var entity invoiceDbEntity
+	for iter.Next(&entity) {
+		if err := request.ctx.Err(); err != nil {
+			iter.Close()
+			return err
+		}
+		entity.Invoice.ID = entity.ID.Hex()
+		if err := each(entity.Invoice); err != nil {
+			iter.Close()
+			return err
+		}
+		entity = invoiceDbEntity{}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("Exporting invoices: %v", err)
+	}
+	return nil
+}
+
 func (dbConn *MongoDbConnection) AddVendor(context *RequestContext, ven Vendor) (bson.ObjectId, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
 	objectID := bson.NewObjectId()
-	err := insertDb(dbConn.vendorDb, vendorDbEntity{objectID, ven})
+	err := insertDb(request.ctx, request.vendorDb, vendorDbEntity{objectID, ven})
 	if err != nil {
 		err = fmt.Errorf("Inserting Vendor: %v", err)
 	}
@@ -123,16 +507,20 @@ func (dbConn *MongoDbConnection) AddVendor(context *RequestContext, ven Vendor)
 }
 
 func (dbConn *MongoDbConnection) UpdateVendorByUserId(context *RequestContext, ven Vendor) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
 	entity := vendorDbEntity{Vendor: ven}
-	if err := updateDb(dbConn.vendorDb, bson.M{"vendor.userId": ven.UserID}, entity); err != nil {
+	if err := updateDb(request.ctx, request.vendorDb, bson.M{"vendor.userId": ven.UserID}, entity); err != nil {
 		return fmt.Errorf("Updating Vendor: %v", err)
 	}
 	return nil
 }
 
 func (dbConn *MongoDbConnection) GetVendorByUserId(context *RequestContext, userID string) (Vendor, bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
 	var venEntity []vendorDbEntity
-	err := findQueryDb(dbConn.vendorDb, bson.M{"vendor.userId": userID}, &venEntity)
+	err := findQueryDb(request.ctx, request.vendorDb, bson.M{"vendor.userId": userID}, &venEntity)
 	if err != nil {
 		return Vendor{}, false, fmt.Errorf("Getting Vendor by ID: %v", err)
 	}
@@ -142,7 +530,7 @@ func (dbConn *MongoDbConnection) GetVendorByUserId(context *RequestContext, user
 	}
 
 	if len(venEntity) > 1 {
-		LogErrFormatWithContext(context, "Found %d vendors in DB with UserID '%s'", len(venEntity), userID)
+		dbConn.logger.LogErrFormatWithContext(context, "Found %d vendors in DB with UserID '%s'", len(venEntity), userID)
 	}
 
 	venEntity[0].Vendor.ID = venEntity[0].ID.Hex()
@@ -150,8 +538,11 @@ func (dbConn *MongoDbConnection) GetVendorByUserId(context *RequestContext, user
 }
 
 func (dbConn *MongoDbConnection) AddCustomer(context *RequestContext, cust Customer) (bson.ObjectId, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
 	objectID := bson.NewObjectId()
-	err := insertDb(dbConn.customerDb, customerDbEntity{objectID, cust})
+	err := insertDb(request.ctx, request.customerDb, customerDbEntity{objectID, cust})
 	if err != nil {
 		err = fmt.Errorf("Inserting Customer: %v", err)
 	}
@@ -159,16 +550,20 @@ func (dbConn *MongoDbConnection) AddCustomer(context *RequestContext, cust Custo
 }
 
 func (dbConn *MongoDbConnection) UpdateCustomerByUserId(context *RequestContext, cust Customer) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
 	entity := customerDbEntity{Customer: cust}
-	if err := updateDb(dbConn.customerDb, bson.M{"customer.userId": cust.UserID}, entity); err != nil {
+	if err := updateDb(request.ctx, request.customerDb, bson.M{"customer.userId": cust.UserID}, entity); err != nil {
 		return fmt.Errorf("Updating Customer: %v", err)
 	}
 	return nil
 }
 
 func (dbConn *MongoDbConnection) GetCustomerByUserId(context *RequestContext, userID string) (Customer, bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
 	var custEntity []customerDbEntity
-	err := findQueryDb(dbConn.customerDb, bson.M{"customer.userId": userID}, &custEntity)
+	err := findQueryDb(request.ctx, request.customerDb, bson.M{"customer.userId": userID}, &custEntity)
 	if err != nil {
 		return Customer{}, false, fmt.Errorf("Getting Customer by ID: %v", err)
 	}
@@ -178,42 +573,435 @@ func (dbConn *MongoDbConnection) GetCustomerByUserId(context *RequestContext, us
 	}
 
 	if len(custEntity) > 1 {
-		LogErrFormatWithContext(context, "Found %d customers in DB with UserID '%s'", len(custEntity), userID)
+		dbConn.logger.LogErrFormatWithContext(context, "Found %d customers in DB with UserID '%s'", len(custEntity), userID)
 	}
 
 	custEntity[0].Customer.ID = custEntity[0].ID.Hex()
 	return custEntity[0].Customer, true, nil
 }
 
+// payableInvoicesQuery selects the invoices created before before that aren't in a payout: invoices once
+// they've been charged, and credit notes once they've been refunded. Invoices stored without a kind predate
+// the payment reference, and aren't paid out.
+func payableInvoicesQuery(before time.Time) bson.M {
+	return bson.M{
+		"_id":              bson.M{"$lt": bson.NewObjectIdWithTime(before)},
+		"invoice.payoutId": bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"invoice.kind": invoiceKindInvoice, "invoice.paymentReference": bson.M{"$exists": true}},
+			{"invoice.kind": invoiceKindCreditNote, "invoice.refundReference": bson.M{"$exists": true}},
+		},
+	}
+}
+
+func (dbConn *MongoDbConnection) GetPayableVendors(context *RequestContext, before time.Time) ([]string, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	var vendorIDs []string
+	err := runWithContext(request.ctx, func() error {
+		return request.invoiceDb.Find(payableInvoicesQuery(before)).SetMaxTime(maxQueryTime(request.ctx)).
+			Distinct("invoice.vendorId", &vendorIDs)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Querying for payable vendors: %v", err)
+	}
+	return vendorIDs, nil
+}
+
+func (dbConn *MongoDbConnection) ClaimPayoutInvoices(context *RequestContext, vendorID string, before time.Time, payoutID bson.ObjectId) ([]Invoice, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	query := payableInvoicesQuery(before)
+	query["invoice.vendorId"] = vendorID
+	// Each invoice is updated atomically, so of concurrent claims only one matches it
+	err := runWithContext(request.ctx, func() error {
+		_, err := request.invoiceDb.UpdateAll(query, bson.M{"$set": bson.M{"invoice.payoutId": payoutID.Hex()}})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Claiming invoices for payout: %v", err)
+	}
+	return getInvoicesWithQuery(dbConn, context, bson.M{"invoice.payoutId": payoutID.Hex()})
+}
+
+func (dbConn *MongoDbConnection) ReleasePayoutInvoices(context *RequestContext, payoutID bson.ObjectId) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	err := runWithContext(request.ctx, func() error {
+		_, err := request.invoiceDb.UpdateAll(bson.M{"invoice.payoutId": payoutID.Hex()}, bson.M{"$unset": bson.M{"invoice.payoutId": ""}})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Releasing payout invoices: %v", err)
+	}
+	return nil
+}
+
+func (dbConn *MongoDbConnection) AddPayout(context *RequestContext, payout Payout) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	err := insertDb(request.ctx, request.payoutDb, payoutDbEntity{bson.ObjectIdHex(payout.ID), payout})
+	if err != nil {
+		return fmt.Errorf("Inserting Payout: %v", err)
+	}
+	return nil
+}
+
+func (dbConn *MongoDbConnection) GetPayouts(context *RequestContext, filter PayoutFilter) ([]Payout, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	query := bson.M{}
+	if filter.VendorID != "" {
+		query["payout.vendorId"] = filter.VendorID
+	}
+	if filter.Status != "" {
+		query["payout.status"] = filter.Status
+	}
+	var entities []payoutDbEntity
+	if err := findQueryDb(request.ctx, request.payoutDb, query, &entities); err != nil {
+		return nil, fmt.Errorf("Querying for payouts: %v", err)
+	}
+	payouts := make([]Payout, len(entities))
+	for i, entity := range entities {
+		entity.Payout.ID = entity.ID.Hex()
+		payouts[i] = entity.Payout
+	}
+	return payouts, nil
+}
+
+func (dbConn *MongoDbConnection) GetPayoutById(context *RequestContext, ID string) (Payout, bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+	var entity payoutDbEntity
+	err := findByIDDb(request.ctx, request.payoutDb, ID, &entity)
+	if err != nil {
+		switch err {
+		case mgo.ErrNotFound:
+			return Payout{}, false, nil
+		default:
+			return Payout{}, false, fmt.Errorf("Getting Payout by ID: %v", err)
+		}
+	}
+
+	entity.Payout.ID = entity.ID.Hex()
+	return entity.Payout, true, nil
+}
+
+func (dbConn *MongoDbConnection) UpdatePayout(context *RequestContext, payout Payout, fromStatus string) (bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	ID := bson.ObjectIdHex(payout.ID)
+	err := updateDb(request.ctx, request.payoutDb, bson.M{"_id": ID, "payout.status": fromStatus}, payoutDbEntity{ID, payout})
+	switch err {
+	case nil:
+		return true, nil
+	case mgo.ErrNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Updating Payout: %v", err)
+	}
+}
+
+func (dbConn *MongoDbConnection) AddPromotion(context *RequestContext, promo Promotion) (bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	err := insertDb(request.ctx, request.promoDb, promotionDbEntity{promo.Code, promo})
+	switch {
+	case err == nil:
+		return true, nil
+	case mgo.IsDup(err):
+		return false, nil
+	default:
+		return false, fmt.Errorf("Inserting Promotion: %v", err)
+	}
+}
+
+func (dbConn *MongoDbConnection) GetPromotions(context *RequestContext) ([]Promotion, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	var entities []promotionDbEntity
+	if err := findQueryDb(request.ctx, request.promoDb, bson.M{}, &entities); err != nil {
+		return nil, fmt.Errorf("Querying for promotions: %v", err)
+	}
+	promos := make([]Promotion, len(entities))
+	for i, entity := range entities {
+		promos[i] = entity.Promotion
+	}
+	return promos, nil
+}
+
+func (dbConn *MongoDbConnection) GetPromotionByCode(context *RequestContext, code string) (Promotion, bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	var entity promotionDbEntity
+	err := runWithContext(request.ctx, func() error {
+		return request.promoDb.FindId(code).SetMaxTime(maxQueryTime(request.ctx)).One(&entity)
+	})
+	switch err {
+	case nil:
+		return entity.Promotion, true, nil
+	case mgo.ErrNotFound:
+		return Promotion{}, false, nil
+	default:
+		return Promotion{}, false, fmt.Errorf("Getting Promotion by code: %v", err)
+	}
+}
+
+// promotionRedemptionID is the id of the document counting the customer's redemptions of the promotion
+func promotionRedemptionID(promo Promotion, customerID string) string {
+	return promo.Code + "/" + customerID
+}
+
+func (dbConn *MongoDbConnection) RedeemPromotion(context *RequestContext, promo Promotion, customerID string) (bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	// Each limit is checked and counted by a single conditional update, so replicas can't both take the
+	// last redemption
+	selector := bson.M{"_id": promo.Code}
+	if promo.MaxRedemptions > 0 {
+		selector["promotion.redemptions"] = bson.M{"$lt": promo.MaxRedemptions}
+	}
+	err := runWithContext(request.ctx, func() error {
+		return request.promoDb.Update(selector, bson.M{"$inc": bson.M{"promotion.redemptions": 1}})
+	})
+	switch err {
+	case nil:
+	case mgo.ErrNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Redeeming Promotion: %v", err)
+	}
+	if promo.MaxRedemptionsPerCustomer == 0 {
+		return true, nil
+	}
+
+	// Once the customer's count reaches the limit the selector stops matching, and the upsert fails
+	// inserting a second document with the same id
+	err = runWithContext(request.ctx, func() error {
+		_, err := request.redemptionDb.Upsert(
+			bson.M{"_id": promotionRedemptionID(promo, customerID), "count": bson.M{"$lt": promo.MaxRedemptionsPerCustomer}},
+			bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"code": promo.Code, "customerId": customerID}})
+		return err
+	})
+	if err == nil {
+		return true, nil
+	}
+	releaseErr := runWithContext(request.ctx, func() error {
+		return request.promoDb.UpdateId(promo.Code, bson.M{"$inc": bson.M{"promotion.redemptions": -1}})
+	})
+	if releaseErr != nil {
+		return false, fmt.Errorf("Releasing Promotion redemption: %v", releaseErr)
+	}
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("Redeeming Promotion for customer: %v", err)
+}
+
+func (dbConn *MongoDbConnection) ReleasePromotion(context *RequestContext, promo Promotion, customerID string) error {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	err := runWithContext(request.ctx, func() error {
+		return request.promoDb.UpdateId(promo.Code, bson.M{"$inc": bson.M{"promotion.redemptions": -1}})
+	})
+	if err == nil && promo.MaxRedemptionsPerCustomer > 0 {
+		err = runWithContext(request.ctx, func() error {
+			return request.redemptionDb.UpdateId(promotionRedemptionID(promo, customerID), bson.M{"$inc": bson.M{"count": -1}})
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("Releasing Promotion redemption: %v", err)
+	}
+	return nil
+}
+
+func (dbConn *MongoDbConnection) AddExchangeRate(context *RequestContext, rate ExchangeRate) (bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	ID := rate.From + "/" + rate.To + "/" + rate.EffectiveDate
+	err := insertDb(request.ctx, request.rateDb, exchangeRateDbEntity{ID, rate})
+	switch {
+	case err == nil:
+		return true, nil
+	case mgo.IsDup(err):
+		return false, nil
+	default:
+		return false, fmt.Errorf("Inserting ExchangeRate: %v", err)
+	}
+}
+
+func (dbConn *MongoDbConnection) GetExchangeRates(context *RequestContext, from, to string) ([]ExchangeRate, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	query := bson.M{}
+	if from != "" {
+		query["rate.from"] = from
+	}
+	if to != "" {
+		query["rate.to"] = to
+	}
+	var entities []exchangeRateDbEntity
+	if err := findQueryDb(request.ctx, request.rateDb, query, &entities); err != nil {
+		return nil, fmt.Errorf("Querying for exchange rates: %v", err)
+	}
+	rates := make([]ExchangeRate, len(entities))
+	for i, entity := range entities {
+		rates[i] = entity.Rate
+	}
+	return rates, nil
+}
+
+func (dbConn *MongoDbConnection) GetExchangeRate(context *RequestContext, from, to, day string) (ExchangeRate, bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	// Effective dates are YYYY-MM-DD, so they sort as text
+	query := bson.M{"rate.from": from, "rate.to": to, "rate.effectiveDate": bson.M{"$lte": day}}
+	var entity exchangeRateDbEntity
+	err := runWithContext(request.ctx, func() error {
+		return request.rateDb.Find(query).Sort("-rate.effectiveDate").SetMaxTime(maxQueryTime(request.ctx)).One(&entity)
+	})
+	switch err {
+	case nil:
+		return entity.Rate, true, nil
+	case mgo.ErrNotFound:
+		return ExchangeRate{}, false, nil
+	default:
+		return ExchangeRate{}, false, fmt.Errorf("Getting ExchangeRate: %v", err)
+	}
+}
+
+func (dbConn *MongoDbConnection) PostJournalEntry(context *RequestContext, entry JournalEntry) (bool, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	// The entry's ID names the event it records, so posting an event twice fails inserting the same id
+	err := insertDb(request.ctx, request.ledgerDb, journalEntryDbEntity{entry.ID, entry})
+	switch {
+	case err == nil:
+		return true, nil
+	case mgo.IsDup(err):
+		return false, nil
+	default:
+		return false, fmt.Errorf("Posting JournalEntry: %v", err)
+	}
+}
+
+// journalEntriesQuery selects the entries posted before before, unless it's zero
+func journalEntriesQuery(before time.Time) bson.M {
+	query := bson.M{}
+	if !before.IsZero() {
+		query["entry.postedAt"] = bson.M{"$lt": before}
+	}
+	return query
+}
+
+func (dbConn *MongoDbConnection) GetJournalEntries(context *RequestContext, filter JournalEntryFilter) ([]JournalEntry, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	query := journalEntriesQuery(filter.Before)
+	if filter.Account != "" {
+		query["entry.lines.account"] = filter.Account
+	}
+	if filter.Reference != "" {
+		query["entry.reference"] = filter.Reference
+	}
+	var entities []journalEntryDbEntity
+	err := runWithContext(request.ctx, func() error {
+		return request.ledgerDb.Find(query).Sort("entry.postedAt", "_id").SetMaxTime(maxQueryTime(request.ctx)).All(&entities)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Querying for journal entries: %v", err)
+	}
+	entries := make([]JournalEntry, len(entities))
+	for i, entity := range entities {
+		entries[i] = entity.Entry
+	}
+	return entries, nil
+}
+
+func (dbConn *MongoDbConnection) GetAccountBalances(context *RequestContext, account string, before time.Time) ([]AccountBalance, error) {
+	request := dbConn.copySession(context)
+	defer request.Close()
+
+	query := journalEntriesQuery(before)
+	lines := bson.M{}
+	if account != "" {
+		query["entry.lines.account"] = account
+		lines["entry.lines.account"] = account
+	}
+	pipeline := []bson.M{
+		{"$match": query},
+		{"$unwind": "$entry.lines"},
+		{"$match": lines},
+		{"$group": bson.M{
+			"_id":     bson.M{"account": "$entry.lines.account", "currency": "$entry.lines.currency"},
+			"debits":  bson.M{"$sum": "$entry.lines.debit"},
+			"credits": bson.M{"$sum": "$entry.lines.credit"},
+		}},
+		{"$project": bson.M{"_id": 0, "account": "$_id.account", "currency": "$_id.currency", "debits": 1, "credits": 1}},
+		{"$sort": bson.M{"account": 1, "currency": 1}},
+	}
+	var balances []AccountBalance
+	err := runWithContext(request.ctx, func() error {
+		return request.ledgerDb.Pipe(pipeline).All(&balances)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Summing account balances: %v", err)
+	}
+	return balances, nil
+}
+
 func (dbConn *MongoDbConnection) Ping() error {
 	return dbConn.session.Ping()
 }
 
+// Refresh discards the session's sockets so the next operation reconnects to the cluster
+func (dbConn *MongoDbConnection) Refresh() {
+	dbConn.session.Refresh()
+}
+
+// Shutdown closes the session. It is safe to call more than once.
 func (dbConn *MongoDbConnection) Shutdown() {
-	if !dbConn.isShutdown {
+	closed := false
+	dbConn.closeOnce.Do(func() {
 		dbConn.session.Close()
 		dbConn.log("MongoDb connection closed")
-		dbConn.shutdownWg.Done()
-		dbConn.isShutdown = true
-	} else {
-		LogErrFormat("Multiple Shutdown() called for '%s'", dbConn.Name)
+		closed = true
+	})
+	if !closed {
+		dbConn.logger.LogErrFormat("Multiple Shutdown() called for '%s'", dbConn.Name)
 	}
 }
 
 func (dbConn *MongoDbConnection) log(format string, args ...interface{}) {
-	logMessageTo(stdLogger, fmt.Sprintf("DB '%s': %s", dbConn.Name, format), args...)
+	logMessageTo(dbConn.logger.stdLogger, fmt.Sprintf("DB '%s': %s", dbConn.Name, format), args...)
 }
 
 func (dbConn *MongoDbConnection) logerr(format string, args ...interface{}) {
-	logMessageTo(errLogger, fmt.Sprintf("DB '%s': %s", dbConn.Name, format), args...)
+	logMessageTo(dbConn.logger.errLogger, fmt.Sprintf("DB '%s': %s", dbConn.Name, format), args...)
 }
 
-func NewDbConnection(connectionName, connectionString, dbName string, shutdownWg *sync.WaitGroup) (*MongoDbConnection, error) {
+// NewDbConnection dials MongoDb, retrying with the reconnect backoff until it succeeds or the attempts run out
+func NewDbConnection(connectionName, connectionString, dbName string, poolLimit int, reconnect BackoffPolicy, logger *Logger) (*MongoDbConnection, error) {
 	dbConn := &MongoDbConnection{
-		Name:       connectionName,
-		dbName:     dbName,
-		shutdownWg: shutdownWg,
-		isShutdown: false,
+		Name:   connectionName,
+		dbName: dbName,
+		logger: logger,
 	}
 
 	editedConnectionString := strings.Replace(connectionString, "ssl=true", "", -1) // 'ssl=true' not supported by mgo
@@ -233,67 +1021,146 @@ func NewDbConnection(connectionName, connectionString, dbName string, shutdownWg
 		}
 	}
 
+	if info.Timeout == 0 {
+		info.Timeout = mongoDialTimeout
+	}
+	if poolLimit > 0 {
+		info.PoolLimit = poolLimit
+	}
+
 	dbConn.log("Dialing MongoDb (%q)", info.Addrs)
-	maxTries := 5
-	for i := 1; i <= maxTries; i++ {
+	for attempt := 1; ; attempt++ {
 		dbConn.session, err = mgo.DialWithInfo(info)
 		if err == nil {
 			break
 		}
 
-		if i < maxTries {
-			dbConn.logerr("%d/%d - Couldn't connect, sleeping and trying again", i, maxTries)
-			time.Sleep(1 * time.Second)
-		} else {
-			dbConn.logerr("%d/%d - Couldn't connect.", i, maxTries)
+		if reconnect.Exhausted(attempt) {
+			dbConn.logerr("%d/%d - Couldn't connect.", attempt, reconnect.MaxAttempts)
+			break
 		}
+		wait := reconnect.Interval(attempt)
+		dbConn.logerr("Attempt %d - Couldn't connect, trying again in %v: %v", attempt, wait, err)
+		time.Sleep(wait)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("Failed to dial db (%s): %v", connectionString, err)
 	}
 	dbConn.log("Got MongoDb connection")
 
-	dbConn.invoiceDb = dbConn.session.DB(dbName).C(InvoiceCollection)
-	dbConn.vendorDb = dbConn.session.DB(dbName).C(VendorCollection)
-	dbConn.customerDb = dbConn.session.DB(dbName).C(CustomerCollection)
+	if err := dbConn.ensureIndexes(); err != nil {
+		dbConn.session.Close()
+		return nil, fmt.Errorf("Failed to create indexes: %v", err)
+	}
 
-	dbConn.shutdownWg.Add(1)
 	return dbConn, nil
 }
 
-func updateDb(db *mgo.Collection, selector bson.M, entity interface{}) error {
-	if err := db.Update(selector, entity); err != nil {
-		return err
+// ensureIndexes creates the indexes the queries and invariants rely on, if they don't exist yet
+func (dbConn *MongoDbConnection) ensureIndexes() error {
+	session := dbConn.session.Copy()
+	defer session.Close()
+
+	db := session.DB(dbConn.dbName)
+	// Invoices stored before invoices were numbered have no number
+	index := mgo.Index{Key: []string{"invoice.number"}, Unique: true, Sparse: true}
+	if err := db.C(InvoiceCollection).EnsureIndex(index); err != nil {
+		return fmt.Errorf("index on %v: %v", index.Key, err)
 	}
 
+	// A reservation has one invoice. Credit notes share its reservationId, and invoices stored before
+	// invoices had a kind may repeat it, so the index only covers invoices of kind invoice. mgo.Index
+	// can't express that filter, so the index is created with the command.
+	err := db.Run(bson.D{
+		{Name: "createIndexes", Value: InvoiceCollection},
+		{Name: "indexes", Value: []bson.M{{
+			"key":                     bson.D{{Name: "invoice.reservationId", Value: 1}},
+			"name":                    invoiceReservationIndex,
+			"unique":                  true,
+			"partialFilterExpression": bson.M{"invoice.kind": invoiceKindInvoice},
+		}}},
+	}, nil)
+	if mgo.IsDup(err) {
+		// Charged twice before the index existed. Refunding is up to people, so Billing starts without it.
+		return dbConn.logReservationsInvoicedTwice(db.C(InvoiceCollection))
+	}
+	if err != nil {
+		return fmt.Errorf("index %s: %v", invoiceReservationIndex, err)
+	}
 	return nil
 }
 
-func insertDb(db *mgo.Collection, entity interface{}) error {
-	if err := db.Insert(entity); err != nil {
-		return err
+// logReservationsInvoicedTwice logs the reservations with more than one invoice, which keep their
+// unique index from being built. Until they're resolved and Billing restarted, a reservation's invoice is
+// only looked up before it's added, so concurrent requests may still invoice it twice.
+func (dbConn *MongoDbConnection) logReservationsInvoicedTwice(invoices *mgo.Collection) error {
+	var duplicates []struct {
+		ReservationID string          `bson:"_id"`
+		InvoiceIDs    []bson.ObjectId `bson:"invoiceIds"`
 	}
-
+	err := invoices.Pipe([]bson.M{
+		{"$match": bson.M{"invoice.kind": invoiceKindInvoice}},
+		{"$group": bson.M{"_id": "$invoice.reservationId", "invoiceIds": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}).All(&duplicates)
+	if err != nil {
+		return fmt.Errorf("Finding the reservations with more than one invoice: %v", err)
+	}
+	for _, duplicate := range duplicates {
+		dbConn.logerr("Reservation (%s) has %d invoices %v, refund all but one of them", duplicate.ReservationID, len(duplicate.InvoiceIDs), duplicate.InvoiceIDs)
+	}
+	dbConn.logerr("Index %s wasn't created, restart Billing once %d reservations have only one invoice", invoiceReservationIndex, len(duplicates))
 	return nil
 }
 
-func findQueryDb(db *mgo.Collection, query bson.M, result interface{}) error {
-	err := db.Find(query).All(result) // NOTE: may cause out of memory
-	if err != nil {
+// runWithContext runs operation unless ctx is already done. The operation isn't abandoned when ctx is
+// done meanwhile, as its session is closed once it returns; the socket timeouts and server-side time
+// limit set from ctx's deadline bound it instead. A failure once ctx is done reports ctx's error.
+func runWithContext(ctx context.Context, operation func() error) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	return nil
+	err := operation()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// maxQueryTime is how long the server may spend on a query before the request's deadline passes
+func maxQueryTime(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout := time.Until(deadline); timeout > 0 {
+			return timeout
+		}
+	}
+	return 0
+}
+
+func updateDb(ctx context.Context, db *mgo.Collection, selector bson.M, entity interface{}) error {
+	return runWithContext(ctx, func() error {
+		return db.Update(selector, entity)
+	})
+}
+
+func insertDb(ctx context.Context, db *mgo.Collection, entity interface{}) error {
+	return runWithContext(ctx, func() error {
+		return db.Insert(entity)
+	})
+}
+
+func findQueryDb(ctx context.Context, db *mgo.Collection, query bson.M, result interface{}) error {
+	return runWithContext(ctx, func() error {
+		return db.Find(query).SetMaxTime(maxQueryTime(ctx)).All(result) // NOTE: may cause out of memory
+	})
 }
 
-func findByIDDb(db *mgo.Collection, ID string, result interface{}) error {
+func findByIDDb(ctx context.Context, db *mgo.Collection, ID string, result interface{}) error {
 	if !bson.IsObjectIdHex(ID) {
 		return fmt.Errorf("'%s' is not a valid Mongo ObjectId", ID)
 	}
-	err := db.FindId(bson.ObjectIdHex(ID)).One(result)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return runWithContext(ctx, func() error {
+		return db.FindId(bson.ObjectIdHex(ID)).SetMaxTime(maxQueryTime(ctx)).One(result)
+	})
 }
@@ -20,7 +20,7 @@ func AddMyInfoToErr(err error) error {
 func AddCallerInfoToErr(err error, numFramesToSkip int) error {
 	funcPtr, fileName, line, ok := runtime.Caller(numFramesToSkip)
 	if !ok {
-		LogErrFormat("couldn't get caller info")
+		// The error is still returned, only without its caller's info
 		return err
 	}
 
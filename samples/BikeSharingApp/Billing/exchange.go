@@ -0,0 +1,324 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// currencyExponents lists the active ISO 4217 currencies with the number of decimals of their minor unit,
+// e.g. 0 for JPY and 3 for KWD. Billing counts every amount in cents, so it only accepts the currencies with
+// two decimals, rather than misstate the others' amounts.
+var currencyExponents = map[string]int{
+	"AED": 2, "AFN": 2, "ALL": 2, "AMD": 2, "ANG": 2, "AOA": 2, "ARS": 2, "AUD": 2, "AWG": 2, "AZN": 2,
+	"BAM": 2, "BBD": 2, "BDT": 2, "BGN": 2, "BHD": 3, "BIF": 0, "BMD": 2, "BND": 2, "BOB": 2, "BOV": 2,
+	"BRL": 2, "BSD": 2, "BTN": 2, "BWP": 2, "BYN": 2, "BZD": 2, "CAD": 2, "CDF": 2, "CHE": 2, "CHF": 2,
+	"CHW": 2, "CLF": 4, "CLP": 0, "CNY": 2, "COP": 2, "COU": 2, "CRC": 2, "CUP": 2, "CVE": 2, "CZK": 2,
+	"DJF": 0, "DKK": 2, "DOP": 2, "DZD": 2, "EGP": 2, "ERN": 2, "ETB": 2, "EUR": 2, "FJD": 2, "FKP": 2,
+	"GBP": 2, "GEL": 2, "GHS": 2, "GIP": 2, "GMD": 2, "GNF": 0, "GTQ": 2, "GYD": 2, "HKD": 2, "HNL": 2,
+	"HTG": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "IQD": 3, "IRR": 2, "ISK": 0, "JMD": 2, "JOD": 3,
+	"JPY": 0, "KES": 2, "KGS": 2, "KHR": 2, "KMF": 0, "KPW": 2, "KRW": 0, "KWD": 3, "KYD": 2, "KZT": 2,
+	"LAK": 2, "LBP": 2, "LKR": 2, "LRD": 2, "LSL": 2, "LYD": 3, "MAD": 2, "MDL": 2, "MGA": 2, "MKD": 2,
+	"MMK": 2, "MNT": 2, "MOP": 2, "MRU": 2, "MUR": 2, "MVR": 2, "MWK": 2, "MXN": 2, "MXV": 2, "MYR": 2,
+	"MZN": 2, "NAD": 2, "NGN": 2, "NIO": 2, "NOK": 2, "NPR": 2, "NZD": 2, "OMR": 3, "PAB": 2, "PEN": 2,
+	"PGK": 2, "PHP": 2, "PKR": 2, "PLN": 2, "PYG": 0, "QAR": 2, "RON": 2, "RSD": 2, "RUB": 2, "RWF": 0,
+	"SAR": 2, "SBD": 2, "SCR": 2, "SDG": 2, "SEK": 2, "SGD": 2, "SHP": 2, "SLE": 2, "SOS": 2, "SRD": 2,
+	"SSP": 2, "STN": 2, "SVC": 2, "SYP": 2, "SZL": 2, "THB": 2, "TJS": 2, "TMT": 2, "TND": 3, "TOP": 2,
+	"TRY": 2, "TTD": 2, "TWD": 2, "TZS": 2, "UAH": 2, "UGX": 0, "USD": 2, "USN": 2, "UYI": 0, "UYU": 2,
+	"UYW": 4, "UZS": 2, "VED": 2, "VES": 2, "VND": 0, "VUV": 0, "WST": 2, "XAF": 0, "XCD": 2, "XCG": 2,
+	"XOF": 0, "XPF": 0, "YER": 2, "ZAR": 2, "ZMW": 2, "ZWG": 2,
+}
+
+// validCurrency reports whether currency is an active ISO 4217 code with two decimals, the currencies Billing handles
+func validCurrency(currency string) bool {
+	exponent, ok := currencyExponents[currency]
+	return ok && exponent == 2
+}
+
+// exchangeRateDateLayout is the format of effective dates, a day in UTC
+const exchangeRateDateLayout = "2006-01-02"
+
+// The sources of exchange rates
+const (
+	exchangeRateSourceFile = "file"
+	exchangeRateSourceAPI  = "api"
+)
+
+// ExchangeRate converts From to To from its effective date until the pair's next rate takes effect
+type ExchangeRate struct {
+	From string `bson:"from" json:"from" yaml:"from" openapi:"required"`
+	To   string `bson:"to" json:"to" yaml:"to" openapi:"required"`
+	// Rate is how much of To one From buys, e.g. 1.0825. It's kept as text so that it's converted with exactly.
+	Rate string `bson:"rate" json:"rate" yaml:"rate" openapi:"required"`
+	// EffectiveDate is the first day the rate applies, YYYY-MM-DD in UTC
+	EffectiveDate string `bson:"effectiveDate" json:"effectiveDate" yaml:"effectiveDate" openapi:"required"`
+	// Source is where the rate came from, exchange_rates_file or the API. It's set by Billing.
+	Source string `bson:"source" json:"source,omitempty" yaml:"-"`
+}
+
+// ExchangeRates is a table of rates, as read from exchange_rates_file
+type ExchangeRates []ExchangeRate
+
+// CurrencyConversion records an invoice's amount converted at an exchange rate, so that it can be audited
+type CurrencyConversion struct {
+	InvoiceID string `bson:"invoiceId" json:"invoiceId" openapi:"required"`
+	// Amount is in the minor unit of Rate.From, Converted in that of Rate.To
+	Amount    int64        `bson:"amount" json:"amount" openapi:"required"`
+	Rate      ExchangeRate `bson:"rate" json:"rate" openapi:"required"`
+	Converted int64        `bson:"converted" json:"converted" openapi:"required"`
+}
+
+// noExchangeRateError is returned converting an amount that no rate was in effect for
+type noExchangeRateError struct {
+	from, to, day string
+}
+
+func (err noExchangeRateError) Error() string {
+	return fmt.Sprintf("No %s to %s exchange rate was in effect on %s, add one", err.from, err.to, err.day)
+}
+
+// LoadExchangeRates reads a YAML or JSON list of exchange rates
+func LoadExchangeRates(path string) (ExchangeRates, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading exchange rates: %v", err)
+	}
+	var rates ExchangeRates
+	if err := yaml.Unmarshal(contents, &rates); err != nil {
+		return nil, fmt.Errorf("Parsing exchange rates '%s': %v", path, err)
+	}
+	for i := range rates {
+		rates[i].Source = exchangeRateSourceFile
+	}
+	if err := rates.Validate(); err != nil {
+		return nil, fmt.Errorf("Exchange rates '%s': %v", path, err)
+	}
+	return rates, nil
+}
+
+// Validate returns a non-nil error naming the first invalid rate, or the first pair with two rates
+// taking effect on the same day
+func (rates ExchangeRates) Validate() error {
+	effective := map[string]bool{}
+	for _, rate := range rates {
+		if err := rate.Validate(); err != nil {
+			return err
+		}
+		key := rate.From + "/" + rate.To + "/" + rate.EffectiveDate
+		if effective[key] {
+			return fmt.Errorf("%s to %s has two rates taking effect on %s", rate.From, rate.To, rate.EffectiveDate)
+		}
+		effective[key] = true
+	}
+	return nil
+}
+
+// Validate returns a non-nil error naming the rate's first problem
+func (rate ExchangeRate) Validate() error {
+	if !validCurrency(rate.From) || !validCurrency(rate.To) || rate.From == rate.To {
+		return fmt.Errorf("%s to %s: from and to must be two ISO 4217 currencies with two decimals, e.g. EUR and USD", rate.From, rate.To)
+	}
+	if parsed, ok := new(big.Rat).SetString(rate.Rate); !ok || parsed.Sign() <= 0 {
+		return fmt.Errorf("%s to %s: rate (%s) must be a positive decimal, e.g. 1.0825", rate.From, rate.To, rate.Rate)
+	}
+	if _, err := time.Parse(exchangeRateDateLayout, rate.EffectiveDate); err != nil {
+		return fmt.Errorf("%s to %s: effectiveDate (%s) must be a date formatted YYYY-MM-DD", rate.From, rate.To, rate.EffectiveDate)
+	}
+	return nil
+}
+
+// Rate returns the pair's rate in effect on day, the one with the latest effective date not after it
+func (rates ExchangeRates) Rate(from, to, day string) (ExchangeRate, bool) {
+	var found ExchangeRate
+	ok := false
+	for _, rate := range rates {
+		if rate.From == from && rate.To == to && rate.EffectiveDate <= day && (!ok || rate.EffectiveDate > found.EffectiveDate) {
+			found, ok = rate, true
+		}
+	}
+	return found, ok
+}
+
+// Convert converts amount cents of From into cents of To, rounding half up. Both have two decimals, as validated.
+func (rate ExchangeRate) Convert(amount int64) int64 {
+	// The rate was validated, so it parses
+	parsed, _ := new(big.Rat).SetString(rate.Rate)
+	return roundCents(parsed.Mul(parsed, big.NewRat(amount, 1)), taxRoundHalfUp)
+}
+
+// exchangeRate finds the pair's rate in effect on day among those of exchange_rates_file and those added
+// through the API. The later effective date wins, and on the same day the API's rate does.
+func (app *App) exchangeRate(context *RequestContext, from, to, day string) (ExchangeRate, bool, error) {
+	fileRate, inFile := app.Config().ExchangeRates.Rate(from, to, day)
+	apiRate, inAPI, err := app.Store.GetExchangeRate(context, from, to, day)
+	if err != nil {
+		return ExchangeRate{}, false, err
+	}
+	if inAPI && (!inFile || apiRate.EffectiveDate >= fileRate.EffectiveDate) {
+		return apiRate, true, nil
+	}
+	return fileRate, inFile, nil
+}
+
+// currencyConverter converts invoices' amounts into one currency at the rates in effect the days the
+// invoices were created, looking each currency and day up once
+type currencyConverter struct {
+	app      *App
+	context  *RequestContext
+	currency string
+	rates    map[string]ExchangeRate
+}
+
+func (app *App) newCurrencyConverter(context *RequestContext, currency string) *currencyConverter {
+	return &currencyConverter{app: app, context: context, currency: currency, rates: map[string]ExchangeRate{}}
+}
+
+// convert returns inv's amount in the converter's currency, and how it was converted when inv is in
+// another currency
+func (converter *currencyConverter) convert(inv Invoice) (int64, *CurrencyConversion, error) {
+	amount := inv.AmountMinorUnits()
+	from := inv.CurrencyCode()
+	if from == converter.currency {
+		return amount, nil, nil
+	}
+
+	day := invoiceCreatedAt(inv).Format(exchangeRateDateLayout)
+	rate, ok := converter.rates[from+"/"+day]
+	if !ok {
+		var err error
+		rate, ok, err = converter.app.exchangeRate(converter.context, from, converter.currency, day)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !ok {
+			return 0, nil, noExchangeRateError{from, converter.currency, day}
+		}
+		converter.rates[from+"/"+day] = rate
+	}
+	converted := rate.Convert(amount)
+	return converted, &CurrencyConversion{InvoiceID: inv.ID, Amount: amount, Rate: rate, Converted: converted}, nil
+}
+
+// vendorCurrency is the currency the vendor is paid and reported in
+func (app *App) vendorCurrency(vendor Vendor) string {
+	if vendor.Currency != "" {
+		return vendor.Currency
+	}
+	return app.Config().BaseCurrency
+}
+
+// NewExchangeRateHandler adds a rate. Rates can't be changed, so a pair's rate for a day that already has
+// one fails with 409; correct a rate by adding one effective on a later day.
+func (app *App) NewExchangeRateHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+	result = &handlerResult{}
+
+	rate := ExchangeRate{}
+	if err := json.NewDecoder(req.Body).Decode(&rate); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
+	if err := rate.Validate(); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
+	rate.Source = exchangeRateSourceAPI
+
+	ok, err := app.Store.AddExchangeRate(context, rate)
+	if err != nil {
+		result.Error = err
+		return
+	}
+	if !ok {
+		result.ResponseCode = http.StatusConflict
+		result.Message = fmt.Sprintf("%s to %s already has a rate taking effect on %s", rate.From, rate.To, rate.EffectiveDate)
+		return
+	}
+	app.Logger.LogWithContext(context, "Added %s to %s exchange rate %s effective %s", rate.From, rate.To, rate.Rate, rate.EffectiveDate)
+
+	rateBytes, err := json.Marshal(rate)
+	if err != nil {
+		result.Error = AddMyInfoToErr(err)
+		return
+	}
+	result.Message = string(rateBytes)
+	result.ResponseCode = http.StatusOK
+	return
+}
+
+// GetExchangeRatesHandler lists the rates of exchange_rates_file and the API, optionally only those
+// converting from or to the from and to parameters' currencies. With the date parameter it lists the rate
+// of each pair in effect that day.
+func (app *App) GetExchangeRatesHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+	result = &handlerResult{}
+
+	query := req.URL.Query()
+	from, to, day := query.Get("from"), query.Get("to"), query.Get("date")
+	if day != "" {
+		if _, err := time.Parse(exchangeRateDateLayout, day); err != nil {
+			result.ResponseCode = http.StatusBadRequest
+			result.Message = fmt.Sprintf("date (%s) must be a date formatted YYYY-MM-DD", day)
+			return
+		}
+	}
+	apiRates, err := app.Store.GetExchangeRates(context, from, to)
+	if err != nil {
+		result.Error = err
+		return
+	}
+
+	rates := ExchangeRates{}
+	for _, rate := range append(app.Config().ExchangeRates, apiRates...) {
+		if (from == "" || rate.From == from) && (to == "" || rate.To == to) {
+			rates = append(rates, rate)
+		}
+	}
+	if day != "" {
+		rates = rates.inEffect(day)
+	}
+	sort.SliceStable(rates, func(i, j int) bool {
+		if rates[i].From != rates[j].From {
+			return rates[i].From < rates[j].From
+		}
+		if rates[i].To != rates[j].To {
+			return rates[i].To < rates[j].To
+		}
+		return rates[i].EffectiveDate < rates[j].EffectiveDate
+	})
+
+	ratesBytes, err := json.Marshal(rates)
+	if err != nil {
+		result.Error = AddMyInfoToErr(err)
+		return
+	}
+	result.Message = string(ratesBytes)
+	result.ResponseCode = http.StatusOK
+	return
+}
+
+// inEffect returns the rate of each pair in effect on day. The rates are those of the file followed by
+// those of the API, so that on the same day the API's rate wins, as in exchangeRate.
+func (rates ExchangeRates) inEffect(day string) ExchangeRates {
+	latest := map[string]ExchangeRate{}
+	for _, rate := range rates {
+		pair := rate.From + "/" + rate.To
+		if rate.EffectiveDate <= day && rate.EffectiveDate >= latest[pair].EffectiveDate {
+			latest[pair] = rate
+		}
+	}
+	inEffect := ExchangeRates{}
+	for _, rate := range latest {
+		inEffect = append(inEffect, rate)
+	}
+	return inEffect
+}
@@ -0,0 +1,146 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// ndjsonContentType is newline delimited JSON, one record per line
+	ndjsonContentType = "application/x-ndjson"
+	// exportFlushRecords is how many records are written between flushes, so clients see progress
+	exportFlushRecords = 100
+)
+
+// ExportInvoicesHandler streams the invoices created between from and to, optionally only a customer's
+// (userId) or a vendor's (vendorId), as newline delimited JSON, oldest first. Passing the id of the last
+// line received as cursor resumes an export; limit caps the lines of one response.
+//
+// The stream ends cleanly only once the export is complete. If it fails part way, the connection is
+// aborted so that clients can't mistake a truncated export for a complete one.
+func (app *App) ExportInvoicesHandler(rw http.ResponseWriter, req *http.Request, context *RequestContext) *handlerResult {
+	filter, err := parseInvoiceExportFilter(req)
+	if err != nil {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	app.Logger.LogWithContext(context, "Exporting invoices matching %+v", filter)
+	version := requestAPIVersion(req)
+	stream := newNDJSONWriter(rw)
+	err = app.Store.ExportInvoices(context, filter, func(inv Invoice) error {
+		return stream.Write(version.toVersion(inv))
+	})
+	if err == nil {
+		stream.Close()
+		app.Logger.LogWithContext(context, "Exported %d invoices", stream.records)
+		return &handlerResult{ResponseCode: http.StatusOK, Streamed: true}
+	}
+	if !stream.started {
+		return &handlerResult{Error: err}
+	}
+
+	app.Logger.LogErrFormatWithContext(context, "Aborting the export after %d invoices: %v", stream.records, err)
+	panic(http.ErrAbortHandler)
+}
+
+// parseInvoiceExportFilter reads the export's query parameters, returning a JSON array of the problems
+func parseInvoiceExportFilter(req *http.Request) (InvoiceExportFilter, error) {
+	var errorSlice []string
+	query := req.URL.Query()
+	filter := InvoiceExportFilter{
+		CustomerID: query.Get("userId"),
+		VendorID:   query.Get("vendorId"),
+	}
+
+	for parameter, field := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(parameter); value != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				errorSlice = append(errorSlice, fmt.Sprintf("%s: '%s' isn't an RFC 3339 time", parameter, value))
+			}
+			*field = parsed
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if bson.IsObjectIdHex(cursor) {
+			filter.After = bson.ObjectIdHex(cursor)
+		} else {
+			errorSlice = append(errorSlice, fmt.Sprintf("cursor: '%s' isn't an invoice id", cursor))
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			errorSlice = append(errorSlice, fmt.Sprintf("limit: '%s' isn't a positive integer", value))
+		}
+		filter.Limit = limit
+	}
+
+	if len(errorSlice) > 0 {
+		sort.Strings(errorSlice)
+		errorBytes, err := json.Marshal(errorSlice)
+		if err != nil {
+			return filter, AddMyInfoToErr(err)
+		}
+		return filter, errors.New(string(errorBytes))
+	}
+	return filter, nil
+}
+
+// ndjsonWriter writes records to a response as newline delimited JSON. The status is written with the
+// first record, so a failure before it can still be reported as an error response.
+type ndjsonWriter struct {
+	rw      http.ResponseWriter
+	encoder *json.Encoder
+	records int
+	started bool
+}
+
+func newNDJSONWriter(rw http.ResponseWriter) *ndjsonWriter {
+	return &ndjsonWriter{rw: rw, encoder: json.NewEncoder(rw)}
+}
+
+// Write writes record on its own line
+func (writer *ndjsonWriter) Write(record interface{}) error {
+	if !writer.started {
+		writer.writeHeader()
+	}
+	if err := writer.encoder.Encode(record); err != nil {
+		return err
+	}
+	writer.records++
+	if writer.records%exportFlushRecords == 0 {
+		writer.flush()
+	}
+	return nil
+}
+
+// Close ends a complete stream, which may have no records
+func (writer *ndjsonWriter) Close() {
+	if !writer.started {
+		writer.writeHeader()
+	}
+	writer.flush()
+}
+
+func (writer *ndjsonWriter) writeHeader() {
+	writer.rw.Header().Set("Content-Type", ndjsonContentType)
+	writer.rw.WriteHeader(http.StatusOK)
+	writer.started = true
+}
+
+func (writer *ndjsonWriter) flush() {
+	if flusher, ok := writer.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -4,11 +4,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/gorilla/mux"
@@ -20,6 +22,8 @@ type handlerResult struct {
 	Message      string
 	ResponseCode int
 	Error        error
+	// Streamed is set by handlers that wrote the response themselves
+	Streamed bool
 }
 
 type helloResponse struct {
@@ -28,6 +32,15 @@ type helloResponse struct {
 
 type RequestContext struct {
 	RequestID *uuid.UUID
+	// Ctx is cancelled when the client goes away or the request timeout passes
+	Ctx context.Context
+}
+
+// detached returns a context for the request that isn't cancelled with it, bounded by timeout instead,
+// for work that must still happen once the request failed
+func (requestContext *RequestContext) detached(timeout time.Duration) (*RequestContext, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return &RequestContext{RequestID: requestContext.RequestID, Ctx: ctx}, cancel
 }
 
 const (
@@ -38,58 +51,89 @@ type EndpointHandler func(req *http.Request, context *RequestContext) *handlerRe
 
 type EndpointHandlerNoContext func(req *http.Request, context *RequestContext) *handlerResult
 
-func (handler EndpointHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	serveHTTPInner(handler, rw, req, true)
+// StreamingEndpointHandler writes its successful response itself, returning a result with Streamed set.
+// A failure before anything was written is returned as usual.
+type StreamingEndpointHandler func(rw http.ResponseWriter, req *http.Request, context *RequestContext) *handlerResult
+
+// endpoint serves a handler's results, logging its errors and requests through the app's logger
+type endpoint struct {
+	app     *App
+	handler StreamingEndpointHandler
+	// requireContext endpoints fail without the x-contoso-request-id header
+	requireContext bool
+}
+
+func (app *App) endpoint(handler EndpointHandler) endpoint {
+	return endpoint{app, func(rw http.ResponseWriter, req *http.Request, context *RequestContext) *handlerResult {
+		return handler(req, context)
+	}, true}
+}
+
+func (app *App) endpointNoContext(handler EndpointHandlerNoContext) endpoint {
+	return endpoint{app, func(rw http.ResponseWriter, req *http.Request, context *RequestContext) *handlerResult {
+		return handler(req, context)
+	}, false}
 }
 
-func (handler EndpointHandlerNoContext) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	serveHTTPInner(EndpointHandler(handler), rw, req, false)
+func (app *App) streamingEndpoint(handler StreamingEndpointHandler) endpoint {
+	return endpoint{app, handler, true}
 }
 
-func serveHTTPInner(handler EndpointHandler, rw http.ResponseWriter, req *http.Request, requireContext bool) {
+func (endpoint endpoint) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	endpoint.app.serveHTTPInner(endpoint.handler, rw, req, endpoint.requireContext)
+}
+
+func (app *App) serveHTTPInner(handler StreamingEndpointHandler, rw http.ResponseWriter, req *http.Request, requireContext bool) {
 	startTime := time.Now()
 	result := &handlerResult{}
 
 	requestContext, err := getRequestContext(req)
 	if !requireContext && err != nil {
-		requestContext = &RequestContext{&uuid.UUID{}}
+		requestContext = &RequestContext{&uuid.UUID{}, req.Context()}
 		err = nil
 	}
 	if err != nil {
 		result.ResponseCode = http.StatusBadRequest
 		result.Message = err.Error()
-	} else if result = handler(req, requestContext); result == nil || (result.ResponseCode == 0 && result.Error == nil) {
+	} else if result = handler(rw, req, requestContext); result == nil || (result.ResponseCode == 0 && result.Error == nil) {
 		panic("Handler returned bad handlerResult!")
 	}
 
-	defer func() { logRequestEnd(req.Method, req.URL.Path, startTime, result.ResponseCode, requestContext) }()
+	defer func() { app.logRequestEnd(req.Method, req.URL.Path, startTime, result.ResponseCode, requestContext) }()
 
-	if result.Error != nil {
+	if result.Error != nil && req.Context().Err() == context.DeadlineExceeded {
+		result.ResponseCode = http.StatusGatewayTimeout
+		result.Message = result.Error.Error()
+		app.Logger.LogErrFormatWithContext(requestContext, "Returning 504 error: %s", result.Message)
+	} else if result.Error != nil {
 		result.ResponseCode = http.StatusInternalServerError
 		result.Message = result.Error.Error()
-		LogErrFormatWithContext(requestContext, "Returning 500 error: %s", result.Message)
+		app.Logger.LogErrFormatWithContext(requestContext, "Returning 500 error: %s", result.Message)
 	}
 
+	if result.Streamed {
+		return
+	}
 	rw.WriteHeader(result.ResponseCode)
 
 	if result.Message != "" {
 		if _, err := fmt.Fprintf(rw, "%s\n", result.Message); err != nil {
 			result.ResponseCode = http.StatusInternalServerError
 			rw.WriteHeader(http.StatusInternalServerError)
-			LogErrorWithContext(requestContext, AddMyInfoToErr(err))
-			LogErrFormatWithContext(requestContext, "Message: %v", result.Message)
+			app.Logger.LogErrorWithContext(requestContext, AddMyInfoToErr(err))
+			app.Logger.LogErrFormatWithContext(requestContext, "Message: %v", result.Message)
 		}
 	}
 }
 
-func logRequestEnd(httpMethod string, endpoint string, startTime time.Time, responseCode int, requestContext *RequestContext) {
+func (app *App) logRequestEnd(httpMethod string, endpoint string, startTime time.Time, responseCode int, requestContext *RequestContext) {
 	requestID := "nil"
 	if requestContext != nil {
 		requestID = requestContext.RequestID.String()
 	}
 
 	milliseconds := float64(time.Since(startTime).Nanoseconds()) / float64(time.Millisecond)
-	Log("%s %s - %.2fms %d - %s", httpMethod, endpoint, milliseconds, responseCode, requestID)
+	app.Logger.Log("%s %s - %.2fms %d - %s", httpMethod, endpoint, milliseconds, responseCode, requestID)
 }
 
 func getRequestContext(req *http.Request) (*RequestContext, error) {
@@ -98,7 +142,7 @@ func getRequestContext(req *http.Request) (*RequestContext, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't parse %s header: %v", RequestIDHeaderName, err)
 	}
-	return &RequestContext{reqUUID}, nil
+	return &RequestContext{reqUUID, req.Context()}, nil
 }
 
 // HelloHandler handles the /hello endpoint
@@ -129,12 +173,12 @@ func checkInvoicesForUser(req *http.Request, context *RequestContext, userID str
 	result.ResponseCode = http.StatusOK
 }
 
-func GetInvoicesForVendorHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) GetInvoicesForVendorHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	vars := mux.Vars(req)
 	userID := vars["userID"]
-	invoices, err := DbConnection.GetVendorInvoices(context, userID)
+	invoices, err := app.Store.GetVendorInvoices(context, userID)
 	if err != nil {
 		result.Error = err
 		return
@@ -143,12 +187,12 @@ func GetInvoicesForVendorHandler(req *http.Request, context *RequestContext) (re
 	return
 }
 
-func GetInvoicesForCustomerHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) GetInvoicesForCustomerHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	vars := mux.Vars(req)
 	userID := vars["userID"]
-	invoices, err := DbConnection.GetCustomerInvoices(context, userID)
+	invoices, err := app.Store.GetCustomerInvoices(context, userID)
 	if err != nil {
 		result.Error = err
 		return
@@ -157,7 +201,7 @@ func GetInvoicesForCustomerHandler(req *http.Request, context *RequestContext) (
 	return
 }
 
-func GetInvoiceHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) GetInvoiceHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	vars := mux.Vars(req)
@@ -167,7 +211,7 @@ func GetInvoiceHandler(req *http.Request, context *RequestContext) (result *hand
 		result.Message = fmt.Sprintf("(%s) is not a valid invoiceID", invoiceID)
 		return
 	}
-	invoice, ok, err := DbConnection.GetInvoiceById(context, invoiceID)
+	invoice, ok, err := app.Store.GetInvoiceById(context, invoiceID)
 	if err != nil {
 		result.Error = err
 		return
@@ -187,12 +231,12 @@ func GetInvoiceHandler(req *http.Request, context *RequestContext) (result *hand
 	return
 }
 
-func GetInvoiceForReservationIdHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) GetInvoiceForReservationIdHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	vars := mux.Vars(req)
 	reservationID := vars["resID"]
-	invoice, ok, err := DbConnection.GetInvoiceForReservationId(context, reservationID)
+	invoice, ok, err := app.Store.GetInvoiceForReservationId(context, reservationID)
 	if err != nil {
 		result.Error = err
 		return
@@ -212,12 +256,12 @@ func GetInvoiceForReservationIdHandler(req *http.Request, context *RequestContex
 	return
 }
 
-func GetVendorByUserIdHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) GetVendorByUserIdHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	vars := mux.Vars(req)
 	userID := vars["userID"]
-	vendor, ok, err := DbConnection.GetVendorByUserId(context, userID)
+	vendor, ok, err := app.Store.GetVendorByUserId(context, userID)
 	if err != nil {
 		result.Error = err
 		return
@@ -237,12 +281,12 @@ func GetVendorByUserIdHandler(req *http.Request, context *RequestContext) (resul
 	return
 }
 
-func GetCustomerByUserIdHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) GetCustomerByUserIdHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	vars := mux.Vars(req)
 	userID := vars["userID"]
-	customer, ok, err := DbConnection.GetCustomerByUserId(context, userID)
+	customer, ok, err := app.Store.GetCustomerByUserId(context, userID)
 	if err != nil {
 		result.Error = err
 		return
@@ -263,7 +307,7 @@ func GetCustomerByUserIdHandler(req *http.Request, context *RequestContext) (res
 }
 
 // NewInvoiceHandler handles the /invoice endpoint
-func NewInvoiceHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) NewInvoiceHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	decoder := json.NewDecoder(req.Body)
@@ -279,33 +323,104 @@ func NewInvoiceHandler(req *http.Request, context *RequestContext) (result *hand
 		result.Message = err.Error()
 		return
 	}
+	// A reservation is invoiced once: posting it again returns its invoice, retrying the charge if it failed
+	existing, ok, err := app.Store.GetInvoiceForReservationId(context, inv.ReservationID)
+	if err != nil {
+		result.Error = err
+		return
+	}
+	if ok {
+		app.Logger.LogWithContext(context, "Reservation (%s) already has invoice (%s)", inv.ReservationID, existing.ID)
+		return app.chargeInvoice(context, existing)
+	}
+	config := app.Config()
+	if err := priceInvoice(&inv, config.Pricing, config.PricingCurrency, config.PostedAmounts); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
+	if inv.Pricing.PostedAmount != nil {
+		app.Logger.LogWithContext(context, "Ignoring posted amount (%s), calculated (%s)", formatMinorUnits(*inv.Pricing.PostedAmount), formatMinorUnits(inv.Pricing.Total))
+	}
+	promo, discounted, promoResult := app.discountInvoice(context, &inv)
+	if promoResult != nil {
+		return promoResult
+	}
+	if taxResult := app.taxInvoice(context, &inv, config.TaxRules); taxResult != nil {
+		return taxResult
+	}
+
+	if discounted {
+		ok, err := app.Store.RedeemPromotion(context, promo, inv.CustomerID)
+		if err != nil {
+			result.Error = err
+			return
+		}
+		if !ok {
+			return promoCodeUsedUp(promo)
+		}
+		app.Logger.LogWithContext(context, "Redeemed promo code (%s) for %s off", promo.Code, formatMinorUnits(inv.Discount.Amount))
+	}
 
 	// Add the invoice
-	LogWithContext(context, "Adding invoice for reservation (%s)", inv.ReservationID)
-	dbID, err := DbConnection.AddInvoice(context, inv)
+	inv.Kind = invoiceKindInvoice
+	app.Logger.LogWithContext(context, "Adding invoice for reservation (%s)", inv.ReservationID)
+	inv, err = app.addNumberedInvoice(context, inv)
 	if err != nil {
+		if discounted {
+			if releaseErr := app.Store.ReleasePromotion(context, promo, inv.CustomerID); releaseErr != nil {
+				app.Logger.LogErrFormatWithContext(context, "Couldn't release the redemption of promo code (%s): %v", promo.Code, releaseErr)
+			}
+		}
+		if mgo.IsDup(err) {
+			// A concurrent request invoiced the reservation first
+			existing, ok, lookupErr := app.Store.GetInvoiceForReservationId(context, inv.ReservationID)
+			if lookupErr != nil {
+				result.Error = lookupErr
+				return
+			}
+			if ok {
+				app.Logger.LogWithContext(context, "Reservation (%s) was invoiced concurrently with invoice (%s)", inv.ReservationID, existing.ID)
+				return app.chargeInvoice(context, existing)
+			}
+		}
 		result.Error = err
 		return
 	}
-	inv.ID = dbID.Hex()
 
-	LogWithContext(context, "Added invoice to db (dbID: %s), processing payment", inv.ID)
-	/*
-	 * Process invoice payment here
-	 */
-	LogWithContext(context, "Payment processing done")
-	LogWithContext(context, "Invoice complete for reservation (%s)", inv.ReservationID)
+	app.postToLedger(context, invoiceJournalEntry(inv))
+
+	app.Logger.LogWithContext(context, "Added invoice (%s) to db (dbID: %s), processing payment", inv.Number, inv.ID)
+	return app.chargeInvoice(context, inv)
+}
+
+// chargeInvoice collects a stored invoice through the payment processor and records the payment on it.
+// An invoice whose charge failed stays unpaid, and is charged when its reservation's invoice is posted again.
+// Invoices already charged, or stored before invoices were charged by kind, are returned as they are.
+func (app *App) chargeInvoice(context *RequestContext, inv Invoice) *handlerResult {
+	if inv.Kind == invoiceKindInvoice && inv.PaymentReference == "" {
+		reference, err := app.Payments.Charge(context, inv)
+		if err != nil {
+			app.Logger.LogErrFormatWithContext(context, "Couldn't charge invoice (%s): %v", inv.ID, err)
+			return &handlerResult{ResponseCode: http.StatusBadGateway, Message: fmt.Sprintf("Couldn't charge invoice (%s), post the invoice for reservation (%s) again to retry", inv.ID, inv.ReservationID)}
+		}
+		inv.PaymentReference = reference
+		if err := app.Store.SetInvoicePaymentReference(context, inv.ID, inv.PaymentReference); err != nil {
+			app.Logger.LogErrFormatWithContext(context, "Charged invoice (%s) with payment reference (%s) but couldn't record it: %v", inv.ID, inv.PaymentReference, err)
+		}
+		app.postToLedger(context, paymentJournalEntry(inv))
+		app.Logger.LogWithContext(context, "Payment processing done")
+	}
+	app.Logger.LogWithContext(context, "Invoice complete for reservation (%s)", inv.ReservationID)
 
-	result.Message, err = inv.Serialize()
+	message, err := inv.Serialize()
 	if err != nil {
-		result.Error = err
-	} else {
-		result.ResponseCode = http.StatusOK
+		return &handlerResult{Error: err}
 	}
-	return
+	return &handlerResult{ResponseCode: http.StatusOK, Message: message}
 }
 
-func NewVendorHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) NewVendorHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	decoder := json.NewDecoder(req.Body)
@@ -321,15 +436,20 @@ func NewVendorHandler(req *http.Request, context *RequestContext) (result *handl
 		result.Message = err.Error()
 		return
 	}
+	if err := app.Config().TaxRules.CheckJurisdiction(ven.Jurisdiction); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
 
 	// Add the vendor
-	LogWithContext(context, "Adding new vendor")
-	dbID, err := DbConnection.AddVendor(context, ven)
+	app.Logger.LogWithContext(context, "Adding new vendor")
+	dbID, err := app.Store.AddVendor(context, ven)
 	if err != nil {
 		result.Error = err
 		return
 	}
-	LogWithContext(context, "Added new vendor (dbID: %s)", dbID.Hex())
+	app.Logger.LogWithContext(context, "Added new vendor (dbID: %s)", dbID.Hex())
 	ven.ID = dbID.Hex()
 
 	result.Message, err = ven.Serialize()
@@ -341,7 +461,7 @@ func NewVendorHandler(req *http.Request, context *RequestContext) (result *handl
 	return
 }
 
-func UpdateVendorHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) UpdateVendorHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	decoder := json.NewDecoder(req.Body)
@@ -357,18 +477,23 @@ func UpdateVendorHandler(req *http.Request, context *RequestContext) (result *ha
 		result.Message = err.Error()
 		return
 	}
+	if err := app.Config().TaxRules.CheckJurisdiction(ven.Jurisdiction); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
 
 	// Update the vendor
-	LogWithContext(context, "Updating vendor")
-	err := DbConnection.UpdateVendorByUserId(context, ven)
+	app.Logger.LogWithContext(context, "Updating vendor")
+	err := app.Store.UpdateVendorByUserId(context, ven)
 	if err != nil {
 		result.Error = err
 		return
 	}
-	LogWithContext(context, "Updated vendor (userID: %s)", ven.UserID)
+	app.Logger.LogWithContext(context, "Updated vendor (userID: %s)", ven.UserID)
 
 	var ok bool
-	ven, ok, err = DbConnection.GetVendorByUserId(context, ven.UserID)
+	ven, ok, err = app.Store.GetVendorByUserId(context, ven.UserID)
 	if err != nil {
 		result.Error = err
 		return
@@ -387,7 +512,7 @@ func UpdateVendorHandler(req *http.Request, context *RequestContext) (result *ha
 	return
 }
 
-func NewCustomerHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) NewCustomerHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	decoder := json.NewDecoder(req.Body)
@@ -402,15 +527,20 @@ func NewCustomerHandler(req *http.Request, context *RequestContext) (result *han
 		result.Message = err.Error()
 		return
 	}
+	if err := app.Config().TaxRules.CheckJurisdiction(cust.Jurisdiction); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
 
 	// Add the Customer
-	LogWithContext(context, "Adding new customer")
-	dbID, err := DbConnection.AddCustomer(context, cust)
+	app.Logger.LogWithContext(context, "Adding new customer")
+	dbID, err := app.Store.AddCustomer(context, cust)
 	if err != nil {
 		result.Error = err
 		return
 	}
-	LogWithContext(context, "Added new customer (dbID: %s)", dbID.Hex())
+	app.Logger.LogWithContext(context, "Added new customer (dbID: %s)", dbID.Hex())
 	cust.ID = dbID.Hex()
 
 	result.Message, err = cust.Serialize()
@@ -422,7 +552,7 @@ func NewCustomerHandler(req *http.Request, context *RequestContext) (result *han
 	return
 }
 
-func UpdateCustomerHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+func (app *App) UpdateCustomerHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
 	result = &handlerResult{}
 
 	decoder := json.NewDecoder(req.Body)
@@ -438,18 +568,23 @@ func UpdateCustomerHandler(req *http.Request, context *RequestContext) (result *
 		result.Message = err.Error()
 		return
 	}
+	if err := app.Config().TaxRules.CheckJurisdiction(cust.Jurisdiction); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
 
 	// Update the customer
-	LogWithContext(context, "Updating customer")
-	err := DbConnection.UpdateCustomerByUserId(context, cust)
+	app.Logger.LogWithContext(context, "Updating customer")
+	err := app.Store.UpdateCustomerByUserId(context, cust)
 	if err != nil {
 		result.Error = err
 		return
 	}
-	LogWithContext(context, "Updated customer (userID: %s)", cust.UserID)
+	app.Logger.LogWithContext(context, "Updated customer (userID: %s)", cust.UserID)
 
 	var ok bool
-	cust, ok, err = DbConnection.GetCustomerByUserId(context, cust.UserID)
+	cust, ok, err = app.Store.GetCustomerByUserId(context, cust.UserID)
 	if err != nil {
 		result.Error = err
 		return
@@ -0,0 +1,28 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// InFlightTracker counts the requests currently being served
+type InFlightTracker struct {
+	count int64
+}
+
+// Count returns the number of requests currently being served
+func (tracker *InFlightTracker) Count() int64 {
+	return atomic.LoadInt64(&tracker.count)
+}
+
+// Middleware counts the request for as long as next is serving it
+func (tracker *InFlightTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&tracker.count, 1)
+		defer atomic.AddInt64(&tracker.count, -1)
+		next.ServeHTTP(rw, req)
+	})
+}
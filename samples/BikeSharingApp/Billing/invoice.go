@@ -6,16 +6,49 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"math"
+	"time"
 )
 
+// invoiceCurrency is the currency of invoices stored before invoices carried their own
+const invoiceCurrency = "USD"
+
 // Invoice defines the expected data for Invoices
 type Invoice struct {
-	ID            string  `bson:"id" json:"id"`
-	CustomerID    string  `bson:"customerId" json:"customerId"`
-	VendorID      string  `bson:"vendorId" json:"vendorId"`
-	BikeID        string  `bson:"bikeId" json:"bikeId"`
-	ReservationID string  `bson:"reservationId" json:"reservationId"`
+	ID string `bson:"id" json:"id"`
+	// Number is the invoice's number in its vendor's series, e.g. VEN-2026-000123. It's set by Billing;
+	// invoices created before invoices were numbered have none.
+	Number        string  `bson:"number,omitempty" json:"number,omitempty"`
+	CustomerID    string  `bson:"customerId" json:"customerId" openapi:"required"`
+	VendorID      string  `bson:"vendorId" json:"vendorId" openapi:"required"`
+	BikeID        string  `bson:"bikeId" json:"bikeId" openapi:"required"`
+	ReservationID string  `bson:"reservationId" json:"reservationId" openapi:"required"`
 	Amount        float32 `bson:"amount" json:"amount"`
+	// Currency is the ISO 4217 currency of the invoice's amounts, pricing_currency when it was created
+	Currency string `bson:"currency,omitempty" json:"currency,omitempty"`
+	// StartTime and EndTime are when the ride began and ended, which the amount is calculated from
+	StartTime *time.Time `bson:"startTime,omitempty" json:"startTime,omitempty" openapi:"required"`
+	EndTime   *time.Time `bson:"endTime,omitempty" json:"endTime,omitempty" openapi:"required"`
+	// Pricing is set by Billing when it calculates the amount. Invoices created before that have none.
+	Pricing *InvoicePricing `bson:"pricing,omitempty" json:"pricing,omitempty"`
+	// PromoCode is the code of the promotion the invoice was posted with, if any. Its discount is taken off
+	// the price before tax.
+	PromoCode string           `bson:"promoCode,omitempty" json:"promoCode,omitempty"`
+	Discount  *InvoiceDiscount `bson:"discount,omitempty" json:"discount,omitempty"`
+	// Tax is set by Billing when the invoice has a jurisdiction. Amount is then the gross amount.
+	Tax *InvoiceTax `bson:"tax,omitempty" json:"tax,omitempty"`
+	// PayoutID is the payout that pays the invoice's vendor, empty until one claims the invoice
+	PayoutID string `bson:"payoutId,omitempty" json:"payoutId,omitempty"`
+	// PaymentReference is the payment processor's reference of the charge, empty until it succeeds
+	PaymentReference string `bson:"paymentReference,omitempty" json:"paymentReference,omitempty"`
+	// Kind is invoiceKindInvoice or invoiceKindCreditNote. Invoices created before credit notes have none.
+	Kind string `bson:"kind,omitempty" json:"kind,omitempty"`
+	// Refunded is how much of an invoice was refunded by credit notes, in cents
+	Refunded int64 `bson:"refunded,omitempty" json:"refunded,omitempty"`
+	// CreditedInvoiceID, Reason and RefundReference describe the refund a credit note records
+	CreditedInvoiceID string `bson:"creditedInvoiceId,omitempty" json:"creditedInvoiceId,omitempty"`
+	Reason            string `bson:"reason,omitempty" json:"reason,omitempty"`
+	RefundReference   string `bson:"refundReference,omitempty" json:"refundReference,omitempty"`
 }
 
 // Serialize serializes an invoice to JSON
@@ -40,6 +73,9 @@ func ValidateInvoice(inv Invoice) error {
 	if inv.ID != zeroString {
 		errorSlice = append(errorSlice, "Must not specify ID string")
 	}
+	if inv.Number != zeroString {
+		errorSlice = append(errorSlice, "Must not specify Number string, it's assigned")
+	}
 	if inv.BikeID == zeroString {
 		errorSlice = append(errorSlice, "Must specify BikeID string")
 	}
@@ -52,6 +88,21 @@ func ValidateInvoice(inv Invoice) error {
 	if inv.VendorID == zeroString {
 		errorSlice = append(errorSlice, "Must specify VendorID string")
 	}
+	if inv.Currency != zeroString && !validCurrency(inv.Currency) {
+		errorSlice = append(errorSlice, "Currency must be an ISO 4217 code with two decimals, e.g. USD")
+	}
+	if inv.StartTime == nil || inv.EndTime == nil {
+		errorSlice = append(errorSlice, "Must specify StartTime and EndTime times")
+	}
+	if inv.Pricing != nil || inv.Discount != nil || inv.Tax != nil {
+		errorSlice = append(errorSlice, "Must not specify Pricing, Discount or Tax, they're calculated")
+	}
+	if inv.PayoutID != zeroString || inv.PaymentReference != zeroString {
+		errorSlice = append(errorSlice, "Must not specify PayoutID or PaymentReference strings")
+	}
+	if inv.Kind != zeroString || inv.Refunded != 0 || inv.CreditedInvoiceID != zeroString || inv.Reason != zeroString || inv.RefundReference != zeroString {
+		errorSlice = append(errorSlice, "Must not specify Kind, Refunded, CreditedInvoiceID, Reason or RefundReference, refund the invoice instead")
+	}
 
 	// TODO validate that passed in userIDs/customerIDs are valid
 
@@ -66,3 +117,112 @@ func ValidateInvoice(inv Invoice) error {
 
 	return nil
 }
+
+// AmountMinorUnits returns the amount in the invoice currency's minor unit, rounded half away from zero
+func (inv Invoice) AmountMinorUnits() int64 {
+	cents := float64(inv.Amount) * 100
+	if cents < 0 {
+		return int64(math.Ceil(cents - 0.5))
+	}
+	return int64(math.Floor(cents + 0.5))
+}
+
+// CurrencyCode is the invoice's currency, invoiceCurrency for invoices stored without one
+func (inv Invoice) CurrencyCode() string {
+	if inv.Currency == "" {
+		return invoiceCurrency
+	}
+	return inv.Currency
+}
+
+// Money is an amount of a currency, counted in its minor unit to avoid rounding errors
+type Money struct {
+	// Currency is the ISO 4217 code, e.g. USD
+	Currency string `json:"currency" openapi:"required"`
+	// MinorUnits is the amount in the currency's minor unit, e.g. cents
+	MinorUnits int64 `json:"minorUnits" openapi:"required"`
+}
+
+// InvoiceV2 is an Invoice as API v2 reads and writes it, with the amount as Money
+type InvoiceV2 struct {
+	ID                string           `json:"id"`
+	Number            string           `json:"number,omitempty"`
+	CustomerID        string           `json:"customerId" openapi:"required"`
+	VendorID          string           `json:"vendorId" openapi:"required"`
+	BikeID            string           `json:"bikeId" openapi:"required"`
+	ReservationID     string           `json:"reservationId" openapi:"required"`
+	Amount            Money            `json:"amount"`
+	StartTime         *time.Time       `json:"startTime,omitempty" openapi:"required"`
+	EndTime           *time.Time       `json:"endTime,omitempty" openapi:"required"`
+	Pricing           *InvoicePricing  `json:"pricing,omitempty"`
+	PromoCode         string           `json:"promoCode,omitempty"`
+	Discount          *InvoiceDiscount `json:"discount,omitempty"`
+	Tax               *InvoiceTax      `json:"tax,omitempty"`
+	PayoutID          string           `json:"payoutId,omitempty"`
+	PaymentReference  string           `json:"paymentReference,omitempty"`
+	Kind              string           `json:"kind,omitempty"`
+	Refunded          int64            `json:"refunded,omitempty"`
+	CreditedInvoiceID string           `json:"creditedInvoiceId,omitempty"`
+	Reason            string           `json:"reason,omitempty"`
+	RefundReference   string           `json:"refundReference,omitempty"`
+}
+
+// NewInvoiceV2 returns inv in its API v2 shape
+func NewInvoiceV2(inv Invoice) InvoiceV2 {
+	return InvoiceV2{
+		ID:            inv.ID,
+		Number:        inv.Number,
+		CustomerID:    inv.CustomerID,
+		VendorID:      inv.VendorID,
+		BikeID:        inv.BikeID,
+		ReservationID: inv.ReservationID,
+		Amount: Money{
+			Currency:   inv.CurrencyCode(),
+			MinorUnits: inv.AmountMinorUnits(),
+		},
+		StartTime: inv.StartTime,
+		EndTime:   inv.EndTime,
+		Pricing:   inv.Pricing,
+		PromoCode: inv.PromoCode,
+		Discount:  inv.Discount,
+		Tax:       inv.Tax,
+		PayoutID:  inv.PayoutID,
+
+		PaymentReference: inv.PaymentReference,
+
+		Kind:              inv.Kind,
+		Refunded:          inv.Refunded,
+		CreditedInvoiceID: inv.CreditedInvoiceID,
+		Reason:            inv.Reason,
+		RefundReference:   inv.RefundReference,
+	}
+}
+
+// Invoice returns the internal Invoice, in the currency of its amount
+func (inv InvoiceV2) Invoice() (Invoice, error) {
+	return Invoice{
+		ID:            inv.ID,
+		Number:        inv.Number,
+		CustomerID:    inv.CustomerID,
+		VendorID:      inv.VendorID,
+		BikeID:        inv.BikeID,
+		ReservationID: inv.ReservationID,
+		Amount:        float32(inv.Amount.MinorUnits) / 100,
+		Currency:      inv.Amount.Currency,
+		StartTime:     inv.StartTime,
+		EndTime:       inv.EndTime,
+		Pricing:       inv.Pricing,
+		PromoCode:     inv.PromoCode,
+		Discount:      inv.Discount,
+		Tax:           inv.Tax,
+		PayoutID:      inv.PayoutID,
+
+		PaymentReference: inv.PaymentReference,
+
+		Kind:              inv.Kind,
+		Refunded:          inv.Refunded,
+		CreditedInvoiceID: inv.CreditedInvoiceID,
+		Reason:            inv.Reason,
+		RefundReference:   inv.RefundReference,
+	}, nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+)
+
+// invoicePrefixPattern matches the prefixes of invoice number series, e.g. VEN
+var invoicePrefixPattern = regexp.MustCompile(`^[A-Z0-9]{2,10}$`)
+
+// invoiceNumberPattern matches invoice numbers, a series and its zero padded sequence, e.g. VEN-2026-000123
+var invoiceNumberPattern = regexp.MustCompile(`^[A-Z0-9]{2,10}-[0-9]{4}-[0-9]{6,}$`)
+
+// invoiceNumberSeries is the series the vendor's invoices are numbered in this year: the vendor's invoice
+// prefix, or invoice_number_prefix for vendors without one, and the year, e.g. VEN-2026. Each series
+// counts from 1, and numbers whose invoices weren't added are taken again.
+func (app *App) invoiceNumberSeries(context *RequestContext, vendorID string) (string, error) {
+	vendor, _, err := app.Store.GetVendorByUserId(context, vendorID)
+	if err != nil {
+		return "", err
+	}
+	prefix := vendor.InvoicePrefix
+	if prefix == "" {
+		prefix = app.Config().InvoiceNumberPrefix
+	}
+	return fmt.Sprintf("%s-%d", prefix, app.Clock.Now().UTC().Year()), nil
+}
+
+// formatInvoiceNumber formats the sequence of an invoice in its series, e.g. VEN-2026-000123
+func formatInvoiceNumber(series string, sequence int64) string {
+	return fmt.Sprintf("%s-%06d", series, sequence)
+}
+
+// normalizeInvoiceNumber returns the number as invoices are stored, so that numbers match whatever their case
+func normalizeInvoiceNumber(number string) string {
+	return strings.ToUpper(strings.TrimSpace(number))
+}
+
+// addNumberedInvoice takes the next number of the series of inv's vendor and adds inv with it, returning
+// inv with its ID and number. A number whose invoice couldn't be added is given back, to be taken by a
+// later invoice. The number's unique index keeps two invoices from ever sharing it.
+func (app *App) addNumberedInvoice(context *RequestContext, inv Invoice) (Invoice, error) {
+	series, err := app.invoiceNumberSeries(context, inv.VendorID)
+	if err != nil {
+		return inv, err
+	}
+	sequence, err := app.Store.NextInvoiceNumber(context, series)
+	if err != nil {
+		return inv, err
+	}
+	inv.Number = formatInvoiceNumber(series, sequence)
+
+	dbID, err := app.Store.AddInvoice(context, inv)
+	if err != nil {
+		return app.releaseInvoiceNumber(context, inv, series, sequence, err)
+	}
+	inv.ID = dbID.Hex()
+	return inv, nil
+}
+
+// releaseInvoiceNumber gives back the number of an invoice whose insert failed with addErr. The insert may
+// have failed after storing the invoice, e.g. when the request timed out, so the number is only given back
+// if no invoice has it; a stored invoice is returned instead. This runs even when the request is cancelled.
+// A number that couldn't be given back is a gap in its series, which is logged as an error.
+func (app *App) releaseInvoiceNumber(requestContext *RequestContext, inv Invoice, series string, sequence int64, addErr error) (Invoice, error) {
+	context, cancel := requestContext.detached(app.Config().RequestTimeout)
+	defer cancel()
+
+	// A duplicate was refused, so it certainly wasn't stored
+	if !mgo.IsDup(addErr) {
+		stored, ok, err := app.Store.GetInvoiceByNumber(context, inv.Number)
+		if err != nil {
+			app.Logger.LogErrFormatWithContext(context, "Invoice number (%s) was left unused, couldn't tell if its invoice was added: %v", inv.Number, err)
+			return inv, addErr
+		}
+		if ok {
+			app.Logger.LogWithContext(context, "Invoice (%s) numbered (%s) was added though adding it failed: %v", stored.ID, inv.Number, addErr)
+			return stored, nil
+		}
+	}
+	if err := app.Store.ReleaseInvoiceNumber(context, series, sequence); err != nil {
+		app.Logger.LogErrFormatWithContext(context, "Invoice number (%s) was left unused, couldn't release it: %v", inv.Number, err)
+	}
+	return inv, addErr
+}
+
+// GetInvoiceByNumberHandler gets an invoice, or a credit note, by its number
+func (app *App) GetInvoiceByNumberHandler(req *http.Request, context *RequestContext) *handlerResult {
+	number := normalizeInvoiceNumber(mux.Vars(req)["number"])
+	if !invoiceNumberPattern.MatchString(number) {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("(%s) is not an invoice number, e.g. VEN-2026-000123", number)}
+	}
+	inv, ok, err := app.Store.GetInvoiceByNumber(context, number)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if !ok {
+		return &handlerResult{ResponseCode: http.StatusNotFound, Message: fmt.Sprintf("Could not find invoice with number: (%s)", number)}
+	}
+	message, err := inv.Serialize()
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Message: message}
+}
@@ -0,0 +1,356 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The platform's accounts. Customers and vendors each have their own, see customerReceivable and vendorPayable.
+const (
+	// accountCash holds the money the payment processor collected and payouts haven't paid out
+	accountCash = "cash:platform"
+	// accountRevenue is credited with the platform fees of payouts
+	accountRevenue = "revenue:platform"
+	// accountFX trades the currencies of invoices converted by payouts, so that entries balance in each
+	accountFX = "fx:platform"
+)
+
+// accountPattern matches the accounts entries post to
+var accountPattern = regexp.MustCompile(`^((receivable:customer|payable:vendor):.+|(cash|revenue|fx):platform)$`)
+
+// The kinds of journal entry, each recording one event
+const (
+	journalInvoice    = "invoice"
+	journalCreditNote = "creditNote"
+	journalPayment    = "payment"
+	journalRefund     = "refund"
+	journalFee        = "fee"
+	journalConversion = "conversion"
+	journalPayout     = "payout"
+)
+
+// customerReceivable is the account of what the customer owes
+func customerReceivable(userID string) string {
+	return "receivable:customer:" + userID
+}
+
+// vendorPayable is the account of what the platform owes the vendor
+func vendorPayable(userID string) string {
+	return "payable:vendor:" + userID
+}
+
+// isDebitAccount is true for the accounts whose balance is their debits less their credits
+func isDebitAccount(account string) bool {
+	return strings.HasPrefix(account, "receivable:") || account == accountCash
+}
+
+// JournalEntry records an event as lines debiting and crediting accounts. Its debits and credits balance
+// in each currency. Entries are never changed; an event is corrected by the entry of another.
+type JournalEntry struct {
+	// ID is the kind and the reference, so that each event is posted once
+	ID   string `bson:"id" json:"id"`
+	Kind string `bson:"kind" json:"kind"`
+	// Reference is the ID of the invoice, credit note or payout the entry records
+	Reference string `bson:"reference" json:"reference"`
+	// Memo is the payment processor's reference of payments and refunds
+	Memo     string        `bson:"memo,omitempty" json:"memo,omitempty"`
+	PostedAt time.Time     `bson:"postedAt" json:"postedAt"`
+	Lines    []JournalLine `bson:"lines" json:"lines"`
+}
+
+// JournalLine debits or credits an account with an amount in the minor unit of Currency
+type JournalLine struct {
+	Account  string `bson:"account" json:"account"`
+	Currency string `bson:"currency" json:"currency"`
+	Debit    int64  `bson:"debit" json:"debit,omitempty"`
+	Credit   int64  `bson:"credit" json:"credit,omitempty"`
+}
+
+// AccountBalance is an account's balance in one currency. Balance is on the account's normal side:
+// debits less credits for receivable and cash accounts, credits less debits for the others.
+type AccountBalance struct {
+	Account  string `bson:"account" json:"account"`
+	Currency string `bson:"currency" json:"currency"`
+	Debits   int64  `bson:"debits" json:"debits"`
+	Credits  int64  `bson:"credits" json:"credits"`
+	Balance  int64  `bson:"-" json:"balance"`
+}
+
+// JournalEntryFilter selects the entries to list. Zero fields don't filter.
+type JournalEntryFilter struct {
+	Account   string
+	Reference string
+	// Before excludes the entries posted at or after it
+	Before time.Time
+}
+
+// LedgerSyncResult counts the entries a sync posted, and those it found already posted
+type LedgerSyncResult struct {
+	Posted        int `json:"posted"`
+	AlreadyPosted int `json:"alreadyPosted"`
+}
+
+func newJournalEntry(kind, reference string, postedAt time.Time) JournalEntry {
+	return JournalEntry{ID: kind + "/" + reference, Kind: kind, Reference: reference, PostedAt: postedAt.UTC()}
+}
+
+// transfer debits one account and credits another with amount, the other way around when amount is
+// negative. Zero amounts add no lines.
+func (entry *JournalEntry) transfer(debit, credit, currency string, amount int64) {
+	if amount < 0 {
+		debit, credit, amount = credit, debit, -amount
+	}
+	if amount == 0 {
+		return
+	}
+	entry.Lines = append(entry.Lines,
+		JournalLine{Account: debit, Currency: currency, Debit: amount},
+		JournalLine{Account: credit, Currency: currency, Credit: amount})
+}
+
+// Validate returns a non-nil error if a line isn't a positive debit or credit of an account, or if the
+// entry doesn't balance in one of its currencies
+func (entry JournalEntry) Validate() error {
+	if len(entry.Lines) < 2 {
+		return fmt.Errorf("Journal entry (%s) must have at least two lines", entry.ID)
+	}
+	balances := map[string]int64{}
+	for _, line := range entry.Lines {
+		if !accountPattern.MatchString(line.Account) || !validCurrency(line.Currency) {
+			return fmt.Errorf("Journal entry (%s) posts to account (%s) in currency (%s)", entry.ID, line.Account, line.Currency)
+		}
+		if (line.Debit > 0) == (line.Credit > 0) || line.Debit < 0 || line.Credit < 0 {
+			return fmt.Errorf("Journal entry (%s) has a line that isn't either a positive debit or a positive credit of (%s)", entry.ID, line.Account)
+		}
+		balances[line.Currency] += line.Debit - line.Credit
+	}
+	for currency, balance := range balances {
+		if balance != 0 {
+			return fmt.Errorf("Journal entry (%s) debits %s more %s than it credits", entry.ID, formatMinorUnits(balance), currency)
+		}
+	}
+	return nil
+}
+
+// invoiceJournalEntry records what the invoice's customer owes its vendor through the platform.
+// A credit note's negative amount reverses that.
+func invoiceJournalEntry(inv Invoice) JournalEntry {
+	kind := journalInvoice
+	if inv.IsCreditNote() {
+		kind = journalCreditNote
+	}
+	entry := newJournalEntry(kind, inv.ID, invoiceCreatedAt(inv))
+	entry.transfer(customerReceivable(inv.CustomerID), vendorPayable(inv.VendorID), inv.CurrencyCode(), inv.AmountMinorUnits())
+	return entry
+}
+
+// paymentJournalEntry records the charge collecting the invoice's amount from its customer
+func paymentJournalEntry(inv Invoice) JournalEntry {
+	entry := newJournalEntry(journalPayment, inv.ID, invoiceCreatedAt(inv))
+	entry.Memo = inv.PaymentReference
+	entry.transfer(accountCash, customerReceivable(inv.CustomerID), inv.CurrencyCode(), inv.AmountMinorUnits())
+	return entry
+}
+
+// refundJournalEntry records the money a credit note's refund returned to its customer
+func refundJournalEntry(creditNote Invoice) JournalEntry {
+	entry := newJournalEntry(journalRefund, creditNote.ID, invoiceCreatedAt(creditNote))
+	entry.Memo = creditNote.RefundReference
+	entry.transfer(customerReceivable(creditNote.CustomerID), accountCash, creditNote.CurrencyCode(), -creditNote.AmountMinorUnits())
+	return entry
+}
+
+// payoutJournalEntries record a settled payout: its platform fee, the conversion of its invoices in other
+// currencies into the payout's, and the money paid to its vendor
+func payoutJournalEntries(payout Payout) []JournalEntry {
+	settledAt := payout.CreatedAt
+	if payout.SettledAt != nil {
+		settledAt = *payout.SettledAt
+	}
+	payable := vendorPayable(payout.VendorID)
+
+	fee := newJournalEntry(journalFee, payout.ID, settledAt)
+	fee.transfer(payable, accountRevenue, payout.Currency, payout.PlatformFee)
+	conversion := newJournalEntry(journalConversion, payout.ID, settledAt)
+	for _, converted := range payout.Conversions {
+		conversion.transfer(payable, accountFX, converted.Rate.From, converted.Amount)
+		conversion.transfer(accountFX, payable, converted.Rate.To, converted.Converted)
+	}
+	paid := newJournalEntry(journalPayout, payout.ID, settledAt)
+	paid.transfer(payable, accountCash, payout.Currency, payout.Net)
+	return []JournalEntry{fee, conversion, paid}
+}
+
+// postJournalEntries posts the entries that have lines, skipping those already posted. It stops at the
+// first that fails, returning how many it posted and found already posted.
+func (app *App) postJournalEntries(context *RequestContext, entries []JournalEntry) (LedgerSyncResult, error) {
+	var result LedgerSyncResult
+	for _, entry := range entries {
+		if len(entry.Lines) == 0 {
+			continue
+		}
+		if err := entry.Validate(); err != nil {
+			return result, err
+		}
+		posted, err := app.Store.PostJournalEntry(context, entry)
+		if err != nil {
+			return result, err
+		}
+		if posted {
+			result.Posted++
+		} else {
+			result.AlreadyPosted++
+		}
+	}
+	return result, nil
+}
+
+// postToLedger posts the entries of an event that already happened, so a failure is only logged;
+// POST /api/ledger/sync posts the entries that are missing
+func (app *App) postToLedger(context *RequestContext, entries ...JournalEntry) {
+	if _, err := app.postJournalEntries(context, entries); err != nil {
+		app.Logger.LogErrFormatWithContext(context, "Couldn't post to the ledger, sync it: %v", err)
+	}
+}
+
+// parseAsOf reads the asOf parameter: an RFC 3339 time counts the entries posted before it, and a
+// YYYY-MM-DD date those posted until the end of that day in UTC. Empty counts every entry.
+func parseAsOf(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if day, err := time.Parse(exchangeRateDateLayout, value); err == nil {
+		return day.AddDate(0, 0, 1), nil
+	}
+	before, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("asOf (%s) must be an RFC 3339 time or a YYYY-MM-DD date", value)
+	}
+	return before, nil
+}
+
+// GetAccountBalanceHandler returns the account's balance in each of its currencies as of the asOf parameter
+func (app *App) GetAccountBalanceHandler(req *http.Request, context *RequestContext) *handlerResult {
+	account := mux.Vars(req)["account"]
+	if !accountPattern.MatchString(account) {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("(%s) is not an account, e.g. receivable:customer:<userId>", account)}
+	}
+	return app.writeBalances(req, context, account)
+}
+
+// GetBalancesHandler returns the balance of every account as of the asOf parameter, a trial balance
+func (app *App) GetBalancesHandler(req *http.Request, context *RequestContext) *handlerResult {
+	return app.writeBalances(req, context, "")
+}
+
+func (app *App) writeBalances(req *http.Request, context *RequestContext, account string) *handlerResult {
+	before, err := parseAsOf(req.URL.Query().Get("asOf"))
+	if err != nil {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	balances, err := app.Store.GetAccountBalances(context, account, before)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if balances == nil {
+		balances = []AccountBalance{}
+	}
+	for i, balance := range balances {
+		balances[i].Balance = balance.Credits - balance.Debits
+		if isDebitAccount(balance.Account) {
+			balances[i].Balance = -balances[i].Balance
+		}
+	}
+	balancesBytes, err := json.Marshal(balances)
+	if err != nil {
+		return &handlerResult{Error: AddMyInfoToErr(err)}
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Message: string(balancesBytes)}
+}
+
+// GetJournalEntriesHandler lists the entries in the order they were posted, optionally only those posting
+// to the account parameter, recording the reference parameter or posted as of the asOf parameter
+func (app *App) GetJournalEntriesHandler(req *http.Request, context *RequestContext) *handlerResult {
+	query := req.URL.Query()
+	before, err := parseAsOf(query.Get("asOf"))
+	if err != nil {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	filter := JournalEntryFilter{Account: query.Get("account"), Reference: query.Get("reference"), Before: before}
+	entries, err := app.Store.GetJournalEntries(context, filter)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if entries == nil {
+		entries = []JournalEntry{}
+	}
+	entriesBytes, err := json.Marshal(entries)
+	if err != nil {
+		return &handlerResult{Error: AddMyInfoToErr(err)}
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Message: string(entriesBytes)}
+}
+
+// errLedgerSyncStopped stops an invoice export once an entry fails to post
+var errLedgerSyncStopped = errors.New("ledger sync stopped")
+
+// SyncLedgerHandler posts the entries missing for the invoices, credit notes and settled payouts stored,
+// e.g. those created before the ledger or whose posting failed. Payments are only known from the
+// processor's reference recorded on their invoice.
+func (app *App) SyncLedgerHandler(req *http.Request, context *RequestContext) *handlerResult {
+	var synced LedgerSyncResult
+	var postErr error
+	post := func(entries ...JournalEntry) error {
+		var result LedgerSyncResult
+		result, postErr = app.postJournalEntries(context, entries)
+		synced.Posted += result.Posted
+		synced.AlreadyPosted += result.AlreadyPosted
+		if postErr != nil {
+			return errLedgerSyncStopped
+		}
+		return nil
+	}
+
+	err := app.Store.ExportInvoices(context, InvoiceExportFilter{}, func(inv Invoice) error {
+		entries := []JournalEntry{invoiceJournalEntry(inv)}
+		if inv.IsCreditNote() && inv.RefundReference != "" {
+			entries = append(entries, refundJournalEntry(inv))
+		} else if !inv.IsCreditNote() && inv.PaymentReference != "" {
+			entries = append(entries, paymentJournalEntry(inv))
+		}
+		return post(entries...)
+	})
+	if err == errLedgerSyncStopped {
+		err = postErr
+	}
+	if err == nil {
+		var payouts []Payout
+		payouts, err = app.Store.GetPayouts(context, PayoutFilter{Status: payoutSettled})
+		for _, payout := range payouts {
+			if post(payoutJournalEntries(payout)...) != nil {
+				err = postErr
+				break
+			}
+		}
+	}
+	app.Logger.LogWithContext(context, "Synced the ledger, posted %d entries, %d were already posted", synced.Posted, synced.AlreadyPosted)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+
+	syncedBytes, err := json.Marshal(synced)
+	if err != nil {
+		return &handlerResult{Error: AddMyInfoToErr(err)}
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Message: string(syncedBytes)}
+}
@@ -5,39 +5,55 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
 
 var flags = log.Flags() | log.LUTC | log.Lmicroseconds | log.Lshortfile
-var stdLogger = log.New(os.Stdout, "", flags)
-var errLogger = log.New(os.Stderr, "Error: ", flags)
+
+// Logger writes standard messages to one writer and errors to another
+type Logger struct {
+	stdLogger *log.Logger
+	errLogger *log.Logger
+}
+
+// NewLogger creates a Logger writing standard messages to stdOut and errors to errOut
+func NewLogger(stdOut, errOut io.Writer) *Logger {
+	return &Logger{
+		stdLogger: log.New(stdOut, "", flags),
+		errLogger: log.New(errOut, "Error: ", flags),
+	}
+}
+
+// defaultLogger is the logger of the service, writing to standard output and standard error
+var defaultLogger = NewLogger(os.Stdout, os.Stderr)
 
 // Log logs a standard message
-func Log(format string, a ...interface{}) {
-	logMessageTo(stdLogger, format, a...)
+func (logger *Logger) Log(format string, a ...interface{}) {
+	logMessageTo(logger.stdLogger, format, a...)
 }
 
-func LogWithContext(context *RequestContext, format string, a ...interface{}) {
-	logMessageTo(stdLogger, fmt.Sprintf("%s - %s", context.RequestID.String(), format), a...)
+func (logger *Logger) LogWithContext(context *RequestContext, format string, a ...interface{}) {
+	logMessageTo(logger.stdLogger, fmt.Sprintf("%s - %s", context.RequestID.String(), format), a...)
 }
 
 // LogErrFormat logs an error message
-func LogErrFormat(format string, a ...interface{}) {
-	logMessageTo(errLogger, format, a...)
+func (logger *Logger) LogErrFormat(format string, a ...interface{}) {
+	logMessageTo(logger.errLogger, format, a...)
 }
 
-func LogErrFormatWithContext(context *RequestContext, format string, a ...interface{}) {
-	logMessageTo(errLogger, fmt.Sprintf("%s - %s", context.RequestID.String(), format), a...)
+func (logger *Logger) LogErrFormatWithContext(context *RequestContext, format string, a ...interface{}) {
+	logMessageTo(logger.errLogger, fmt.Sprintf("%s - %s", context.RequestID.String(), format), a...)
 }
 
 // LogError logs an error type
-func LogError(err error) {
-	logMessageTo(errLogger, fmt.Sprintf("%v", err))
+func (logger *Logger) LogError(err error) {
+	logMessageTo(logger.errLogger, "%v", err)
 }
 
-func LogErrorWithContext(context *RequestContext, err error) {
-	logMessageTo(errLogger, fmt.Sprintf("%s - %v", context.RequestID.String(), err))
+func (logger *Logger) LogErrorWithContext(context *RequestContext, err error) {
+	logMessageTo(logger.errLogger, "%s - %v", context.RequestID.String(), err)
 }
 
 func logMessageTo(out *log.Logger, format string, a ...interface{}) {
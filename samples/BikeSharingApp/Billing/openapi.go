@@ -0,0 +1,418 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+	// openAPITag holds comma separated options on model fields. "required" marks fields requests must set.
+	openAPITag = "openapi"
+)
+
+// apiRoute is an endpoint, along with what the OpenAPI specification says about it
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler http.Handler
+	// Request is an example of the JSON request body, nil if there's none
+	Request interface{}
+	// Responses holds an example of the JSON body of each status, nil if the body is plain text
+	Responses map[int]interface{}
+	// Query lists the query parameters the route reads
+	Query []OpenAPIParameter
+	// Timeout returns the deadline of the route's requests, nil for the request timeout
+	Timeout func(config Config) time.Duration
+	// Deprecated routes belong to an API version that has a successor
+	Deprecated bool
+	// RequiresRequestID routes fail without the x-contoso-request-id header
+	RequiresRequestID bool
+}
+
+// ndjsonStream is the example body of a response streaming newline delimited JSON records like Record
+type ndjsonStream struct {
+	Record interface{}
+}
+
+// fileDocument is the example body of a response that is a document in one of ContentTypes
+type fileDocument struct {
+	ContentTypes []string
+}
+
+// queryParameter describes an optional query parameter
+func queryParameter(name, description string) OpenAPIParameter {
+	return OpenAPIParameter{Name: name, In: "query", Description: description, Schema: &OpenAPISchema{Type: "string"}}
+}
+
+// requiredQueryParameter describes a query parameter the route fails without
+func requiredQueryParameter(name, description string) OpenAPIParameter {
+	parameter := queryParameter(name, description)
+	parameter.Required = true
+	return parameter
+}
+
+// OpenAPISpec is an OpenAPI 3 document
+type OpenAPISpec struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIComponents struct {
+	Schemas map[string]*OpenAPISchema `json:"schemas"`
+}
+
+type OpenAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	OperationID string                      `json:"operationId"`
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+	Parameters  []OpenAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+type OpenAPIBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPISchema is the subset of JSON schema the models need
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+}
+
+var (
+	pathParameterPattern = regexp.MustCompile(`{([^}]+)}`)
+	timeType             = reflect.TypeOf(time.Time{})
+)
+
+// NewOpenAPISpec generates the specification of routes from the Go types of their bodies
+func NewOpenAPISpec(title, version string, routes []apiRoute) *OpenAPISpec {
+	spec := &OpenAPISpec{
+		OpenAPI:    openAPIVersion,
+		Info:       OpenAPIInfo{Title: title, Version: version},
+		Paths:      map[string]map[string]*OpenAPIOperation{},
+		Components: OpenAPIComponents{Schemas: map[string]*OpenAPISchema{}},
+	}
+
+	for _, route := range routes {
+		operation := &OpenAPIOperation{
+			Summary:     route.Summary,
+			OperationID: operationID(route),
+			Deprecated:  route.Deprecated,
+			Responses:   map[string]*OpenAPIResponse{},
+		}
+		for _, match := range pathParameterPattern.FindAllStringSubmatch(route.Path, -1) {
+			operation.Parameters = append(operation.Parameters, OpenAPIParameter{
+				Name: match[1], In: "path", Required: true, Schema: &OpenAPISchema{Type: "string"},
+			})
+		}
+		if route.RequiresRequestID {
+			operation.Parameters = append(operation.Parameters, OpenAPIParameter{
+				Name: RequestIDHeaderName, In: "header", Required: true, Schema: &OpenAPISchema{Type: "string", Format: "uuid"},
+			})
+		}
+		operation.Parameters = append(operation.Parameters, route.Query...)
+		if route.Request != nil {
+			operation.RequestBody = &OpenAPIBody{
+				Required: true,
+				Content:  jsonContent(spec.schemaFor(reflect.TypeOf(route.Request))),
+			}
+		}
+		for status, body := range route.Responses {
+			response := &OpenAPIResponse{Description: http.StatusText(status)}
+			if stream, ok := body.(ndjsonStream); ok {
+				response.Content = map[string]OpenAPIMediaType{ndjsonContentType: {Schema: spec.schemaFor(reflect.TypeOf(stream.Record))}}
+			} else if document, ok := body.(fileDocument); ok {
+				response.Content = map[string]OpenAPIMediaType{}
+				for _, contentType := range document.ContentTypes {
+					response.Content[contentType] = OpenAPIMediaType{Schema: &OpenAPISchema{Type: "string"}}
+				}
+			} else if body != nil {
+				response.Content = jsonContent(spec.schemaFor(reflect.TypeOf(body)))
+			} else {
+				response.Content = map[string]OpenAPIMediaType{"text/plain": {Schema: &OpenAPISchema{Type: "string"}}}
+			}
+			operation.Responses[strconv.Itoa(status)] = response
+		}
+
+		if spec.Paths[route.Path] == nil {
+			spec.Paths[route.Path] = map[string]*OpenAPIOperation{}
+		}
+		spec.Paths[route.Path][strings.ToLower(route.Method)] = operation
+	}
+	return spec
+}
+
+func jsonContent(schema *OpenAPISchema) map[string]OpenAPIMediaType {
+	return map[string]OpenAPIMediaType{"application/json": {Schema: schema}}
+}
+
+// operationID names the operation after the method and the path's literal segments, e.g. getCustomerInvoices
+func operationID(route apiRoute) string {
+	id := strings.ToLower(route.Method)
+	for _, segment := range strings.Split(route.Path, "/") {
+		if segment == "" || segment == "api" || strings.HasPrefix(segment, "{") {
+			continue
+		}
+		id += strings.ToUpper(segment[:1]) + segment[1:]
+	}
+	return id
+}
+
+// schemaFor returns the schema of values of type t, adding the schemas of named structs to the components
+func (spec *OpenAPISpec) schemaFor(t reflect.Type) *OpenAPISchema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case t.Kind() == reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		format := "int32"
+		if t.Bits() > 32 {
+			format = "int64"
+		}
+		return &OpenAPISchema{Type: "integer", Format: format}
+	case t.Kind() == reflect.Float32:
+		return &OpenAPISchema{Type: "number", Format: "float"}
+	case t.Kind() == reflect.Float64:
+		return &OpenAPISchema{Type: "number", Format: "double"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return &OpenAPISchema{Type: "array", Items: spec.schemaFor(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: spec.schemaFor(t.Elem())}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := spec.Components.Schemas[t.Name()]; !ok {
+			// Reserve the name first, so recursive types terminate
+			spec.Components.Schemas[t.Name()] = &OpenAPISchema{}
+			*spec.Components.Schemas[t.Name()] = *spec.structSchema(t)
+		}
+		return &OpenAPISchema{Ref: "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Struct:
+		return spec.structSchema(t)
+	}
+	return &OpenAPISchema{}
+}
+
+// structSchema describes a struct as a JSON object, following the encoding/json rules for field names
+func (spec *OpenAPISpec) structSchema(t reflect.Type) *OpenAPISchema {
+	schema := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema.Properties[name] = spec.schemaFor(field.Type)
+		for _, option := range strings.Split(field.Tag.Get(openAPITag), ",") {
+			if option == "required" {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+	}
+	sort.Strings(schema.Required)
+	return schema
+}
+
+// resolve follows a $ref to the component it names
+func (spec *OpenAPISpec) resolve(schema *OpenAPISchema) *OpenAPISchema {
+	if schema.Ref == "" {
+		return schema
+	}
+	return spec.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+}
+
+// Validate returns a description of every way value, decoded from JSON, doesn't match schema
+func (spec *OpenAPISpec) Validate(schema *OpenAPISchema, value interface{}, path string) []string {
+	schema = spec.resolve(schema)
+	if value == nil {
+		// Optional properties may be null, required ones are checked by their object
+		return nil
+	}
+
+	var problems []string
+	mismatch := func() []string {
+		return []string{fmt.Sprintf("%s must be %s", path, describeSchemaType(schema))}
+	}
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for _, name := range schema.Required {
+			if object[name] == nil {
+				problems = append(problems, fmt.Sprintf("%s.%s is required", path, name))
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := schema.Properties[name]; ok {
+				problems = append(problems, spec.Validate(property, object[name], path+"."+name)...)
+			} else if schema.AdditionalProperties != nil {
+				problems = append(problems, spec.Validate(schema.AdditionalProperties, object[name], path+"."+name)...)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for i, item := range array {
+			problems = append(problems, spec.Validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		if schema.Format == "date-time" && text != "" {
+			if _, err := time.Parse(time.RFC3339Nano, text); err != nil {
+				problems = append(problems, fmt.Sprintf("%s must be an RFC 3339 time", path))
+			}
+		}
+		if len(schema.Enum) > 0 && !containsString(schema.Enum, text) {
+			problems = append(problems, fmt.Sprintf("%s must be one of %s", path, strings.Join(schema.Enum, ", ")))
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			return mismatch()
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return mismatch()
+		}
+	}
+	return problems
+}
+
+func describeSchemaType(schema *OpenAPISchema) string {
+	switch schema.Type {
+	case "object", "array", "integer":
+		return "an " + schema.Type
+	}
+	return "a " + schema.Type
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenAPIHandler serves the specification at /openapi.json
+func OpenAPIHandler(spec *OpenAPISpec) http.Handler {
+	encodedSpec, err := json.Marshal(spec)
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't encode the OpenAPI specification: %v", err))
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(encodedSpec)
+	})
+}
+
+// requestValidationMiddleware rejects request bodies that don't match the route's schema with a 400
+// listing the problems, while the validate_requests setting is on
+func (app *App) requestValidationMiddleware(spec *OpenAPISpec, route apiRoute, next http.Handler) http.Handler {
+	if route.Request == nil {
+		return next
+	}
+	schema := spec.Paths[route.Path][strings.ToLower(route.Method)].RequestBody.Content["application/json"].Schema
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !app.Config().ValidateRequests {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Couldn't read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		var decoded interface{}
+		problems := []string{"body must be JSON"}
+		if err := json.Unmarshal(body, &decoded); err == nil && decoded != nil {
+			problems = spec.Validate(schema, decoded, "body")
+		}
+		if len(problems) > 0 {
+			encodedProblems, _ := json.Marshal(problems)
+			rw.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(rw, "%s\n", encodedProblems)
+			return
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,42 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// PaymentProcessor moves customers' money. Billing only reaches the processor through it.
+type PaymentProcessor interface {
+	// Charge collects the invoice's amount from its customer, returning the processor's reference.
+	// The processor charges each invoice ID once, so a charge that may have happened can be retried.
+	Charge(context *RequestContext, inv Invoice) (string, error)
+	// Refund returns amount cents of a charged invoice to its customer, returning the processor's reference.
+	// The processor refunds each key once, so a refund that may have happened can be retried with its key.
+	Refund(context *RequestContext, inv Invoice, amount int64, key string) (string, error)
+}
+
+// loggingPaymentProcessor stands in for a real processor. It logs each payment, which always succeeds.
+type loggingPaymentProcessor struct {
+	logger *Logger
+}
+
+func (processor loggingPaymentProcessor) Charge(context *RequestContext, inv Invoice) (string, error) {
+	return processor.record(context, "Charged %s to customer (%s) for invoice (%s)", formatMinorUnits(inv.AmountMinorUnits()), inv.CustomerID, inv.ID)
+}
+
+func (processor loggingPaymentProcessor) Refund(context *RequestContext, inv Invoice, amount int64, key string) (string, error) {
+	return processor.record(context, "Refunded %s to customer (%s) for invoice (%s) with key (%s)", formatMinorUnits(amount), inv.CustomerID, inv.ID, key)
+}
+
+func (processor loggingPaymentProcessor) record(context *RequestContext, format string, args ...interface{}) (string, error) {
+	reference, err := uuid.NewV4()
+	if err != nil {
+		return "", AddMyInfoToErr(err)
+	}
+	processor.logger.LogWithContext(context, "%s (payment reference: %s)", fmt.Sprintf(format, args...), reference)
+	return reference.String(), nil
+}
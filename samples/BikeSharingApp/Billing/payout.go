@@ -0,0 +1,335 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The states of a payout. Payouts are created pending, submitted once approved, and then either settled
+// or failed. Failing a payout releases its invoices, so that they're paid out in a later one.
+const (
+	payoutPending   = "pending"
+	payoutSubmitted = "submitted"
+	payoutSettled   = "settled"
+	payoutFailed    = "failed"
+)
+
+// payoutStates are the valid values of Payout.Status
+var payoutStates = []string{payoutPending, payoutSubmitted, payoutSettled, payoutFailed}
+
+// payoutTransitions lists the states each state can be reached from
+var payoutTransitions = map[string][]string{
+	payoutSubmitted: {payoutPending},
+	payoutSettled:   {payoutSubmitted},
+	payoutFailed:    {payoutPending, payoutSubmitted},
+}
+
+// basisPoints is the denominator of the platform fee rate
+const basisPoints = 10000
+
+// Payout pays a vendor the amounts of a batch of invoices, less the platform fee. Amounts are in the minor
+// unit of Currency.
+type Payout struct {
+	ID         string   `bson:"id" json:"id"`
+	VendorID   string   `bson:"vendorId" json:"vendorId"`
+	Status     string   `bson:"status" json:"status"`
+	InvoiceIDs []string `bson:"invoiceIds" json:"invoiceIds"`
+	// ReleasedInvoiceIDs are the invoices a failed payout had, which later payouts may claim
+	ReleasedInvoiceIDs []string `bson:"releasedInvoiceIds,omitempty" json:"releasedInvoiceIds,omitempty"`
+	// Currency is the vendor's. The amounts of invoices in other currencies are converted into it.
+	Currency string `bson:"currency" json:"currency"`
+	// Conversions records the rate each converted invoice's amount was converted at
+	Conversions []CurrencyConversion `bson:"conversions,omitempty" json:"conversions,omitempty"`
+	// Gross is the sum of the invoices' amounts
+	Gross int64 `bson:"gross" json:"gross"`
+	// PlatformFeeBps is the platform fee rate the payout was created with, in basis points of Gross
+	PlatformFeeBps int   `bson:"platformFeeBps" json:"platformFeeBps"`
+	PlatformFee    int64 `bson:"platformFee" json:"platformFee"`
+	// Net is what the vendor is paid, Gross less PlatformFee
+	Net int64 `bson:"net" json:"net"`
+
+	CreatedAt     time.Time  `bson:"createdAt" json:"createdAt"`
+	SubmittedAt   *time.Time `bson:"submittedAt,omitempty" json:"submittedAt,omitempty"`
+	SettledAt     *time.Time `bson:"settledAt,omitempty" json:"settledAt,omitempty"`
+	FailedAt      *time.Time `bson:"failedAt,omitempty" json:"failedAt,omitempty"`
+	FailureReason string     `bson:"failureReason,omitempty" json:"failureReason,omitempty"`
+}
+
+// PayoutFilter selects the payouts to list. Zero fields don't filter.
+type PayoutFilter struct {
+	VendorID string
+	Status   string
+}
+
+// NewPayout returns the pending payout in currency of a vendor's invoices, their amounts converted by convert
+func NewPayout(ID bson.ObjectId, vendorID, currency string, invoices []Invoice, convert func(Invoice) (int64, *CurrencyConversion, error),
+	platformFeeBps int, now time.Time) (Payout, error) {
+	payout := Payout{
+		ID:             ID.Hex(),
+		VendorID:       vendorID,
+		Status:         payoutPending,
+		InvoiceIDs:     make([]string, len(invoices)),
+		Currency:       currency,
+		PlatformFeeBps: platformFeeBps,
+		CreatedAt:      now.UTC(),
+	}
+	for i, inv := range invoices {
+		amount, conversion, err := convert(inv)
+		if err != nil {
+			return Payout{}, err
+		}
+		if conversion != nil {
+			payout.Conversions = append(payout.Conversions, *conversion)
+		}
+		payout.InvoiceIDs[i] = inv.ID
+		payout.Gross += amount
+	}
+	payout.PlatformFee = roundCents(big.NewRat(payout.Gross*int64(platformFeeBps), basisPoints), taxRoundHalfUp)
+	payout.Net = payout.Gross - payout.PlatformFee
+	return payout, nil
+}
+
+// Serialize serializes a payout to JSON
+func (payout Payout) Serialize() (string, error) {
+	val, err := json.Marshal(payout)
+	if err != nil {
+		return "", AddMyInfoToErr(err)
+	}
+	return string(val), nil
+}
+
+// NewPayoutsHandler groups the invoices created before the before parameter (default now) that aren't in
+// a payout yet into a pending payout per vendor, or only the vendorId parameter's. Vendors with invoices
+// no exchange rate converts are left for a later run, or fail with 409 when they're the only one.
+func (app *App) NewPayoutsHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+	result = &handlerResult{}
+
+	query := req.URL.Query()
+	before := app.Clock.Now()
+	if value := query.Get("before"); value != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			result.ResponseCode = http.StatusBadRequest
+			result.Message = fmt.Sprintf("before (%s) isn't an RFC 3339 time", value)
+			return
+		}
+		before = parsed
+	}
+	vendorIDs := []string{query.Get("vendorId")}
+	allVendors := vendorIDs[0] == ""
+	if allVendors {
+		var err error
+		if vendorIDs, err = app.Store.GetPayableVendors(context, before); err != nil {
+			result.Error = err
+			return
+		}
+	}
+
+	platformFeeBps := app.Config().PayoutPlatformFeeBps
+	payouts := []Payout{}
+	for _, vendorID := range vendorIDs {
+		payout, ok, err := app.createPayout(context, vendorID, before, platformFeeBps)
+		if _, missingRate := err.(noExchangeRateError); missingRate {
+			if !allVendors {
+				result.ResponseCode = http.StatusConflict
+				result.Message = fmt.Sprintf("Vendor (%s) can't be paid out: %v", vendorID, err)
+				return
+			}
+			app.Logger.LogErrFormatWithContext(context, "Not paying out vendor (%s): %v", vendorID, err)
+			continue
+		}
+		if err != nil {
+			result.Error = err
+			return
+		}
+		if ok {
+			payouts = append(payouts, payout)
+		}
+	}
+	app.Logger.LogWithContext(context, "Created %d payouts of the invoices before %s", len(payouts), before.Format(time.RFC3339))
+	writePayouts(payouts, result)
+	return
+}
+
+// createPayout claims the vendor's invoices created before before that aren't in a payout yet, and adds
+// their payout in the vendor's currency. It returns false when there are none.
+func (app *App) createPayout(context *RequestContext, vendorID string, before time.Time, platformFeeBps int) (Payout, bool, error) {
+	vendor, _, err := app.Store.GetVendorByUserId(context, vendorID)
+	if err != nil {
+		return Payout{}, false, err
+	}
+	currency := app.vendorCurrency(vendor)
+
+	payoutID := bson.NewObjectId()
+	invoices, err := app.Store.ClaimPayoutInvoices(context, vendorID, before, payoutID)
+	if err != nil || len(invoices) == 0 {
+		return Payout{}, false, err
+	}
+
+	payout, err := NewPayout(payoutID, vendorID, currency, invoices, app.newCurrencyConverter(context, currency).convert, platformFeeBps, app.Clock.Now())
+	if err == nil {
+		err = app.Store.AddPayout(context, payout)
+	}
+	if err != nil {
+		if releaseErr := app.Store.ReleasePayoutInvoices(context, payoutID); releaseErr != nil {
+			app.Logger.LogErrFormatWithContext(context, "Couldn't release the invoices of payout (%s): %v", payoutID.Hex(), releaseErr)
+		}
+		return Payout{}, false, err
+	}
+	app.Logger.LogWithContext(context, "Created payout (%s) of %d invoices for vendor (%s)", payout.ID, len(invoices), vendorID)
+	return payout, true, nil
+}
+
+// GetPayoutsHandler lists the payouts, optionally only those with the status or vendorId parameters
+func (app *App) GetPayoutsHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+	result = &handlerResult{}
+
+	query := req.URL.Query()
+	filter := PayoutFilter{VendorID: query.Get("vendorId"), Status: query.Get("status")}
+	if filter.Status != "" && !isPayoutState(filter.Status) {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = fmt.Sprintf("status (%s) must be one of %v", filter.Status, payoutStates)
+		return
+	}
+	payouts, err := app.Store.GetPayouts(context, filter)
+	if err != nil {
+		result.Error = err
+		return
+	}
+	writePayouts(payouts, result)
+	return
+}
+
+func (app *App) GetPayoutHandler(req *http.Request, context *RequestContext) *handlerResult {
+	payout, result := app.findPayout(req, context)
+	if result != nil {
+		return result
+	}
+	message, err := payout.Serialize()
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Message: message}
+}
+
+// ApprovePayoutHandler submits a pending payout
+func (app *App) ApprovePayoutHandler(req *http.Request, context *RequestContext) *handlerResult {
+	return app.transitionPayout(req, context, payoutSubmitted)
+}
+
+// SettlePayoutHandler records that a submitted payout reached the vendor
+func (app *App) SettlePayoutHandler(req *http.Request, context *RequestContext) *handlerResult {
+	return app.transitionPayout(req, context, payoutSettled)
+}
+
+// FailPayoutHandler records why a payout failed, with the reason parameter, and releases its invoices
+func (app *App) FailPayoutHandler(req *http.Request, context *RequestContext) *handlerResult {
+	return app.transitionPayout(req, context, payoutFailed)
+}
+
+// transitionPayout moves the payout to the status, failing with 409 unless it's reachable from the
+// payout's current status
+func (app *App) transitionPayout(req *http.Request, context *RequestContext, status string) *handlerResult {
+	payout, result := app.findPayout(req, context)
+	if result != nil {
+		return result
+	}
+	from := payout.Status
+	if !canTransitionPayout(from, status) {
+		return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Payout (%s) is %s, it can't become %s", payout.ID, from, status)}
+	}
+
+	now := app.Clock.Now().UTC()
+	payout.Status = status
+	switch status {
+	case payoutSubmitted:
+		payout.SubmittedAt = &now
+	case payoutSettled:
+		payout.SettledAt = &now
+	case payoutFailed:
+		payout.FailedAt = &now
+		payout.FailureReason = req.URL.Query().Get("reason")
+		// Its invoices are released below, so that they're only ever listed by the payout paying them
+		payout.ReleasedInvoiceIDs = payout.InvoiceIDs
+		payout.InvoiceIDs = []string{}
+	}
+	ok, err := app.Store.UpdatePayout(context, payout, from)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if !ok {
+		return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Payout (%s) changed while becoming %s, try again", payout.ID, status)}
+	}
+	switch status {
+	case payoutSettled:
+		// A payout's fee is only earned once it's paid, failed payouts post nothing
+		app.postToLedger(context, payoutJournalEntries(payout)...)
+	case payoutFailed:
+		if err := app.Store.ReleasePayoutInvoices(context, bson.ObjectIdHex(payout.ID)); err != nil {
+			return &handlerResult{Error: err}
+		}
+	}
+	app.Logger.LogWithContext(context, "Payout (%s) went from %s to %s", payout.ID, from, status)
+
+	message, err := payout.Serialize()
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Message: message}
+}
+
+// findPayout gets the payout named by the request's path, or the result to respond with when there's none
+func (app *App) findPayout(req *http.Request, context *RequestContext) (Payout, *handlerResult) {
+	payoutID := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(payoutID) {
+		return Payout{}, &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("(%s) is not a valid payoutID", payoutID)}
+	}
+	payout, ok, err := app.Store.GetPayoutById(context, payoutID)
+	if err != nil {
+		return Payout{}, &handlerResult{Error: err}
+	}
+	if !ok {
+		return Payout{}, &handlerResult{ResponseCode: http.StatusNotFound, Message: fmt.Sprintf("Could not find payout with ID: (%s)", payoutID)}
+	}
+	return payout, nil
+}
+
+func writePayouts(payouts []Payout, result *handlerResult) {
+	if payouts == nil {
+		payouts = []Payout{}
+	}
+	payoutsBytes, err := json.Marshal(payouts)
+	if err != nil {
+		result.Error = AddMyInfoToErr(err)
+		return
+	}
+	result.Message = string(payoutsBytes)
+	result.ResponseCode = http.StatusOK
+}
+
+func isPayoutState(status string) bool {
+	for _, state := range payoutStates {
+		if state == status {
+			return true
+		}
+	}
+	return false
+}
+
+func canTransitionPayout(from, to string) bool {
+	for _, allowed := range payoutTransitions[to] {
+		if allowed == from {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,485 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The formats of payout files
+const (
+	// payoutFileNACHA is a NACHA ACH file of CCD credits
+	payoutFileNACHA = "nacha"
+	// payoutFilePain001 is an ISO 20022 pain.001.001.03 customer credit transfer initiation
+	payoutFilePain001 = "pain.001"
+
+	nachaContentType = "text/plain; charset=us-ascii"
+	// nachaCurrency is the only currency ACH moves
+	nachaCurrency      = "USD"
+	pain001ContentType = "application/xml"
+	pain001Namespace   = "urn:iso:std:iso:20022:tech:xsd:pain.001.001.03"
+
+	// effectiveDateLayout is the format of the date vendors are credited on
+	effectiveDateLayout = "2006-01-02"
+)
+
+// NACHA records are 94 characters long, written in blocks of 10
+const (
+	nachaRecordLength   = 94
+	nachaBlockingFactor = 10
+	// nachaEntryHashModulus keeps the 10 rightmost digits of entry hashes
+	nachaEntryHashModulus = 10000000000
+)
+
+// accountNumberPattern matches the account numbers both NACHA and pain.001 files can hold
+var accountNumberPattern = regexp.MustCompile(`^[0-9A-Za-z-]{1,17}$`)
+
+// PayoutOriginator is the platform's account that payouts are paid from
+type PayoutOriginator struct {
+	Name string
+	// ID is the NACHA company identification, e.g. 1 followed by the EIN
+	ID            string
+	RoutingNumber string
+	AccountNumber string
+	// BankName is the name of the bank that holds the account and receives the files
+	BankName string
+}
+
+// PayoutFileRequest asks for the file paying out a set of submitted payouts
+type PayoutFileRequest struct {
+	// Format is payoutFileNACHA or payoutFilePain001
+	Format    string   `json:"format" openapi:"required"`
+	PayoutIDs []string `json:"payoutIds" openapi:"required"`
+	// EffectiveDate is when the vendors are credited, YYYY-MM-DD
+	EffectiveDate string `json:"effectiveDate" openapi:"required"`
+	// CreatedAt is recorded as the file's creation time, by default now. Files of the same request are identical.
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+}
+
+// payoutFile holds everything a payout file is generated from. Generating it has no other inputs, so the
+// same payoutFile always produces the same file.
+type payoutFile struct {
+	Originator    PayoutOriginator
+	CreatedAt     time.Time
+	EffectiveDate time.Time
+	// Credits are ordered by payout ID
+	Credits []payoutCredit
+}
+
+// payoutCredit is the credit paying a payout into its vendor's account
+type payoutCredit struct {
+	Payout Payout
+	Vendor Vendor
+}
+
+// ID identifies the file by its payouts, as the pain.001 message ID
+func (file payoutFile) ID() string {
+	hash := sha256.New()
+	for _, credit := range file.Credits {
+		fmt.Fprintln(hash, credit.Payout.ID)
+	}
+	return "PAYOUTS-" + strings.ToUpper(hex.EncodeToString(hash.Sum(nil))[:16])
+}
+
+// Validate returns a JSON array of everything that would make the file unusable
+func (file payoutFile) Validate() error {
+	var errorSlice []string
+	if file.Originator.Name == "" || file.Originator.ID == "" || file.Originator.BankName == "" {
+		errorSlice = append(errorSlice, "payout_originator_name, payout_originator_id and payout_bank_name must be configured")
+	}
+	if !accountNumberPattern.MatchString(file.Originator.AccountNumber) {
+		errorSlice = append(errorSlice, "payout_originator_account_number must be at most 17 letters, digits and hyphens")
+	}
+	if !isRoutingNumber(file.Originator.RoutingNumber) {
+		errorSlice = append(errorSlice, "payout_originator_routing_number must be configured with an ABA routing number")
+	}
+	for _, credit := range file.Credits {
+		if credit.Payout.Net <= 0 {
+			errorSlice = append(errorSlice, fmt.Sprintf("Payout (%s) has nothing to pay", credit.Payout.ID))
+		}
+		if !isRoutingNumber(credit.Vendor.RoutingNumber) {
+			errorSlice = append(errorSlice, fmt.Sprintf("Vendor (%s) has an invalid routing number", credit.Payout.VendorID))
+		}
+		if !accountNumberPattern.MatchString(credit.Vendor.AccountNumber) {
+			errorSlice = append(errorSlice, fmt.Sprintf("Vendor (%s) has an invalid account number", credit.Payout.VendorID))
+		}
+	}
+
+	if len(errorSlice) > 0 {
+		errorBytes, err := json.Marshal(errorSlice)
+		if err != nil {
+			return AddMyInfoToErr(err)
+		}
+		return errors.New(string(errorBytes))
+	}
+	return nil
+}
+
+// NACHA writes the file as one batch of CCD credits to checking accounts, each followed by an addenda
+// naming the payout
+func (file payoutFile) NACHA() ([]byte, error) {
+	var records []string
+	originator := file.Originator
+	originatingDFI := originator.RoutingNumber[:8]
+	createdAt := file.CreatedAt.UTC()
+
+	records = append(records, "1"+"01"+
+		" "+originator.RoutingNumber+
+		nachaNumber(originator.ID, 10)+
+		createdAt.Format("060102")+createdAt.Format("1504")+
+		"A"+"094"+"10"+"1"+
+		nachaAlpha(originator.BankName, 23)+
+		nachaAlpha(originator.Name, 23)+
+		nachaAlpha("", 8))
+
+	const batchNumber = "0000001"
+	companyID := nachaAlpha(originator.ID, 10)
+	records = append(records, "5"+"220"+
+		nachaAlpha(originator.Name, 16)+
+		nachaAlpha("", 20)+
+		companyID+
+		"CCD"+
+		nachaAlpha("PAYOUT", 10)+
+		file.EffectiveDate.Format("060102")+
+		file.EffectiveDate.Format("060102")+
+		"   "+"1"+
+		originatingDFI+
+		batchNumber)
+
+	var entryHash, totalCredit int64
+	for i, credit := range file.Credits {
+		sequence := fmt.Sprintf("%07d", i+1)
+		receivingDFI := credit.Vendor.RoutingNumber[:8]
+		entryHash += parseDigits(receivingDFI)
+		totalCredit += credit.Payout.Net
+
+		records = append(records, "6"+"22"+
+			credit.Vendor.RoutingNumber+
+			nachaAlpha(credit.Vendor.AccountNumber, 17)+
+			fmt.Sprintf("%010d", credit.Payout.Net)+
+			nachaAlpha(credit.Payout.VendorID, 15)+
+			nachaAlpha(credit.Payout.VendorID, 22)+
+			"  "+"1"+
+			originatingDFI+sequence)
+		records = append(records, "7"+"05"+
+			nachaAlpha("PAYOUT "+credit.Payout.ID, 80)+
+			"0001"+
+			sequence)
+	}
+	entryHash %= nachaEntryHashModulus
+	entryAddendaCount := 2 * len(file.Credits)
+
+	records = append(records, "8"+"220"+
+		fmt.Sprintf("%06d", entryAddendaCount)+
+		fmt.Sprintf("%010d", entryHash)+
+		fmt.Sprintf("%012d", 0)+
+		fmt.Sprintf("%012d", totalCredit)+
+		companyID+
+		nachaAlpha("", 19)+
+		nachaAlpha("", 6)+
+		originatingDFI+
+		batchNumber)
+
+	blockCount := (len(records) + 1 + nachaBlockingFactor - 1) / nachaBlockingFactor
+	records = append(records, "9"+
+		fmt.Sprintf("%06d", 1)+
+		fmt.Sprintf("%06d", blockCount)+
+		fmt.Sprintf("%08d", entryAddendaCount)+
+		fmt.Sprintf("%010d", entryHash)+
+		fmt.Sprintf("%012d", 0)+
+		fmt.Sprintf("%012d", totalCredit)+
+		nachaAlpha("", 39))
+	for len(records)%nachaBlockingFactor != 0 {
+		records = append(records, strings.Repeat("9", nachaRecordLength))
+	}
+
+	var buffer bytes.Buffer
+	for i, record := range records {
+		if len(record) != nachaRecordLength {
+			return nil, fmt.Errorf("NACHA record %d is %d characters long, not %d", i+1, len(record), nachaRecordLength)
+		}
+		buffer.WriteString(record)
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes(), nil
+}
+
+// The subset of pain.001.001.03 that payout files use, with the elements in the order of the schema
+type pain001Document struct {
+	XMLName    xml.Name          `xml:"Document"`
+	Xmlns      string            `xml:"xmlns,attr"`
+	Initiation pain001Initiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001Initiation struct {
+	GroupHeader pain001GroupHeader `xml:"GrpHdr"`
+	Payments    []pain001Payment   `xml:"PmtInf"`
+}
+
+type pain001GroupHeader struct {
+	MessageID        string `xml:"MsgId"`
+	CreationDateTime string `xml:"CreDtTm"`
+	NumberOfTxs      int    `xml:"NbOfTxs"`
+	// ControlSum is left out of files in several currencies, whose amounts can't be added up
+	ControlSum      string       `xml:"CtrlSum,omitempty"`
+	InitiatingParty pain001Party `xml:"InitgPty"`
+}
+
+type pain001Payment struct {
+	PaymentInfoID          string            `xml:"PmtInfId"`
+	PaymentMethod          string            `xml:"PmtMtd"`
+	NumberOfTxs            int               `xml:"NbOfTxs"`
+	ControlSum             string            `xml:"CtrlSum"`
+	RequestedExecutionDate string            `xml:"ReqdExctnDt"`
+	Debtor                 pain001Party      `xml:"Dbtr"`
+	DebtorAccount          pain001Account    `xml:"DbtrAcct"`
+	DebtorAgent            pain001Agent      `xml:"DbtrAgt"`
+	Transfers              []pain001Transfer `xml:"CdtTrfTxInf"`
+}
+
+type pain001Transfer struct {
+	EndToEndID      string         `xml:"PmtId>EndToEndId"`
+	Amount          pain001Amount  `xml:"Amt>InstdAmt"`
+	CreditorAgent   pain001Agent   `xml:"CdtrAgt"`
+	Creditor        pain001Party   `xml:"Cdtr"`
+	CreditorAccount pain001Account `xml:"CdtrAcct"`
+	Remittance      string         `xml:"RmtInf>Ustrd"`
+}
+
+type pain001Party struct {
+	Name string `xml:"Nm"`
+}
+
+type pain001Account struct {
+	ID string `xml:"Id>Othr>Id"`
+}
+
+// pain001Agent identifies a US bank by its ABA routing number
+type pain001Agent struct {
+	ClearingSystem string `xml:"FinInstnId>ClrSysMmbId>ClrSysId>Cd"`
+	MemberID       string `xml:"FinInstnId>ClrSysMmbId>MmbId"`
+}
+
+type pain001Amount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// Pain001 writes the file as a pain.001.001.03 message with a payment per currency, ordered by currency,
+// and a credit transfer per payout
+func (file payoutFile) Pain001() ([]byte, error) {
+	originator := file.Originator
+	messageID := file.ID()
+	transfers := map[string][]pain001Transfer{}
+	controlSums := map[string]int64{}
+	var currencies []string
+	for _, credit := range file.Credits {
+		currency := credit.Payout.Currency
+		if _, ok := transfers[currency]; !ok {
+			currencies = append(currencies, currency)
+		}
+		controlSums[currency] += credit.Payout.Net
+		transfers[currency] = append(transfers[currency], pain001Transfer{
+			EndToEndID:      credit.Payout.ID,
+			Amount:          pain001Amount{Currency: currency, Value: formatMinorUnits(credit.Payout.Net)},
+			CreditorAgent:   pain001Agent{ClearingSystem: "USABA", MemberID: credit.Vendor.RoutingNumber},
+			Creditor:        pain001Party{Name: credit.Payout.VendorID},
+			CreditorAccount: pain001Account{ID: credit.Vendor.AccountNumber},
+			Remittance:      "Payout " + credit.Payout.ID,
+		})
+	}
+	sort.Strings(currencies)
+
+	payments := make([]pain001Payment, len(currencies))
+	for i, currency := range currencies {
+		payments[i] = pain001Payment{
+			PaymentInfoID:          fmt.Sprintf("%s-%d", messageID, i+1),
+			PaymentMethod:          "TRF",
+			NumberOfTxs:            len(transfers[currency]),
+			ControlSum:             formatMinorUnits(controlSums[currency]),
+			RequestedExecutionDate: file.EffectiveDate.Format(effectiveDateLayout),
+			Debtor:                 pain001Party{Name: originator.Name},
+			DebtorAccount:          pain001Account{ID: originator.AccountNumber},
+			DebtorAgent:            pain001Agent{ClearingSystem: "USABA", MemberID: originator.RoutingNumber},
+			Transfers:              transfers[currency],
+		}
+	}
+	groupHeader := pain001GroupHeader{
+		MessageID:        messageID,
+		CreationDateTime: file.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		NumberOfTxs:      len(file.Credits),
+		InitiatingParty:  pain001Party{Name: originator.Name},
+	}
+	if len(payments) == 1 {
+		groupHeader.ControlSum = payments[0].ControlSum
+	}
+
+	document := pain001Document{
+		Xmlns:      pain001Namespace,
+		Initiation: pain001Initiation{GroupHeader: groupHeader, Payments: payments},
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buffer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return nil, AddMyInfoToErr(err)
+	}
+	buffer.WriteString("\n")
+	return buffer.Bytes(), nil
+}
+
+// NewPayoutFileHandler generates the file paying out the requested payouts, which must all be submitted
+func (app *App) NewPayoutFileHandler(rw http.ResponseWriter, req *http.Request, context *RequestContext) *handlerResult {
+	var request PayoutFileRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	if request.Format != payoutFileNACHA && request.Format != payoutFilePain001 {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("format (%s) must be %s or %s", request.Format, payoutFileNACHA, payoutFilePain001)}
+	}
+	effectiveDate, err := time.Parse(effectiveDateLayout, request.EffectiveDate)
+	if err != nil {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("effectiveDate (%s) must be a date formatted YYYY-MM-DD", request.EffectiveDate)}
+	}
+	if len(request.PayoutIDs) == 0 {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: "payoutIds must list at least one payout"}
+	}
+
+	file := payoutFile{Originator: app.Config().PayoutOriginator, CreatedAt: app.Clock.Now(), EffectiveDate: effectiveDate}
+	if request.CreatedAt != nil {
+		file.CreatedAt = *request.CreatedAt
+	}
+	payoutIDs := append([]string(nil), request.PayoutIDs...)
+	sort.Strings(payoutIDs)
+	for i, payoutID := range payoutIDs {
+		if i > 0 && payoutID == payoutIDs[i-1] {
+			return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("Payout (%s) is listed twice", payoutID)}
+		}
+		credit, result := app.findPayoutCredit(context, payoutID)
+		if result != nil {
+			return result
+		}
+		file.Credits = append(file.Credits, credit)
+	}
+	if err := file.Validate(); err != nil {
+		return &handlerResult{ResponseCode: http.StatusConflict, Message: err.Error()}
+	}
+	if request.Format == payoutFileNACHA {
+		for _, credit := range file.Credits {
+			if credit.Payout.Currency != nachaCurrency {
+				return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Payout (%s) is in %s, NACHA files only pay %s", credit.Payout.ID, credit.Payout.Currency, nachaCurrency)}
+			}
+		}
+	}
+
+	contents, contentType, extension := []byte(nil), nachaContentType, "ach"
+	if request.Format == payoutFileNACHA {
+		contents, err = file.NACHA()
+	} else {
+		contents, err = file.Pain001()
+		contentType, extension = pain001ContentType, "xml"
+	}
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	app.Logger.LogWithContext(context, "Generated %s file (%s) of %d payouts", request.Format, file.ID(), len(file.Credits))
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", strings.ToLower(file.ID()), extension))
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(contents)
+	return &handlerResult{ResponseCode: http.StatusOK, Streamed: true}
+}
+
+// findPayoutCredit gets a submitted payout and its vendor, or the result to respond with when it can't be paid
+func (app *App) findPayoutCredit(context *RequestContext, payoutID string) (payoutCredit, *handlerResult) {
+	if !bson.IsObjectIdHex(payoutID) {
+		return payoutCredit{}, &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("(%s) is not a valid payoutID", payoutID)}
+	}
+	payout, ok, err := app.Store.GetPayoutById(context, payoutID)
+	if err != nil {
+		return payoutCredit{}, &handlerResult{Error: err}
+	}
+	if !ok {
+		return payoutCredit{}, &handlerResult{ResponseCode: http.StatusNotFound, Message: fmt.Sprintf("Could not find payout with ID: (%s)", payoutID)}
+	}
+	if payout.Status != payoutSubmitted {
+		return payoutCredit{}, &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Payout (%s) is %s, only %s payouts are paid", payoutID, payout.Status, payoutSubmitted)}
+	}
+	vendor, ok, err := app.Store.GetVendorByUserId(context, payout.VendorID)
+	if err != nil {
+		return payoutCredit{}, &handlerResult{Error: err}
+	}
+	if !ok {
+		return payoutCredit{}, &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Payout (%s) is to vendor (%s), who has no bank account", payoutID, payout.VendorID)}
+	}
+	return payoutCredit{Payout: payout, Vendor: vendor}, nil
+}
+
+// isRoutingNumber checks the length and the check digit of an ABA routing number
+func isRoutingNumber(routingNumber string) bool {
+	if len(routingNumber) != 9 || strings.Trim(routingNumber, "0123456789") != "" {
+		return false
+	}
+	weights := []int{3, 7, 1}
+	sum := 0
+	for i, digit := range routingNumber {
+		sum += int(digit-'0') * weights[i%3]
+	}
+	return sum%10 == 0
+}
+
+// nachaText uppercases value, replacing the characters NACHA files can't hold with spaces
+func nachaText(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r < ' ' || r > '~' {
+			return ' '
+		}
+		return r
+	}, value)
+}
+
+// nachaAlpha left-justifies value in a field of width characters, truncating it if it's longer
+func nachaAlpha(value string, width int) string {
+	value = nachaText(value)
+	if len(value) > width {
+		return value[:width]
+	}
+	return value + strings.Repeat(" ", width-len(value))
+}
+
+// nachaNumber right-justifies value in a field of width characters
+func nachaNumber(value string, width int) string {
+	value = nachaText(value)
+	if len(value) > width {
+		return value[len(value)-width:]
+	}
+	return strings.Repeat(" ", width-len(value)) + value
+}
+
+func parseDigits(digits string) int64 {
+	var value int64
+	for _, digit := range digits {
+		value = value*10 + int64(digit-'0')
+	}
+	return value
+}
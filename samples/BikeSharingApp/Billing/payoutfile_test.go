@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// updateGolden rewrites the golden files with the generated ones: go test -run PayoutFile -update
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testPayoutFile returns a file of two USD payouts, or of a USD and a EUR payout with currencies
+func testPayoutFile(currencies bool) payoutFile {
+	file := payoutFile{
+		Originator: PayoutOriginator{
+			Name:          "Contoso Bike Sharing",
+			ID:            "1234567890",
+			RoutingNumber: "021000021",
+			AccountNumber: "000123456789",
+			BankName:      "Contoso Bank",
+		},
+		CreatedAt:     time.Date(2026, time.October, 19, 8, 30, 0, 0, time.UTC),
+		EffectiveDate: time.Date(2026, time.October, 20, 0, 0, 0, 0, time.UTC),
+		Credits: []payoutCredit{
+			{
+				Payout: Payout{ID: "6a2f0c1e8b3d4a0012345601", VendorID: "vendor-1", Status: payoutSubmitted, Currency: "USD", Gross: 12500, PlatformFee: 1250, Net: 11250},
+				Vendor: Vendor{UserID: "vendor-1", RoutingNumber: "011000015", AccountNumber: "987654321"},
+			},
+			{
+				Payout: Payout{ID: "6a2f0c1e8b3d4a0012345602", VendorID: "vendor-2", Status: payoutSubmitted, Currency: "USD", Gross: 4005, PlatformFee: 401, Net: 3604},
+				Vendor: Vendor{UserID: "vendor-2", RoutingNumber: "121000358", AccountNumber: "55-0001"},
+			},
+		},
+	}
+	if currencies {
+		file.Credits[0].Payout.Currency = "EUR"
+	}
+	return file
+}
+
+// checkGolden compares generated with the golden file, or rewrites it with -update
+func checkGolden(t *testing.T, name string, generated []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, generated, 0644); err != nil {
+			t.Fatalf("Couldn't update %s: %v", path, err)
+		}
+	}
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", path, err)
+	}
+	if !bytes.Equal(generated, golden) {
+		t.Errorf("Generated file differs from %s, run with -update if the change is intended:\n%s", path, generated)
+	}
+}
+
+func TestPayoutFileNACHA(t *testing.T) {
+	file := testPayoutFile(false)
+	if err := file.Validate(); err != nil {
+		t.Fatalf("Expected a valid file, got %v", err)
+	}
+	contents, err := file.NACHA()
+	if err != nil {
+		t.Fatalf("Couldn't generate the NACHA file: %v", err)
+	}
+	checkGolden(t, "payouts.ach", contents)
+}
+
+func TestPayoutFilePain001(t *testing.T) {
+	file := testPayoutFile(false)
+	if err := file.Validate(); err != nil {
+		t.Fatalf("Expected a valid file, got %v", err)
+	}
+	contents, err := file.Pain001()
+	if err != nil {
+		t.Fatalf("Couldn't generate the pain.001 file: %v", err)
+	}
+	checkGolden(t, "payouts.xml", contents)
+}
+
+func TestPayoutFilePain001Currencies(t *testing.T) {
+	contents, err := testPayoutFile(true).Pain001()
+	if err != nil {
+		t.Fatalf("Couldn't generate the pain.001 file: %v", err)
+	}
+	checkGolden(t, "payouts-currencies.xml", contents)
+
+	var document pain001Document
+	if err := xml.Unmarshal(contents, &document); err != nil {
+		t.Fatalf("Couldn't parse the pain.001 file: %v", err)
+	}
+	if controlSum := document.Initiation.GroupHeader.ControlSum; controlSum != "" {
+		t.Errorf("Expected no group control sum across currencies, got %s", controlSum)
+	}
+	payments := document.Initiation.Payments
+	if len(payments) != 2 {
+		t.Fatalf("Expected a payment per currency, got %d", len(payments))
+	}
+	for i, expected := range []struct{ currency, controlSum string }{{"EUR", "112.50"}, {"USD", "36.04"}} {
+		payment := payments[i]
+		if payment.ControlSum != expected.controlSum || payment.Transfers[0].Amount.Currency != expected.currency {
+			t.Errorf("Expected payment %d to be %s %s, got %s %s", i+1, expected.controlSum, expected.currency, payment.ControlSum, payment.Transfers[0].Amount.Currency)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// The values of posted_amounts, what happens to the amount posted with a new invoice
+const (
+	// postedAmountsIgnore replaces the posted amount with the calculated one, recording it on the pricing
+	postedAmountsIgnore = "ignore"
+	// postedAmountsReject fails invoices posted with an amount other than the calculated one
+	postedAmountsReject = "reject"
+)
+
+const minutesPerDay = 24 * 60
+
+// PricingRules is the rule set invoice amounts are calculated with. Amounts are in the minor unit of
+// pricing_currency.
+type PricingRules struct {
+	// UnlockFee is charged once per ride
+	UnlockFee int64 `bson:"unlockFee" json:"unlockFee"`
+	// PerMinute is charged for every started minute of the ride
+	PerMinute int64 `bson:"perMinute" json:"perMinute"`
+	// DailyCap is the most the minutes of each started 24 hours of the ride cost, 0 for no cap
+	DailyCap int64 `bson:"dailyCap" json:"dailyCap"`
+	// MinimumCharge is the least a ride costs
+	MinimumCharge int64 `bson:"minimumCharge" json:"minimumCharge"`
+}
+
+// InvoicePricing records how an invoice's amount was calculated, so that it can be audited
+type InvoicePricing struct {
+	Currency string       `bson:"currency" json:"currency" openapi:"required"`
+	Rules    PricingRules `bson:"rules" json:"rules" openapi:"required"`
+	// Minutes is the number of started minutes between the invoice's start and end times
+	Minutes int64 `bson:"minutes" json:"minutes" openapi:"required"`
+	// UnlockFee and Usage are the charges before the minimum charge is applied, Usage after the daily cap
+	UnlockFee int64 `bson:"unlockFee" json:"unlockFee" openapi:"required"`
+	Usage     int64 `bson:"usage" json:"usage" openapi:"required"`
+	// Total is the amount charged, in cents
+	Total int64 `bson:"total" json:"total" openapi:"required"`
+	// PostedAmount is the amount the invoice was posted with, in cents, when it differed from Total
+	PostedAmount *int64 `bson:"postedAmount,omitempty" json:"postedAmount,omitempty"`
+}
+
+// Price calculates the charge of a ride from start to end
+func (rules PricingRules) Price(start, end time.Time) (InvoicePricing, error) {
+	if end.Before(start) {
+		return InvoicePricing{}, fmt.Errorf("endTime (%s) is before startTime (%s)", end.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+	minutes := int64(end.Sub(start) / time.Minute)
+	if end.Sub(start)%time.Minute != 0 {
+		minutes++
+	}
+
+	pricing := InvoicePricing{
+		Rules:     rules,
+		Minutes:   minutes,
+		UnlockFee: rules.UnlockFee,
+		Usage:     minutes / minutesPerDay * rules.dailyUsage(minutesPerDay),
+	}
+	pricing.Usage += rules.dailyUsage(minutes % minutesPerDay)
+	pricing.Total = pricing.UnlockFee + pricing.Usage
+	if pricing.Total < rules.MinimumCharge {
+		pricing.Total = rules.MinimumCharge
+	}
+	return pricing, nil
+}
+
+// dailyUsage is the charge for minutes within a single 24 hours, capped at DailyCap
+func (rules PricingRules) dailyUsage(minutes int64) int64 {
+	usage := minutes * rules.PerMinute
+	if rules.DailyCap > 0 && usage > rules.DailyCap {
+		return rules.DailyCap
+	}
+	return usage
+}
+
+// priceInvoice calculates inv's amount in currency from its start and end times and records the
+// calculation on it. A posted amount that differs from the calculated one fails under postedAmountsReject,
+// a posted currency that differs always does.
+func priceInvoice(inv *Invoice, rules PricingRules, currency, postedAmounts string) error {
+	if inv.Currency != "" && inv.Currency != currency {
+		return fmt.Errorf("currency (%s) must be %s, the currency rides are priced in", inv.Currency, currency)
+	}
+	pricing, err := rules.Price(*inv.StartTime, *inv.EndTime)
+	if err != nil {
+		return err
+	}
+	pricing.Currency = currency
+	if posted := inv.AmountMinorUnits(); posted != 0 && posted != pricing.Total {
+		if postedAmounts == postedAmountsReject {
+			return fmt.Errorf("amount (%s) doesn't match the calculated amount (%s), leave it out", formatMinorUnits(posted), formatMinorUnits(pricing.Total))
+		}
+		pricing.PostedAmount = &posted
+	}
+
+	inv.Amount = float32(pricing.Total) / 100
+	inv.Currency = currency
+	inv.Pricing = &pricing
+	return nil
+}
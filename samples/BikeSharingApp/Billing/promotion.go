@@ -0,0 +1,246 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The kinds of promotion, how a promo code's discount is calculated
+const (
+	promotionPercent = "percent"
+	promotionFixed   = "fixed"
+)
+
+// promoCodePattern matches promo codes, which are compared uppercased
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// Promotion is a promo code customers can post with a new invoice for a discount. Amounts are in the minor
+// unit of the invoice's currency. Promotions can't be changed once created, so that every redemption got
+// the same terms.
+type Promotion struct {
+	Code string `bson:"code" json:"code" openapi:"required"`
+	// Kind is promotionPercent or promotionFixed
+	Kind string `bson:"kind" json:"kind" openapi:"required"`
+	// PercentOff is the discount of a percent promotion, in whole percent of the invoice's price
+	PercentOff int `bson:"percentOff,omitempty" json:"percentOff,omitempty"`
+	// AmountOff is the discount of a fixed promotion, at most the invoice's price
+	AmountOff int64 `bson:"amountOff,omitempty" json:"amountOff,omitempty"`
+	// MinimumAmount is the least an invoice's price must be for the code to apply
+	MinimumAmount int64 `bson:"minimumAmount,omitempty" json:"minimumAmount,omitempty"`
+	// ExpiresAt is when the code stops applying, never when unset
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	// MaxRedemptions limits how many invoices, and MaxRedemptionsPerCustomer how many of each customer's
+	// invoices, can use the code. 0 doesn't limit.
+	MaxRedemptions            int `bson:"maxRedemptions,omitempty" json:"maxRedemptions,omitempty"`
+	MaxRedemptionsPerCustomer int `bson:"maxRedemptionsPerCustomer,omitempty" json:"maxRedemptionsPerCustomer,omitempty"`
+	// Redemptions counts the invoices that used the code
+	Redemptions int       `bson:"redemptions" json:"redemptions"`
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// InvoiceDiscount is the discount line of an invoice posted with a promo code. The invoice's amount is its
+// price less Amount, before tax.
+type InvoiceDiscount struct {
+	Code       string `bson:"code" json:"code" openapi:"required"`
+	Kind       string `bson:"kind" json:"kind" openapi:"required"`
+	PercentOff int    `bson:"percentOff,omitempty" json:"percentOff,omitempty"`
+	// Amount is what was taken off the price, in cents
+	Amount int64 `bson:"amount" json:"amount" openapi:"required"`
+}
+
+// Serialize serializes a promotion to JSON
+func (promo Promotion) Serialize() (string, error) {
+	val, err := json.Marshal(promo)
+	if err != nil {
+		return "", AddMyInfoToErr(err)
+	}
+	return string(val), nil
+}
+
+// Validate calls ValidatePromotion(promo) for the Promotion struct
+func (promo Promotion) Validate() error {
+	return ValidatePromotion(promo)
+}
+
+// ValidatePromotion checks a new promotion and returns a non-nil error if any issues
+func ValidatePromotion(promo Promotion) error {
+	var errorSlice []string
+
+	if !promoCodePattern.MatchString(promo.Code) {
+		errorSlice = append(errorSlice, "Code must be 3 to 32 letters, digits, '_' or '-'")
+	}
+	switch promo.Kind {
+	case promotionPercent:
+		if promo.PercentOff < 1 || promo.PercentOff > 100 || promo.AmountOff != 0 {
+			errorSlice = append(errorSlice, "A percent promotion must specify PercentOff from 1 to 100, and no AmountOff")
+		}
+	case promotionFixed:
+		if promo.AmountOff <= 0 || promo.PercentOff != 0 {
+			errorSlice = append(errorSlice, "A fixed promotion must specify a positive AmountOff, and no PercentOff")
+		}
+	default:
+		errorSlice = append(errorSlice, fmt.Sprintf("Kind must be %s or %s", promotionPercent, promotionFixed))
+	}
+	if promo.MinimumAmount < 0 || promo.MaxRedemptions < 0 || promo.MaxRedemptionsPerCustomer < 0 {
+		errorSlice = append(errorSlice, "MinimumAmount, MaxRedemptions and MaxRedemptionsPerCustomer must not be negative")
+	}
+	if promo.Redemptions != 0 || !promo.CreatedAt.IsZero() {
+		errorSlice = append(errorSlice, "Must not specify Redemptions or CreatedAt")
+	}
+
+	if len(errorSlice) > 0 {
+		errorBytes, err := json.Marshal(errorSlice)
+		if err != nil {
+			return AddMyInfoToErr(err)
+		}
+
+		return errors.New(string(errorBytes))
+	}
+
+	return nil
+}
+
+// normalizePromoCode returns the code as promotions are stored, so that codes match whatever their case
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Discount returns the discount of the promotion on an invoice priced at price, or why it doesn't apply
+func (promo Promotion) Discount(price int64, now time.Time) (InvoiceDiscount, error) {
+	if promo.ExpiresAt != nil && !now.Before(*promo.ExpiresAt) {
+		return InvoiceDiscount{}, fmt.Errorf("promo code (%s) expired at %s", promo.Code, promo.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if price < promo.MinimumAmount {
+		return InvoiceDiscount{}, fmt.Errorf("promo code (%s) only applies to rides of at least %s", promo.Code, formatMinorUnits(promo.MinimumAmount))
+	}
+
+	discount := InvoiceDiscount{Code: promo.Code, Kind: promo.Kind, PercentOff: promo.PercentOff}
+	switch promo.Kind {
+	case promotionPercent:
+		discount.Amount = roundCents(big.NewRat(price*int64(promo.PercentOff), 100), taxRoundHalfUp)
+	case promotionFixed:
+		discount.Amount = promo.AmountOff
+	}
+	if discount.Amount > price {
+		discount.Amount = price
+	}
+	return discount, nil
+}
+
+// discountInvoice applies the promo code inv was posted with to its price, returning the promotion to
+// redeem, or the result to respond with when it doesn't apply. It returns false when inv has no code.
+func (app *App) discountInvoice(context *RequestContext, inv *Invoice) (Promotion, bool, *handlerResult) {
+	if inv.PromoCode == "" {
+		return Promotion{}, false, nil
+	}
+	inv.PromoCode = normalizePromoCode(inv.PromoCode)
+	promo, ok, err := app.Store.GetPromotionByCode(context, inv.PromoCode)
+	if err != nil {
+		return Promotion{}, false, &handlerResult{Error: err}
+	}
+	if !ok {
+		return Promotion{}, false, &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("promo code (%s) doesn't exist", inv.PromoCode)}
+	}
+	discount, err := promo.Discount(inv.Pricing.Total, app.Clock.Now())
+	if err != nil {
+		return Promotion{}, false, &handlerResult{ResponseCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	if promo.MaxRedemptions > 0 && promo.Redemptions >= promo.MaxRedemptions {
+		return Promotion{}, false, promoCodeUsedUp(promo)
+	}
+
+	inv.Discount = &discount
+	inv.Amount = float32(inv.Pricing.Total-discount.Amount) / 100
+	return promo, true, nil
+}
+
+func promoCodeUsedUp(promo Promotion) *handlerResult {
+	return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("promo code (%s) has been redeemed as often as it can be", promo.Code)}
+}
+
+// NewPromotionHandler creates a promotion, failing with 409 if its code is taken
+func (app *App) NewPromotionHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+	result = &handlerResult{}
+
+	promo := Promotion{}
+	if err := json.NewDecoder(req.Body).Decode(&promo); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
+	promo.Code = normalizePromoCode(promo.Code)
+	if err := promo.Validate(); err != nil {
+		result.ResponseCode = http.StatusBadRequest
+		result.Message = err.Error()
+		return
+	}
+	promo.CreatedAt = app.Clock.Now().UTC()
+
+	ok, err := app.Store.AddPromotion(context, promo)
+	if err != nil {
+		result.Error = err
+		return
+	}
+	if !ok {
+		result.ResponseCode = http.StatusConflict
+		result.Message = fmt.Sprintf("promo code (%s) already exists", promo.Code)
+		return
+	}
+	app.Logger.LogWithContext(context, "Added promotion (%s)", promo.Code)
+
+	result.Message, err = promo.Serialize()
+	if err != nil {
+		result.Error = err
+	} else {
+		result.ResponseCode = http.StatusOK
+	}
+	return
+}
+
+func (app *App) GetPromotionsHandler(req *http.Request, context *RequestContext) (result *handlerResult) {
+	result = &handlerResult{}
+
+	promos, err := app.Store.GetPromotions(context)
+	if err != nil {
+		result.Error = err
+		return
+	}
+	if promos == nil {
+		promos = []Promotion{}
+	}
+	promosBytes, err := json.Marshal(promos)
+	if err != nil {
+		result.Error = AddMyInfoToErr(err)
+		return
+	}
+	result.Message = string(promosBytes)
+	result.ResponseCode = http.StatusOK
+	return
+}
+
+func (app *App) GetPromotionHandler(req *http.Request, context *RequestContext) *handlerResult {
+	code := normalizePromoCode(mux.Vars(req)["code"])
+	promo, ok, err := app.Store.GetPromotionByCode(context, code)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if !ok {
+		return &handlerResult{ResponseCode: http.StatusNotFound, Message: fmt.Sprintf("Could not find promotion with code: (%s)", code)}
+	}
+	message, err := promo.Serialize()
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Message: message}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The kinds of invoice documents. Invoices stored before kinds were recorded have none, and are invoices.
+const (
+	invoiceKindInvoice    = "invoice"
+	invoiceKindCreditNote = "creditNote"
+)
+
+// RefundRequest asks for part of an invoice's amount back
+type RefundRequest struct {
+	// Amount is what to refund, by default all that hasn't been refunded yet
+	Amount *float32 `json:"amount,omitempty"`
+	// Currency is the amount's, which must be the invoice's
+	Currency string `json:"currency,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// RefundRequestV2 is a RefundRequest as API v2 reads it, with the amount as Money
+type RefundRequestV2 struct {
+	Amount *Money `json:"amount,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewRefundRequestV2 returns the API v2 form of a RefundRequest
+func NewRefundRequestV2(request RefundRequest) RefundRequestV2 {
+	versioned := RefundRequestV2{Reason: request.Reason}
+	if request.Amount != nil {
+		versioned.Amount = &Money{Currency: request.Currency, MinorUnits: Invoice{Amount: *request.Amount}.AmountMinorUnits()}
+	}
+	return versioned
+}
+
+// RefundRequest returns the internal RefundRequest
+func (request RefundRequestV2) RefundRequest() (RefundRequest, error) {
+	refund := RefundRequest{Reason: request.Reason}
+	if request.Amount != nil {
+		amount := float32(request.Amount.MinorUnits) / 100
+		refund.Amount = &amount
+		refund.Currency = request.Amount.Currency
+	}
+	return refund, nil
+}
+
+// IsCreditNote tells credit notes apart from invoices
+func (inv Invoice) IsCreditNote() bool {
+	return inv.Kind == invoiceKindCreditNote
+}
+
+// NewCreditNote returns the credit note of refunding amount cents of inv. Its amount, and its tax when inv
+// was taxed, are negative. It has no refund reference until the refund is made.
+func NewCreditNote(inv Invoice, amount int64, reason string) Invoice {
+	creditNote := Invoice{
+		Kind:              invoiceKindCreditNote,
+		Currency:          inv.Currency,
+		CustomerID:        inv.CustomerID,
+		VendorID:          inv.VendorID,
+		BikeID:            inv.BikeID,
+		ReservationID:     inv.ReservationID,
+		Amount:            -float32(amount) / 100,
+		CreditedInvoiceID: inv.ID,
+		Reason:            reason,
+	}
+	if inv.Tax != nil {
+		tax := inv.Tax.credit(amount)
+		creditNote.Tax = &tax
+	}
+	return creditNote
+}
+
+// credit returns the tax reversed by refunding amount cents of the gross amount, each line in proportion
+func (tax InvoiceTax) credit(amount int64) InvoiceTax {
+	credited := InvoiceTax{
+		Jurisdiction: tax.Jurisdiction,
+		Inclusive:    tax.Inclusive,
+		Rounding:     tax.Rounding,
+		Lines:        make([]TaxLine, len(tax.Lines)),
+		Gross:        -amount,
+	}
+	for i, line := range tax.Lines {
+		credited.Lines[i] = line
+		if tax.Gross != 0 {
+			credited.Lines[i].Amount = -roundCents(big.NewRat(line.Amount*amount, tax.Gross), tax.Rounding)
+		}
+		credited.Total += credited.Lines[i].Amount
+	}
+	credited.Net = credited.Gross - credited.Total
+	return credited
+}
+
+// RefundInvoiceHandler refunds all or part of a charged invoice through the payment processor, recording the
+// refund as a credit note linked to the invoice. An invoice's refunds never add up to more than its amount.
+// The credit note is added before the money moves, so refunding a credit note whose refund failed retries it.
+func (app *App) RefundInvoiceHandler(req *http.Request, context *RequestContext) *handlerResult {
+	invoiceID := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(invoiceID) {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("(%s) is not a valid invoiceID", invoiceID)}
+	}
+	inv, ok, err := app.Store.GetInvoiceById(context, invoiceID)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if !ok {
+		return &handlerResult{ResponseCode: http.StatusNotFound, Message: fmt.Sprintf("Could not find invoice with ID: (%s)", invoiceID)}
+	}
+	if inv.IsCreditNote() {
+		if inv.RefundReference == "" {
+			app.Logger.LogWithContext(context, "Retrying the refund of credit note (%s)", invoiceID)
+			return app.refundCreditNote(context, inv)
+		}
+		return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Invoice (%s) is a credit note, refund the invoice it credits", invoiceID)}
+	}
+	if inv.PaymentReference == "" {
+		return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Invoice (%s) hasn't been charged, there's nothing to refund", invoiceID)}
+	}
+	var request RefundRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	if request.Currency != "" && request.Currency != inv.CurrencyCode() {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("currency (%s) must be the invoice's, %s", request.Currency, inv.CurrencyCode())}
+	}
+
+	total := inv.AmountMinorUnits()
+	refundable := total - inv.Refunded
+	if refundable <= 0 {
+		return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Invoice (%s) is already fully refunded", invoiceID)}
+	}
+	amount := refundable
+	if request.Amount != nil {
+		amount = Invoice{Amount: *request.Amount}.AmountMinorUnits()
+		if amount <= 0 {
+			return &handlerResult{ResponseCode: http.StatusBadRequest, Message: "amount must be positive"}
+		}
+	}
+	if amount > refundable {
+		return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Invoice (%s) has %s left to refund, less than %s", invoiceID, formatMinorUnits(refundable), formatMinorUnits(amount))}
+	}
+
+	// Reserve the amount first, so that concurrent refunds can't together exceed the invoice
+	ok, err = app.Store.ReserveInvoiceRefund(context, invoiceID, amount, total)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if !ok {
+		return &handlerResult{ResponseCode: http.StatusConflict, Message: fmt.Sprintf("Invoice (%s) was refunded concurrently, try again", invoiceID)}
+	}
+
+	creditNote, err := app.addNumberedInvoice(context, NewCreditNote(inv, amount, request.Reason))
+	if err != nil {
+		if releaseErr := app.Store.ReleaseInvoiceRefund(context, invoiceID, amount); releaseErr != nil {
+			app.Logger.LogErrFormatWithContext(context, "Couldn't release the refund of %s reserved on invoice (%s): %v", formatMinorUnits(amount), invoiceID, releaseErr)
+		}
+		return &handlerResult{Error: err}
+	}
+	app.postToLedger(context, invoiceJournalEntry(creditNote))
+	return app.refundCreditNote(context, creditNote)
+}
+
+// refundCreditNote returns the credit note's amount to the customer through the payment processor, keyed by
+// the credit note so that it's refunded once however often it's retried, and records the refund on it. A
+// credit note whose refund failed keeps its amount reserved on the invoice until it's retried.
+func (app *App) refundCreditNote(context *RequestContext, creditNote Invoice) *handlerResult {
+	inv, ok, err := app.Store.GetInvoiceById(context, creditNote.CreditedInvoiceID)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if !ok {
+		return &handlerResult{Error: fmt.Errorf("Couldn't find invoice (%s) credited by credit note (%s)", creditNote.CreditedInvoiceID, creditNote.ID)}
+	}
+
+	amount := -creditNote.AmountMinorUnits()
+	reference, err := app.Payments.Refund(context, inv, amount, creditNote.ID)
+	if err != nil {
+		app.Logger.LogErrFormatWithContext(context, "Payment processor failed to refund credit note (%s) of invoice (%s): %v", creditNote.ID, inv.ID, err)
+		return &handlerResult{ResponseCode: http.StatusBadGateway, Message: fmt.Sprintf("Couldn't refund credit note (%s) of invoice (%s), retry with POST /api/invoice/%s/refund", creditNote.ID, inv.ID, creditNote.ID)}
+	}
+	creditNote.RefundReference = reference
+	if err := app.Store.SetInvoiceRefundReference(context, creditNote.ID, reference); err != nil {
+		app.Logger.LogErrFormatWithContext(context, "Refunded credit note (%s) with payment reference (%s) but couldn't record it: %v", creditNote.ID, reference, err)
+		return &handlerResult{Error: err}
+	}
+	app.postToLedger(context, refundJournalEntry(creditNote))
+	app.Logger.LogWithContext(context, "Refunded %s of invoice (%s) with credit note (%s) numbered (%s)", formatMinorUnits(amount), inv.ID, creditNote.ID, creditNote.Number)
+
+	message, err := creditNote.Serialize()
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Message: message}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// statementPeriodLayout is the format of the period parameter, a calendar month in UTC
+	statementPeriodLayout = "2006-01"
+	csvContentType        = "text/csv; charset=utf-8"
+)
+
+// statementColumns is the documented layout of vendor statements. Only ever append to it.
+var statementColumns = []string{"type", "bikeId", "invoiceId", "reservationId", "customerId", "createdAt", "currency", "amount",
+	"invoiceCurrency", "invoiceAmount", "exchangeRate", "rateEffectiveDate", "rateSource"}
+
+// The values of the type column
+const (
+	statementRowInvoice  = "invoice"
+	statementRowSubtotal = "subtotal"
+	statementRowTotal    = "total"
+)
+
+// statementInvoice is an invoice of a statement, its amount converted into the statement's currency
+type statementInvoice struct {
+	Invoice
+	amount     int64
+	conversion *CurrencyConversion
+}
+
+// GetVendorStatementHandler renders the vendor's invoices created during period as CSV, grouped by bike
+// with a subtotal row after each bike's invoices and a total row last. Amounts are in the currency parameter,
+// by default the vendor's, invoices in others converted at the rate in effect the day they were created.
+func (app *App) GetVendorStatementHandler(rw http.ResponseWriter, req *http.Request, context *RequestContext) *handlerResult {
+	userID := mux.Vars(req)["userID"]
+	query := req.URL.Query()
+	if format := query.Get("format"); format != "" && format != "csv" {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("Unsupported format (%s), only csv is", format)}
+	}
+	periodStart, err := time.Parse(statementPeriodLayout, query.Get("period"))
+	if err != nil {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("period (%s) must be a month formatted YYYY-MM", query.Get("period"))}
+	}
+	periodEnd := periodStart.AddDate(0, 1, 0)
+	currency := query.Get("currency")
+	if currency != "" && !validCurrency(currency) {
+		return &handlerResult{ResponseCode: http.StatusBadRequest, Message: fmt.Sprintf("currency (%s) must be an ISO 4217 code with two decimals, e.g. USD", currency)}
+	}
+
+	vendor, ok, err := app.Store.GetVendorByUserId(context, userID)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if !ok {
+		return &handlerResult{ResponseCode: http.StatusNotFound, Message: fmt.Sprintf("Could not find vendor with UserID: (%s)", userID)}
+	}
+	if currency == "" {
+		currency = app.vendorCurrency(vendor)
+	}
+	invoices, err := app.Store.GetVendorInvoices(context, userID)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+
+	// Convert everything before writing, so that a missing rate can still fail the request
+	converter := app.newCurrencyConverter(context, currency)
+	var periodInvoices []statementInvoice
+	for _, inv := range invoices {
+		if createdAt := invoiceCreatedAt(inv); createdAt.Before(periodStart) || !createdAt.Before(periodEnd) {
+			continue
+		}
+		amount, conversion, err := converter.convert(inv)
+		if _, missingRate := err.(noExchangeRateError); missingRate {
+			return &handlerResult{ResponseCode: http.StatusConflict, Message: err.Error()}
+		}
+		if err != nil {
+			return &handlerResult{Error: err}
+		}
+		periodInvoices = append(periodInvoices, statementInvoice{inv, amount, conversion})
+	}
+	app.Logger.LogWithContext(context, "Rendering the %s statement of vendor (%s) in %s, %d invoices", periodStart.Format(statementPeriodLayout), userID, currency, len(periodInvoices))
+
+	rw.Header().Set("Content-Type", csvContentType)
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%s.csv\"", periodStart.Format(statementPeriodLayout)))
+	rw.WriteHeader(http.StatusOK)
+	if err := writeVendorStatement(rw, periodInvoices, currency); err != nil {
+		// The status is already written, all that's left is to log
+		app.Logger.LogErrFormatWithContext(context, "Couldn't write the statement of vendor (%s): %v", userID, err)
+	}
+	return &handlerResult{ResponseCode: http.StatusOK, Streamed: true}
+}
+
+// writeVendorStatement writes the statement of invoices in currency, ordered by bike and then by creation time
+func writeVendorStatement(rw http.ResponseWriter, invoices []statementInvoice, currency string) error {
+	sort.SliceStable(invoices, func(i, j int) bool {
+		if invoices[i].BikeID != invoices[j].BikeID {
+			return invoices[i].BikeID < invoices[j].BikeID
+		}
+		return invoices[i].ID < invoices[j].ID
+	})
+
+	writer := csv.NewWriter(rw)
+	writer.Write(statementColumns)
+	var subtotal, total int64
+	for i, inv := range invoices {
+		converted := []string{"", "", "", "", ""}
+		if inv.conversion != nil {
+			rate := inv.conversion.Rate
+			converted = []string{inv.CurrencyCode(), formatMinorUnits(inv.conversion.Amount), rate.Rate, rate.EffectiveDate, rate.Source}
+		}
+		writer.Write(append([]string{
+			statementRowInvoice,
+			csvText(inv.BikeID),
+			csvText(inv.ID),
+			csvText(inv.ReservationID),
+			csvText(inv.CustomerID),
+			invoiceCreatedAt(inv.Invoice).Format(time.RFC3339),
+			currency,
+			formatMinorUnits(inv.amount),
+		}, converted...))
+		subtotal += inv.amount
+		total += inv.amount
+
+		if i == len(invoices)-1 || invoices[i+1].BikeID != inv.BikeID {
+			writer.Write([]string{statementRowSubtotal, csvText(inv.BikeID), "", "", "", "", currency, formatMinorUnits(subtotal), "", "", "", "", ""})
+			subtotal = 0
+		}
+	}
+	writer.Write([]string{statementRowTotal, "", "", "", "", "", currency, formatMinorUnits(total), "", "", "", "", ""})
+	writer.Flush()
+	return writer.Error()
+}
+
+// invoiceCreatedAt is when the invoice was created, as recorded in its ObjectId
+func invoiceCreatedAt(inv Invoice) time.Time {
+	if !bson.IsObjectIdHex(inv.ID) {
+		return time.Time{}
+	}
+	return bson.ObjectIdHex(inv.ID).Time().UTC()
+}
+
+// csvText keeps spreadsheets from evaluating a value as a formula, by prefixing the characters that
+// start one with a quote. encoding/csv takes care of quoting separators, quotes and newlines.
+func csvText(value string) string {
+	if value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return "'" + value
+	}
+	return value
+}
+
+// formatMinorUnits formats an amount counted in cents as a decimal, e.g. -1234 as -12.34
+func formatMinorUnits(minorUnits int64) string {
+	sign := ""
+	if minorUnits < 0 {
+		sign = "-"
+		minorUnits = -minorUnits
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, minorUnits/100, minorUnits%100)
+}
@@ -0,0 +1,241 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The rounding modes of tax rules, applied to each tax line
+const (
+	// taxRoundHalfUp rounds to the nearest cent, halves away from zero. It's the default.
+	taxRoundHalfUp = "half_up"
+	// taxRoundHalfEven rounds to the nearest cent, halves to the even cent
+	taxRoundHalfEven = "half_even"
+	// taxRoundUp rounds away from zero
+	taxRoundUp = "up"
+	// taxRoundDown rounds toward zero
+	taxRoundDown = "down"
+)
+
+// jurisdictionPattern matches ISO 3166-1 alpha-2 country codes, optionally followed by an ISO 3166-2
+// subdivision, e.g. DE or US-WA
+var jurisdictionPattern = regexp.MustCompile(`^[A-Z]{2}(-[A-Z0-9]{1,3})?$`)
+
+// TaxRules holds the rules of each jurisdiction, as read from tax_rules_file
+type TaxRules map[string]JurisdictionTaxRules
+
+// JurisdictionTaxRules is how invoices in a jurisdiction are taxed
+type JurisdictionTaxRules struct {
+	// Inclusive amounts already include the tax, exclusive ones have it added
+	Inclusive bool `yaml:"inclusive"`
+	// Rounding is one of the taxRound modes
+	Rounding string    `yaml:"rounding"`
+	Rates    []TaxRate `yaml:"rates"`
+}
+
+// TaxRate is a tax levied as a fraction of the net amount
+type TaxRate struct {
+	Name string `yaml:"name"`
+	// Rate is a decimal fraction, e.g. 0.19. It's kept as text so that it's calculated with exactly.
+	Rate string `yaml:"rate"`
+}
+
+// InvoiceTax records the tax lines of an invoice. Amounts are in the minor unit of the invoice's currency.
+type InvoiceTax struct {
+	Jurisdiction string    `bson:"jurisdiction" json:"jurisdiction" openapi:"required"`
+	Inclusive    bool      `bson:"inclusive" json:"inclusive" openapi:"required"`
+	Rounding     string    `bson:"rounding" json:"rounding" openapi:"required"`
+	Lines        []TaxLine `bson:"lines" json:"lines" openapi:"required"`
+	// Net is the amount before tax, Total the sum of the lines and Gross the amount charged
+	Net   int64 `bson:"net" json:"net" openapi:"required"`
+	Total int64 `bson:"total" json:"total" openapi:"required"`
+	Gross int64 `bson:"gross" json:"gross" openapi:"required"`
+}
+
+// TaxLine is the amount of one tax levied on an invoice
+type TaxLine struct {
+	Name   string `bson:"name" json:"name" openapi:"required"`
+	Rate   string `bson:"rate" json:"rate" openapi:"required"`
+	Amount int64  `bson:"amount" json:"amount" openapi:"required"`
+}
+
+// LoadTaxRules reads and validates a YAML or JSON document of jurisdictions to their tax rules
+func LoadTaxRules(path string) (TaxRules, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading tax rules: %v", err)
+	}
+	var rules TaxRules
+	if err := yaml.Unmarshal(contents, &rules); err != nil {
+		return nil, fmt.Errorf("Parsing tax rules '%s': %v", path, err)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("Tax rules '%s': %v", path, err)
+	}
+	return rules, nil
+}
+
+// Validate returns a non-nil error naming the first invalid rule, checking jurisdictions in order
+func (rules TaxRules) Validate() error {
+	jurisdictions := make([]string, 0, len(rules))
+	for jurisdiction := range rules {
+		jurisdictions = append(jurisdictions, jurisdiction)
+	}
+	sort.Strings(jurisdictions)
+
+	for _, jurisdiction := range jurisdictions {
+		if !jurisdictionPattern.MatchString(jurisdiction) {
+			return fmt.Errorf("'%s' isn't an ISO 3166 jurisdiction, e.g. DE or US-WA", jurisdiction)
+		}
+		jurisdictionRules := rules[jurisdiction]
+		switch jurisdictionRules.Rounding {
+		case "", taxRoundHalfUp, taxRoundHalfEven, taxRoundUp, taxRoundDown:
+		default:
+			return fmt.Errorf("%s: rounding must be %s, %s, %s or %s", jurisdiction, taxRoundHalfUp, taxRoundHalfEven, taxRoundUp, taxRoundDown)
+		}
+		for _, rate := range jurisdictionRules.Rates {
+			if rate.Name == "" {
+				return fmt.Errorf("%s: every rate needs a name", jurisdiction)
+			}
+			if parsed, ok := new(big.Rat).SetString(rate.Rate); !ok || parsed.Sign() < 0 || parsed.Cmp(big.NewRat(1, 1)) >= 0 {
+				return fmt.Errorf("%s: %s: rate (%s) must be a fraction between 0 and 1, e.g. 0.19", jurisdiction, rate.Name, rate.Rate)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckJurisdiction returns a non-nil error if invoices in jurisdiction couldn't be taxed, so that vendors
+// and customers aren't saved with a jurisdiction tax_rules_file doesn't cover
+func (rules TaxRules) CheckJurisdiction(jurisdiction string) error {
+	if jurisdiction == "" {
+		return nil
+	}
+	if _, ok := rules[jurisdiction]; ok {
+		return nil
+	}
+	errorBytes, err := json.Marshal([]string{fmt.Sprintf("Jurisdiction (%s) has no tax rules, add them to tax_rules_file first", jurisdiction)})
+	if err != nil {
+		return AddMyInfoToErr(err)
+	}
+	return errors.New(string(errorBytes))
+}
+
+// Tax calculates the tax lines of amount, in cents, in the jurisdiction
+func (rules JurisdictionTaxRules) Tax(jurisdiction string, amount int64) InvoiceTax {
+	tax := InvoiceTax{
+		Jurisdiction: jurisdiction,
+		Inclusive:    rules.Inclusive,
+		Rounding:     rules.Rounding,
+		Lines:        []TaxLine{},
+	}
+	if tax.Rounding == "" {
+		tax.Rounding = taxRoundHalfUp
+	}
+
+	// Every line is a fraction of the exact net amount, which inclusive amounts are divided back to
+	rates := make([]*big.Rat, len(rules.Rates))
+	grossPerNet := big.NewRat(1, 1)
+	for i, rate := range rules.Rates {
+		// Validate checked that the rates parse
+		rates[i], _ = new(big.Rat).SetString(rate.Rate)
+		grossPerNet.Add(grossPerNet, rates[i])
+	}
+	net := new(big.Rat).SetInt64(amount)
+	if rules.Inclusive {
+		net.Quo(net, grossPerNet)
+	}
+	for i, rate := range rules.Rates {
+		line := TaxLine{Name: rate.Name, Rate: rate.Rate, Amount: roundCents(new(big.Rat).Mul(net, rates[i]), tax.Rounding)}
+		tax.Lines = append(tax.Lines, line)
+		tax.Total += line.Amount
+	}
+
+	if rules.Inclusive {
+		tax.Gross = amount
+		tax.Net = amount - tax.Total
+	} else {
+		tax.Net = amount
+		tax.Gross = amount + tax.Total
+	}
+	return tax
+}
+
+// roundCents rounds an exact amount of cents to a whole cent
+func roundCents(value *big.Rat, rounding string) int64 {
+	quotient, remainder := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	if remainder.Sign() == 0 {
+		return quotient.Int64()
+	}
+	awayFromZero := big.NewInt(int64(value.Sign()))
+
+	switch rounding {
+	case taxRoundUp:
+		quotient.Add(quotient, awayFromZero)
+	case taxRoundDown:
+	default:
+		// Compare the remainder to half a cent
+		twiceRemainder := new(big.Int).Lsh(remainder.Abs(remainder), 1)
+		half := twiceRemainder.Cmp(value.Denom())
+		if half > 0 || half == 0 && (rounding != taxRoundHalfEven || quotient.Bit(0) == 1) {
+			quotient.Add(quotient, awayFromZero)
+		}
+	}
+	return quotient.Int64()
+}
+
+// invoiceJurisdiction is where inv is taxed: its vendor's jurisdiction, or else its customer's. It's
+// empty when neither has one, or neither is known.
+func (app *App) invoiceJurisdiction(context *RequestContext, inv Invoice) (string, error) {
+	vendor, _, err := app.Store.GetVendorByUserId(context, inv.VendorID)
+	if err != nil {
+		return "", err
+	}
+	if vendor.Jurisdiction != "" {
+		return vendor.Jurisdiction, nil
+	}
+	customer, _, err := app.Store.GetCustomerByUserId(context, inv.CustomerID)
+	if err != nil {
+		return "", err
+	}
+	return customer.Jurisdiction, nil
+}
+
+// taxInvoice calculates the tax of inv's priced and discounted amount in its jurisdiction and records it on
+// inv, adding it to the amount when the jurisdiction's prices are tax exclusive. Invoices without a
+// jurisdiction aren't taxed. It returns the result to respond with when inv can't be taxed.
+func (app *App) taxInvoice(context *RequestContext, inv *Invoice, rules TaxRules) *handlerResult {
+	jurisdiction, err := app.invoiceJurisdiction(context, *inv)
+	if err != nil {
+		return &handlerResult{Error: err}
+	}
+	if jurisdiction == "" {
+		return nil
+	}
+	jurisdictionRules, ok := rules[jurisdiction]
+	if !ok {
+		// The rules were removed from tax_rules_file after the vendor or customer was saved
+		app.Logger.LogErrFormatWithContext(context, "No tax rules for jurisdiction (%s), add them to tax_rules_file", jurisdiction)
+		return &handlerResult{ResponseCode: http.StatusServiceUnavailable, Message: fmt.Sprintf("Invoices in jurisdiction (%s) can't be taxed until its tax rules are configured", jurisdiction)}
+	}
+
+	amount := inv.Pricing.Total
+	if inv.Discount != nil {
+		amount -= inv.Discount.Amount
+	}
+	tax := jurisdictionRules.Tax(jurisdiction, amount)
+	inv.Amount = float32(tax.Gross) / 100
+	inv.Tax = &tax
+	return nil
+}
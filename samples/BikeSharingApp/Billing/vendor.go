@@ -10,9 +10,15 @@ import (
 
 type Vendor struct {
 	ID            string `bson:"id" json:"id"`
-	UserID        string `bson:"userId" json:"userId"`
-	RoutingNumber string `bson:"routingNumber" json:"routingNumber"`
-	AccountNumber string `bson:"accountNumber" json:"accountNumber"`
+	UserID        string `bson:"userId" json:"userId" openapi:"required"`
+	RoutingNumber string `bson:"routingNumber" json:"routingNumber" openapi:"required"`
+	AccountNumber string `bson:"accountNumber" json:"accountNumber" openapi:"required"`
+	// Jurisdiction is where the vendor's rides are taxed, e.g. DE or US-WA
+	Jurisdiction string `bson:"jurisdiction,omitempty" json:"jurisdiction,omitempty"`
+	// Currency is the ISO 4217 currency the vendor is paid and reported in, base_currency when unset
+	Currency string `bson:"currency,omitempty" json:"currency,omitempty"`
+	// InvoicePrefix starts the numbers of the vendor's invoices, e.g. VEN, invoice_number_prefix when unset
+	InvoicePrefix string `bson:"invoicePrefix,omitempty" json:"invoicePrefix,omitempty"`
 }
 
 // Serialize serializes a vendor to JSON
@@ -42,6 +48,15 @@ func ValidateVendor(ven Vendor) error {
 	if ven.RoutingNumber == zeroString {
 		errorSlice = append(errorSlice, "Must specify RoutingNumber string")
 	}
+	if ven.Jurisdiction != zeroString && !jurisdictionPattern.MatchString(ven.Jurisdiction) {
+		errorSlice = append(errorSlice, "Jurisdiction must be an ISO 3166 code, e.g. DE or US-WA")
+	}
+	if ven.Currency != zeroString && !validCurrency(ven.Currency) {
+		errorSlice = append(errorSlice, "Currency must be an ISO 4217 code with two decimals, e.g. USD")
+	}
+	if ven.InvoicePrefix != zeroString && !invoicePrefixPattern.MatchString(ven.InvoicePrefix) {
+		errorSlice = append(errorSlice, "InvoicePrefix must be 2 to 10 uppercase letters or digits, e.g. VEN")
+	}
 
 	if len(errorSlice) > 0 {
 		errorBytes, err := json.Marshal(errorSlice)
@@ -0,0 +1,252 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Clock tells the time. It is injected so that time dependent behavior can be controlled.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the Clock backed by the system time
+var SystemClock Clock = systemClock{}
+
+// App is the Reservation service. Building one has no side effects; nothing happens until Run is called.
+type App struct {
+	Store  Store
+	Logger *Logger
+	Clock  Clock
+
+	configMutex sync.RWMutex
+	config      Config
+
+	health   *HealthMonitor
+	breaker  *CircuitBreaker
+	inFlight *InFlightTracker
+}
+
+// NewApp creates a Reservation service serving the given store
+func NewApp(config Config, store Store, logger *Logger, clock Clock) *App {
+	return &App{
+		config:   config,
+		Store:    store,
+		Logger:   logger,
+		Clock:    clock,
+		health:   NewHealthMonitor(clock),
+		breaker:  NewCircuitBreaker(mongoDbDependencyName, config.MongoDbBreakerThreshold, logger),
+		inFlight: &InFlightTracker{},
+	}
+}
+
+// Config returns the configuration currently in effect
+func (app *App) Config() Config {
+	app.configMutex.RLock()
+	defer app.configMutex.RUnlock()
+	return app.config
+}
+
+// Reload applies the reloadable settings of config to the running service. Other settings are
+// only read at startup and are left untouched.
+func (app *App) Reload(config Config) {
+	app.configMutex.Lock()
+	app.config = app.config.withReloadedSettings(config)
+	reloaded := app.config
+	app.configMutex.Unlock()
+
+	app.breaker.SetThreshold(reloaded.MongoDbBreakerThreshold)
+	app.Logger.LogInfo("Reloaded configuration: %s", reloaded.Redacted())
+}
+
+// apiPrefix is where the routes behind the circuit breaker and request timeout live
+const apiPrefix = "/api"
+
+// routes lists every Reservation endpoint. The OpenAPI specification is generated from it.
+func (app *App) routes() []apiRoute {
+	reservationResponses := map[int]interface{}{http.StatusOK: ReservationDetails{}, http.StatusNotFound: ErrorResult{}}
+	listResponses := map[int]interface{}{http.StatusOK: []ReservationDetails{}, http.StatusBadRequest: ErrorResult{}}
+	startTimeRange := []OpenAPIParameter{
+		queryParameter("from", "Only reservations starting at or after this RFC 3339 time"),
+		queryParameter("to", "Only reservations starting before this RFC 3339 time"),
+	}
+	updateResponses := map[int]interface{}{
+		http.StatusOK:         ReservationDetails{},
+		http.StatusBadRequest: ErrorResult{},
+		http.StatusNotFound:   ErrorResult{},
+		http.StatusConflict:   ErrorResult{},
+	}
+
+	return []apiRoute{
+		{Method: http.MethodGet, Path: "/hello", Summary: "Says hello",
+			Handler: http.HandlerFunc(HelloHandler), Responses: map[int]interface{}{http.StatusOK: nil}},
+		{Method: http.MethodGet, Path: "/healthz", Summary: "Reports that the process is alive",
+			Handler: http.HandlerFunc(app.LivenessHandler), Responses: map[int]interface{}{http.StatusOK: map[string]string{}}},
+		{Method: http.MethodGet, Path: "/readyz", Summary: "Reports the status of each dependency",
+			Handler:   http.HandlerFunc(app.ReadinessHandler),
+			Responses: map[int]interface{}{http.StatusOK: readinessResponse{}, http.StatusServiceUnavailable: readinessResponse{}}},
+		{Method: http.MethodGet, Path: "/api/allReservations", Summary: "Lists every reservation, optionally starting between from and to",
+			Handler: http.HandlerFunc(app.getAllReservationsHandler), Query: startTimeRange, Responses: listResponses},
+		{Method: http.MethodPost, Path: "/api/reservation", Summary: "Creates a reservation, or returns the one its requestId already created",
+			Handler: http.HandlerFunc(app.addReservationHandler), Request: ReservationDetails{},
+			Responses: map[int]interface{}{
+				http.StatusCreated:    ReservationDetails{},
+				http.StatusOK:         ReservationDetails{},
+				http.StatusBadRequest: ErrorResult{},
+				http.StatusConflict:   ErrorResult{},
+			}},
+		{Method: http.MethodGet, Path: "/api/reservation/{reservationId}", Summary: "Gets a reservation",
+			Handler: http.HandlerFunc(app.getReservationHandler), Responses: reservationResponses},
+		{Method: http.MethodPatch, Path: "/api/reservation/{reservationId}", Summary: "Changes a reservation's state or end time",
+			Handler: http.HandlerFunc(app.updateReservationHandler), Request: ReservationUpdate{}, Responses: updateResponses},
+		{Method: http.MethodPost, Path: "/api/reservation/{reservationId}/cancel", Summary: "Cancels a reservation",
+			Handler: http.HandlerFunc(app.cancelReservationHandler), Responses: updateResponses},
+		{Method: http.MethodGet, Path: "/api/user/{userId}/reservations", Summary: "Lists a user's reservations, optionally starting between from and to",
+			Handler: http.HandlerFunc(app.listReservationsHandler), Query: startTimeRange, Responses: listResponses},
+		{Method: http.MethodGet, Path: "/api/export/reservations", Summary: "Streams reservations as newline delimited JSON, ordered by reservationId",
+			Handler: http.HandlerFunc(app.exportReservationsHandler),
+			Query: append(startTimeRange,
+				queryParameter("userId", "Only the user's reservations"),
+				queryParameter("cursor", "Resume after the reservation with this reservationId, the last line received"),
+				queryParameter("limit", "Most reservations to return")),
+			Timeout:   func(config Config) time.Duration { return config.ExportTimeout },
+			Responses: map[int]interface{}{http.StatusOK: ndjsonStream{Record: ReservationDetails{}}, http.StatusBadRequest: ErrorResult{}}},
+	}
+}
+
+// versionRoutes serves each /api route under every API version, as well as unversioned as the first
+func versionRoutes(routes []apiRoute) []apiRoute {
+	var versioned []apiRoute
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, apiPrefix+"/") {
+			versioned = append(versioned, route)
+			continue
+		}
+		versioned = append(versioned, apiVersions[0].route(route, apiPrefix))
+		for _, version := range apiVersions {
+			versioned = append(versioned, version.route(route, apiPrefix+"/"+version.Name))
+		}
+	}
+	return versioned
+}
+
+// Handler returns the HTTP handler serving every Reservation endpoint
+func (app *App) Handler() http.Handler {
+	routes := app.routes()
+	for i := range routes {
+		if strings.HasPrefix(routes[i].Path, apiPrefix+"/") {
+			// The circuit breaker fails these fast while the database is unreachable, and failed
+			// database work is a 500, or a 504 once the request times out
+			responses := map[int]interface{}{
+				http.StatusInternalServerError: ErrorResult{},
+				http.StatusServiceUnavailable:  ErrorResult{},
+				http.StatusGatewayTimeout:      ErrorResult{},
+			}
+			for status, body := range routes[i].Responses {
+				responses[status] = body
+			}
+			routes[i].Responses = responses
+		}
+	}
+	routes = versionRoutes(routes)
+	spec := NewOpenAPISpec("Reservation", "1.0.0", routes)
+
+	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	r.Handle("/openapi.json", OpenAPIHandler(spec)).Methods(http.MethodGet)
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.Use(app.breaker.Middleware)
+	for _, route := range routes {
+		handler := app.requestValidationMiddleware(spec, route, route.Handler)
+		if strings.HasPrefix(route.Path, apiPrefix+"/") {
+			handler = app.requestTimeoutMiddleware(route, handler)
+			api.Handle(strings.TrimPrefix(route.Path, apiPrefix), handler).Methods(route.Method)
+		} else {
+			r.Handle(route.Path, handler).Methods(route.Method)
+		}
+	}
+
+	return app.inFlight.Middleware(r)
+}
+
+// requestTimeoutMiddleware bounds the request's context, and so its database work, by the route's timeout
+func (app *App) requestTimeoutMiddleware(route apiRoute, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		config := app.Config()
+		timeout := config.RequestTimeout
+		if route.Timeout != nil {
+			timeout = route.Timeout(config)
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// Run serves HTTP until ctx is cancelled or the webserver fails, then drains in-flight requests.
+// The store stays open; call Close once Run returns.
+func (app *App) Run(ctx context.Context) error {
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	defer stopMonitor()
+	go app.monitorStoreHealth(monitorCtx)
+
+	config := app.Config()
+	srv := &http.Server{
+		Handler: app.Handler(),
+		Addr:    fmt.Sprintf(":%d", config.Port),
+	}
+	serverErrChan := make(chan error, 1)
+	go func() {
+		app.Logger.LogInfo("Listening on port: %d", config.Port)
+		serverErrChan <- srv.ListenAndServe()
+	}()
+
+	var serverErr error
+	select {
+	case <-ctx.Done():
+	case serverErr = <-serverErrChan:
+		app.Logger.LogError("Webserver shutdown unexpectedly!: %v", serverErr)
+	}
+
+	app.shutdown(srv)
+	return serverErr
+}
+
+// shutdown reports not-ready and drains in-flight requests
+func (app *App) shutdown(srv *http.Server) {
+	config := app.Config()
+	app.Logger.LogInfo("Shutting down!")
+	app.health.SetShuttingDown()
+	if config.ShutdownDelay > 0 {
+		app.Logger.LogInfo("Waiting %v for readiness to propagate", config.ShutdownDelay)
+		time.Sleep(config.ShutdownDelay)
+	}
+
+	app.Logger.LogInfo("Draining %d in-flight requests", app.inFlight.Count())
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		app.Logger.LogError("Webserver didn't drain within %v, %d requests still in flight: %v", config.ShutdownTimeout, app.inFlight.Count(), err)
+	}
+}
+
+// Close releases the store. Call it once Run has returned.
+func (app *App) Close() {
+	app.Store.Close()
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffPolicy describes an exponential backoff with jitter
+type BackoffPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter is the fraction (0-1) of each interval that is randomized
+	Jitter float64
+	// MaxAttempts is the number of attempts before giving up, 0 means retry forever
+	MaxAttempts int
+}
+
+var (
+	jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMutex sync.Mutex
+)
+
+// Interval returns how long to wait after the given (1 based) failed attempt
+func (policy BackoffPolicy) Interval(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	interval := float64(policy.InitialInterval) * math.Pow(policy.Multiplier, float64(attempt-1))
+	if interval > float64(policy.MaxInterval) {
+		interval = float64(policy.MaxInterval)
+	}
+
+	if policy.Jitter > 0 {
+		jitterMutex.Lock()
+		random := jitterRand.Float64()
+		jitterMutex.Unlock()
+		// Spread the interval evenly over [interval*(1-jitter), interval*(1+jitter)]
+		interval = interval * (1 - policy.Jitter + 2*policy.Jitter*random)
+	}
+	return time.Duration(interval)
+}
+
+// Exhausted returns true if no more attempts should be made after the given (1 based) attempt
+func (policy BackoffPolicy) Exhausted(attempt int) bool {
+	return policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts
+}
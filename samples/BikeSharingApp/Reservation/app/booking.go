@@ -0,0 +1,73 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// bikeLockTTL bounds how long a crashed replica can keep a bike locked
+	bikeLockTTL = 10 * time.Second
+	// bikeLockRetryInterval is how often a replica retries taking a bike lock held by another
+	bikeLockRetryInterval = 50 * time.Millisecond
+)
+
+// lockBike takes the bike's lock for owner, waiting while another request holds it. The lock is held
+// across replicas until the returned function is called, or bikeLockTTL passes.
+func (app *App) lockBike(ctx context.Context, bikeID, owner string) (func(), error) {
+	lockName := "bike:" + bikeID
+	for {
+		acquired, err := app.Store.AcquireLock(ctx, lockName, owner, app.Clock.Now().UTC(), bikeLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(bikeLockRetryInterval):
+		}
+	}
+
+	return func() {
+		// Release even if the request was cancelled, rather than holding the bike until the TTL
+		if err := app.Store.ReleaseLock(context.Background(), lockName, owner); err != nil {
+			app.Logger.LogError("Couldn't release %s held by %s, it expires in %v: %v", lockName, owner, bikeLockTTL, err)
+		}
+	}, nil
+}
+
+// findOverlappingReservation returns another active reservation of the same bike whose time window
+// overlaps reservationDetails', if there is one. A reservation without an end time lasts until it's ended.
+func (app *App) findOverlappingReservation(ctx context.Context, reservationDetails ReservationDetails) (*ReservationDetails, error) {
+	query := bson.M{
+		"reservationId": bson.M{"$ne": reservationDetails.ReservationID},
+		"bikeId":        reservationDetails.BikeID,
+		"state":         bson.M{"$nin": []ReservationState{reservationStateFailed, reservationStateCancelled}},
+		// A null endTime also matches documents without one
+		"$or": []bson.M{
+			{"endTime": nil},
+			{"endTime": bson.M{"$gt": reservationDetails.StartTime.Time}},
+		},
+	}
+	if !reservationDetails.EndTime.IsZero() {
+		query["startTime"] = bson.M{"$lt": reservationDetails.EndTime.Time}
+	}
+
+	var overlapping []ReservationDetails
+	if err := app.Store.QueryAll(ctx, query, &overlapping); err != nil {
+		return nil, err
+	}
+	if len(overlapping) == 0 {
+		return nil, nil
+	}
+	return &overlapping[0], nil
+}
@@ -3,8 +3,39 @@
 
 package main
 
+import "time"
+
 const (
 	reservationMongoDBConnectionString string = `mongodb://databases-mongo`
 	reservationMongoDBDatabase         string = `resdb`
 	reservationMongoDBCollection       string = `reservation`
+
+	// lockCollectionSuffix names the collection holding the reservation collection's locks
+	lockCollectionSuffix = `Locks`
+	// duplicateCollectionSuffix names the collection keeping the reservations archived as duplicates
+	duplicateCollectionSuffix = `Duplicates`
+)
+
+// Defaults for connecting to MongoDB, overridable through the configuration
+const (
+	mongoDialTimeout             = 10 * time.Second
+	defaultMongoPoolLimit        = 4096
+	defaultMongoMaxAttempts      = 10
+	defaultMongoBackoffInitial   = 500 * time.Millisecond
+	defaultMongoBackoffMax       = 30 * time.Second
+	defaultMongoBreakerThreshold = 2
+)
+
+// defaultRequestTimeout is the deadline given to each API request, overridable through the configuration
+const defaultRequestTimeout = 10 * time.Second
+
+// defaultExportTimeout is the deadline given to each export, overridable through the configuration
+const defaultExportTimeout = 5 * time.Minute
+
+// Defaults for shutting down, overridable through the configuration
+const (
+	// defaultShutdownDelay gives load balancers time to notice /readyz failing before the listener closes
+	defaultShutdownDelay = 5 * time.Second
+	// defaultShutdownTimeout bounds how long in-flight requests are given to finish
+	defaultShutdownTimeout = 20 * time.Second
 )
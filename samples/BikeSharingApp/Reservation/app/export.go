@@ -0,0 +1,132 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// ndjsonContentType is newline delimited JSON, one record per line
+	ndjsonContentType = "application/x-ndjson"
+	// exportFlushRecords is how many records are written between flushes, so clients see progress
+	exportFlushRecords = 100
+)
+
+// exportReservationsHandler streams the reservations starting between from and to, optionally only the
+// user's, as newline delimited JSON ordered by reservationId. Passing the reservationId of the last line
+// received as cursor resumes an export; limit caps the lines of one response.
+//
+// The stream ends cleanly only once the export is complete. If it fails part way, the connection is
+// aborted so that clients can't mistake a truncated export for a complete one.
+func (app *App) exportReservationsHandler(w http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	var errorSlice []string
+	if err := addStartTimeRange(req, query); err != nil {
+		errorSlice = append(errorSlice, err.(ValidationError)...)
+	}
+	limit, err := exportLimit(req)
+	if err != nil {
+		errorSlice = append(errorSlice, err.Error())
+	}
+	if len(errorSlice) > 0 {
+		writeBadRequest(w, ValidationError(errorSlice))
+		return
+	}
+	if userID := req.URL.Query().Get("userId"); userID != "" {
+		query["userId"] = userID
+	}
+	if cursor := req.URL.Query().Get("cursor"); cursor != "" {
+		query["reservationId"] = bson.M{"$gt": cursor}
+	}
+
+	app.Logger.LogInfo("Exporting reservations matching %v", query)
+	version := requestAPIVersion(req)
+	stream := newNDJSONWriter(w)
+	var reservationDetails ReservationDetails
+	err = app.Store.QueryEach(req.Context(), query, "reservationId", limit, &reservationDetails, func() error {
+		err := stream.Write(version.toVersion(reservationDetails))
+		// Decode the next document into a clean value, rather than over this one
+		reservationDetails = ReservationDetails{}
+		return err
+	})
+	if err == nil {
+		stream.Close()
+		app.Logger.LogInfo("Exported %d reservations", stream.records)
+		return
+	}
+	if !stream.started {
+		app.writeStoreError(w, req, err, "Couldn't export reservations")
+		return
+	}
+
+	app.Logger.LogError("Aborting the export after %d reservations. Reason: %v", stream.records, err)
+	panic(http.ErrAbortHandler)
+}
+
+// exportLimit reads the limit parameter, 0 if there's none
+func exportLimit(req *http.Request) (int, error) {
+	value := req.URL.Query().Get("limit")
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("limit: '%s' isn't a positive integer", value)
+	}
+	return limit, nil
+}
+
+// ndjsonWriter writes records to a response as newline delimited JSON. The status is written with the
+// first record, so a failure before it can still be reported as an error response.
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	encoder *json.Encoder
+	records int
+	started bool
+}
+
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	return &ndjsonWriter{w: w, encoder: json.NewEncoder(w)}
+}
+
+// Write writes record on its own line
+func (writer *ndjsonWriter) Write(record interface{}) error {
+	if !writer.started {
+		writer.writeHeader()
+	}
+	if err := writer.encoder.Encode(record); err != nil {
+		return err
+	}
+	writer.records++
+	if writer.records%exportFlushRecords == 0 {
+		writer.flush()
+	}
+	return nil
+}
+
+// Close ends a complete stream, which may have no records
+func (writer *ndjsonWriter) Close() {
+	if !writer.started {
+		writer.writeHeader()
+	}
+	writer.flush()
+}
+
+func (writer *ndjsonWriter) writeHeader() {
+	writer.w.Header().Set("Content-Type", ndjsonContentType)
+	writer.w.WriteHeader(http.StatusOK)
+	writer.started = true
+}
+
+func (writer *ndjsonWriter) flush() {
+	if flusher, ok := writer.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
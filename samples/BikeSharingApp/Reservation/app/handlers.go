@@ -6,7 +6,11 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"encoding/json"
@@ -18,76 +22,297 @@ func HelloHandler(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "It's-a-me Mario.")
 }
 
-func addReservationHandler(w http.ResponseWriter, req *http.Request) {
+func (app *App) addReservationHandler(w http.ResponseWriter, req *http.Request) {
 	jsonDecoder := json.NewDecoder(req.Body)
 	reservationDetails := ReservationDetails{}
 	if err := jsonDecoder.Decode(&reservationDetails); err != nil {
-		http.Error(w, "BadRequest: Invalid request body.", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid request body: %v", err)
 		return
 	}
 
 	if err := reservationDetails.Validate(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBadRequest(w, err)
 		return
 	}
 
-	LogInfo("Inserting reservation document for reservationId: %s", reservationDetails.ReservationID)
-	InsertDocument(reservationDetails)
+	if app.writeReplayedReservation(w, req, reservationDetails) {
+		return
+	}
+
+	// Hold the bike while checking for overlaps, so concurrent requests on any replica can't double book it
+	unlockBike, err := app.lockBike(req.Context(), reservationDetails.BikeID, reservationDetails.ReservationID)
+	if err != nil {
+		app.writeStoreError(w, req, err, "Couldn't lock bike %s for reservation %s", reservationDetails.BikeID, reservationDetails.ReservationID)
+		return
+	}
+	defer unlockBike()
+
+	overlapping, err := app.findOverlappingReservation(req.Context(), reservationDetails)
+	if err != nil {
+		app.writeStoreError(w, req, err, "Couldn't check bike %s for overlapping reservations", reservationDetails.BikeID)
+		return
+	}
+	if overlapping != nil {
+		app.Logger.LogError("ReservationId: %s overlaps reservationId: %s of bikeId: %s", reservationDetails.ReservationID, overlapping.ReservationID, reservationDetails.BikeID)
+		writeError(w, http.StatusConflict, "Bike %s is already reserved by reservation %s", reservationDetails.BikeID, overlapping.ReservationID)
+		return
+	}
+
+	reservationDetails.Transitions = []StateTransition{{To: reservationDetails.State, At: NewReservationTime(app.Clock.Now()).Time}}
+	app.Logger.LogInfo("Inserting reservation document for reservationId: %s", reservationDetails.ReservationID)
+	if err := app.Store.InsertDocument(req.Context(), reservationDetails); mgo.IsDup(err) {
+		// Lost a race with a replay of the same request, or the reservationId is taken
+		if app.writeReplayedReservation(w, req, reservationDetails) {
+			return
+		}
+		app.Logger.LogError("ReservationId: %s already exists", reservationDetails.ReservationID)
+		writeError(w, http.StatusConflict, "Reservation %s already exists", reservationDetails.ReservationID)
+		return
+	} else if err != nil {
+		app.writeStoreError(w, req, err, "Couldn't insert reservation %s", reservationDetails.ReservationID)
+		return
+	}
+
+	w.Header().Set("Location", reservationLocation(req, reservationDetails.ReservationID))
+	writeJSON(w, http.StatusCreated, reservationDetails)
 }
 
-func getReservationHandler(w http.ResponseWriter, req *http.Request) {
+// writeReplayedReservation writes the reservation already created by the request with reservationDetails'
+// requestId, returning false if there's none. A different reservation with the same requestId is a conflict.
+func (app *App) writeReplayedReservation(w http.ResponseWriter, req *http.Request, reservationDetails ReservationDetails) bool {
+	var existing ReservationDetails
+	err := app.Store.QueryOne(req.Context(), bson.M{"requestId": reservationDetails.RequestId}, &existing)
+	if err == mgo.ErrNotFound {
+		return false
+	} else if err != nil {
+		app.writeStoreError(w, req, err, "Couldn't look up request %s", reservationDetails.RequestId)
+		return true
+	}
+
+	if existing.ReservationID != reservationDetails.ReservationID {
+		app.Logger.LogError("RequestId: %s already created reservationId: %s", reservationDetails.RequestId, existing.ReservationID)
+		writeError(w, http.StatusConflict, "Request %s already created reservation %s", reservationDetails.RequestId, existing.ReservationID)
+		return true
+	}
+
+	app.Logger.LogInfo("Replayed requestId: %s, returning reservationId: %s", reservationDetails.RequestId, existing.ReservationID)
+	w.Header().Set("Location", reservationLocation(req, existing.ReservationID))
+	writeJSON(w, http.StatusOK, existing)
+	return true
+}
+
+// reservationLocation is the URL of the reservation, in the API version req was made to
+func reservationLocation(req *http.Request, reservationID string) string {
+	return strings.TrimSuffix(req.URL.Path, "/") + "/" + url.PathEscape(reservationID)
+}
+
+func (app *App) getReservationHandler(w http.ResponseWriter, req *http.Request) {
 	varsMap := mux.Vars(req)
 	reservationID := varsMap["reservationId"]
-	var queryResult ReservationDetails
-	query := bson.M{"reservationId": reservationID}
-	LogInfo("Querying for reservationId: %s", reservationID)
-	if err := QueryOne(query, &queryResult); err != nil {
-		LogError("Couldn't get reservation for reservationId: %s. Reason: %v", reservationID, err)
-		http.Error(w, fmt.Sprintf("BadRequest: %v", err), http.StatusBadRequest)
+	app.Logger.LogInfo("Querying for reservationId: %s", reservationID)
+	reservationDetails, ok := app.findReservation(w, req, reservationID)
+	if !ok {
 		return
 	}
 
-	if queryResult == (ReservationDetails{}) {
-		LogError("No reservation found for reservationId: %s", reservationID)
-		http.Error(w, fmt.Sprintf("BadRequest: No reservation found for reservationId: %s", reservationID), http.StatusBadRequest)
+	app.Logger.LogInfo("Reservation found for reservationId: %s", reservationID)
+	writeJSON(w, http.StatusOK, reservationDetails)
+}
+
+func (app *App) getAllReservationsHandler(w http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if err := addStartTimeRange(req, query); err != nil {
+		writeBadRequest(w, err)
 		return
 	}
 
-	LogInfo("Reservation found for reservationId: %s", reservationID)
-	w.Header().Set("Content-Type", "application/json")
-	jsonResponse, _ := json.Marshal(queryResult)
-	fmt.Fprintf(w, string(jsonResponse))
-}
-
-func getAllReservationsHandler(w http.ResponseWriter, req *http.Request) {
-	var queryResult []ReservationDetails
-	LogInfo("Getting all reservations")
-	if err := QueryAll(bson.M{}, &queryResult); err != nil {
-		LogError("Couldn't get all reservations. Reason: %v", err)
-		http.Error(w, fmt.Sprintf("InternalServerError: %v", err), http.StatusInternalServerError)
+	app.Logger.LogInfo("Getting all reservations")
+	queryResult, err := app.findReservations(req, query)
+	if err != nil {
+		app.writeStoreError(w, req, err, "Couldn't get all reservations")
 		return
 	}
 
-	LogInfo("Returning %d reservations", len(queryResult))
-	w.Header().Set("Content-Type", "application/json")
-	jsonResponse, _ := json.Marshal(queryResult)
-	fmt.Fprintf(w, string(jsonResponse))
+	app.Logger.LogInfo("Returning %d reservations", len(queryResult))
+	writeJSON(w, http.StatusOK, queryResult)
 }
 
-func listReservationsHandler(w http.ResponseWriter, req *http.Request) {
+func (app *App) listReservationsHandler(w http.ResponseWriter, req *http.Request) {
 	varsMap := mux.Vars(req)
 	userID := varsMap["userId"]
-	var queryResult []ReservationDetails
 	query := bson.M{"userId": userID}
-	LogInfo("Querying reservations for userId: %s", userID)
-	if err := QueryAll(query, &queryResult); err != nil {
-		LogError("Couldn't get reservations for userId: %s. Reason: %v", userID, err)
-		http.Error(w, fmt.Sprintf("BadRequest: %v", err), http.StatusBadRequest)
+	if err := addStartTimeRange(req, query); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	app.Logger.LogInfo("Querying reservations for userId: %s", userID)
+	queryResult, err := app.findReservations(req, query)
+	if err != nil {
+		app.writeStoreError(w, req, err, "Couldn't get reservations for user %s", userID)
+		return
+	}
+
+	app.Logger.LogInfo("Found %d reservations for userId: %s", len(queryResult), userID)
+	writeJSON(w, http.StatusOK, queryResult)
+}
+
+func (app *App) updateReservationHandler(w http.ResponseWriter, req *http.Request) {
+	varsMap := mux.Vars(req)
+	reservationID := varsMap["reservationId"]
+
+	jsonDecoder := json.NewDecoder(req.Body)
+	update := ReservationUpdate{}
+	if err := jsonDecoder.Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body: %v", err)
+		return
+	}
+
+	if err := update.Validate(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	reservationDetails, ok := app.findReservation(w, req, reservationID)
+	if !ok {
 		return
 	}
 
-	LogInfo("Found %d reservations for userId: %s", len(queryResult), userID)
-	w.Header().Set("Content-Type", "application/json")
-	jsonResponse, _ := json.Marshal(queryResult)
-	fmt.Fprintf(w, string(jsonResponse))
+	app.writeReservationUpdate(w, req, reservationDetails, update)
+}
+
+func (app *App) cancelReservationHandler(w http.ResponseWriter, req *http.Request) {
+	varsMap := mux.Vars(req)
+	reservationID := varsMap["reservationId"]
+
+	reservationDetails, ok := app.findReservation(w, req, reservationID)
+	if !ok {
+		return
+	}
+
+	// A reservation that hasn't started yet ends as it starts, rather than before
+	endTime := NewReservationTime(app.Clock.Now())
+	if endTime.Before(reservationDetails.StartTime.Time) {
+		endTime = reservationDetails.StartTime
+	}
+	update := ReservationUpdate{
+		State:   reservationStateCancelled,
+		EndTime: endTime,
+	}
+	app.writeReservationUpdate(w, req, reservationDetails, update)
+}
+
+// writeReservationUpdate applies update to the reservation if its state allows it, and writes the updated reservation
+func (app *App) writeReservationUpdate(w http.ResponseWriter, req *http.Request, current ReservationDetails, update ReservationUpdate) {
+	reservationID := current.ReservationID
+	if err := update.validateFor(current); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if update.changesState(current) && !current.State.CanTransitionTo(update.State) {
+		app.Logger.LogError("Rejected moving reservationId: %s from %s to %s", reservationID, current.State, update.State)
+		writeError(w, http.StatusConflict, "Reservation %s can't move from %s to %s", reservationID, current.State, update.State)
+		return
+	}
+	if !update.changesState(current) && (update.EndTime.IsZero() || update.EndTime.Equal(current.EndTime.Time)) {
+		// A retried update that has already been applied
+		writeJSON(w, http.StatusOK, current)
+		return
+	}
+	if !update.changesState(current) && current.State.IsFinal() {
+		app.Logger.LogError("Rejected updating reservationId: %s in final state %s", reservationID, current.State)
+		writeError(w, http.StatusConflict, "Reservation %s is already %s", reservationID, current.State)
+		return
+	}
+
+	mongoUpdate, updated := update.applyTo(current, NewReservationTime(app.Clock.Now()).Time)
+	if update.changesEndTime(current) && updated.State != reservationStateFailed && updated.State != reservationStateCancelled {
+		// Hold the bike while checking the new window, as when booking it
+		unlockBike, err := app.lockBike(req.Context(), current.BikeID, reservationID)
+		if err != nil {
+			app.writeStoreError(w, req, err, "Couldn't lock bike %s for reservation %s", current.BikeID, reservationID)
+			return
+		}
+		defer unlockBike()
+
+		overlapping, err := app.findOverlappingReservation(req.Context(), updated)
+		if err != nil {
+			app.writeStoreError(w, req, err, "Couldn't check bike %s for overlapping reservations", current.BikeID)
+			return
+		}
+		if overlapping != nil {
+			app.Logger.LogError("ReservationId: %s would overlap reservationId: %s of bikeId: %s", reservationID, overlapping.ReservationID, current.BikeID)
+			writeError(w, http.StatusConflict, "Bike %s is already reserved by reservation %s", current.BikeID, overlapping.ReservationID)
+			return
+		}
+	}
+
+	// Only update the state that was checked, so a concurrent transition isn't overwritten
+	selector := bson.M{"reservationId": reservationID, "state": current.State}
+	app.Logger.LogInfo("Updating reservationId: %s from %s to %s", reservationID, current.State, updated.State)
+	if err := app.Store.UpdateOne(req.Context(), selector, mongoUpdate); err == mgo.ErrNotFound {
+		app.Logger.LogError("ReservationId: %s changed while being updated", reservationID)
+		writeError(w, http.StatusConflict, "Reservation %s changed while being updated, try again", reservationID)
+		return
+	} else if err != nil {
+		app.writeStoreError(w, req, err, "Couldn't update reservation %s", reservationID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// addStartTimeRange restricts query to reservations starting from the 'from' query parameter and before
+// the 'to' query parameter, when they're given
+func addStartTimeRange(req *http.Request, query bson.M) error {
+	var errorSlice []string
+	startTime := bson.M{}
+	for parameter, operator := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := req.URL.Query().Get(parameter)
+		if value == "" {
+			continue
+		}
+		parsed, err := ParseReservationTime(value)
+		if err != nil {
+			errorSlice = append(errorSlice, fmt.Sprintf("%s: %v", parameter, err))
+			continue
+		}
+		startTime[operator] = parsed.Time
+	}
+
+	if len(errorSlice) > 0 {
+		sort.Strings(errorSlice)
+		return ValidationError(errorSlice)
+	}
+	if len(startTime) > 0 {
+		query["startTime"] = startTime
+	}
+	return nil
+}
+
+// findReservation reads the reservation, writing the error response and returning false if it can't
+func (app *App) findReservation(w http.ResponseWriter, req *http.Request, reservationID string) (ReservationDetails, bool) {
+	var reservationDetails ReservationDetails
+	err := app.Store.QueryOne(req.Context(), bson.M{"reservationId": reservationID}, &reservationDetails)
+	if err == mgo.ErrNotFound {
+		app.Logger.LogError("No reservation found for reservationId: %s", reservationID)
+		writeError(w, http.StatusNotFound, "No reservation found for reservationId: %s", reservationID)
+		return reservationDetails, false
+	} else if err != nil {
+		app.writeStoreError(w, req, err, "Couldn't get reservation %s", reservationID)
+		return reservationDetails, false
+	}
+	return reservationDetails, true
+}
+
+// findReservations returns the reservations matching query, an empty slice rather than nil if there are none
+func (app *App) findReservations(req *http.Request, query bson.M) ([]ReservationDetails, error) {
+	reservations := []ReservationDetails{}
+	if err := app.Store.QueryAll(req.Context(), query, &reservations); err != nil {
+		return nil, err
+	}
+	if reservations == nil {
+		reservations = []ReservationDetails{}
+	}
+	return reservations, nil
 }
@@ -0,0 +1,227 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeStore serves reservations from memory, keyed by reservationId. Every operation fails with err when it's set.
+type fakeStore struct {
+	reservations map[string]ReservationDetails
+	err          error
+}
+
+func (store *fakeStore) InsertDocument(ctx context.Context, doc interface{}) error {
+	if store.err != nil {
+		return store.err
+	}
+	reservationDetails := doc.(ReservationDetails)
+	store.reservations[reservationDetails.ReservationID] = reservationDetails
+	return nil
+}
+
+func (store *fakeStore) QueryOne(ctx context.Context, query bson.M, result interface{}) error {
+	if store.err != nil {
+		return store.err
+	}
+	reservationDetails, ok := store.reservations[query["reservationId"].(string)]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	*result.(*ReservationDetails) = reservationDetails
+	return nil
+}
+
+// QueryAll leaves result nil when nothing matches, as a driver may, so that handlers must still write []
+func (store *fakeStore) QueryAll(ctx context.Context, query bson.M, result interface{}) error {
+	if store.err != nil {
+		return store.err
+	}
+	var reservations []ReservationDetails
+	for _, reservationDetails := range store.reservations {
+		if userID, ok := query["userId"]; !ok || userID == reservationDetails.UserID {
+			reservations = append(reservations, reservationDetails)
+		}
+	}
+	*result.(*[]ReservationDetails) = reservations
+	return nil
+}
+
+func (store *fakeStore) QueryEach(ctx context.Context, query bson.M, sortField string, limit int, result interface{}, each func() error) error {
+	return errors.New("not implemented")
+}
+
+func (store *fakeStore) UpdateOne(ctx context.Context, selector bson.M, update bson.M) error {
+	if store.err != nil {
+		return store.err
+	}
+	reservationDetails, ok := store.reservations[selector["reservationId"].(string)]
+	if !ok || reservationDetails.State != selector["state"] {
+		return mgo.ErrNotFound
+	}
+	return nil
+}
+
+func (store *fakeStore) ArchiveDocument(ctx context.Context, id interface{}) error {
+	return errors.New("not implemented")
+}
+
+func (store *fakeStore) AcquireLock(ctx context.Context, name, owner string, now time.Time, ttl time.Duration) (bool, error) {
+	return store.err == nil, store.err
+}
+
+func (store *fakeStore) ReleaseLock(ctx context.Context, name, owner string) error {
+	return nil
+}
+
+func (store *fakeStore) Ping() error { return store.err }
+func (store *fakeStore) Refresh()    {}
+func (store *fakeStore) Close()      {}
+
+func newTestApp(store *fakeStore) http.Handler {
+	return NewApp(DefaultConfig(), store, NewLogger(ioutil.Discard, ioutil.Discard), SystemClock).Handler()
+}
+
+func serve(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// decodeErrorResult checks that the response is a JSON ErrorResult with the given status
+func decodeErrorResult(t *testing.T, recorder *httptest.ResponseRecorder, status int) ErrorResult {
+	if recorder.Code != status {
+		t.Fatalf("Expected status %d, got %d: %s", status, recorder.Code, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("Expected a JSON body, got Content-Type %q", contentType)
+	}
+	var result ErrorResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Expected an ErrorResult body, got %s: %v", recorder.Body.String(), err)
+	}
+	if result.Status != status || result.Error == "" || result.Message == "" {
+		t.Fatalf("Expected an ErrorResult for status %d, got %+v", status, result)
+	}
+	return result
+}
+
+func TestMissingReservationIsNotFound(t *testing.T) {
+	handler := newTestApp(&fakeStore{reservations: map[string]ReservationDetails{}})
+	requests := []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/api/reservation/unknown", ""},
+		{http.MethodGet, "/api/v2/reservation/unknown", ""},
+		{http.MethodPatch, "/api/reservation/unknown", `{"state": "Booked"}`},
+		{http.MethodPost, "/api/reservation/unknown/cancel", ""},
+		{http.MethodGet, "/api/unknown", ""},
+	}
+	for _, request := range requests {
+		recorder := serve(handler, request.method, request.path, request.body)
+		result := decodeErrorResult(t, recorder, http.StatusNotFound)
+		if result.Error != "NotFound" {
+			t.Errorf("%s %s: expected error NotFound, got %q", request.method, request.path, result.Error)
+		}
+	}
+}
+
+func TestFoundReservationIsReturned(t *testing.T) {
+	reservationDetails := ReservationDetails{ReservationID: "r1", BikeID: "b1", UserID: "u1", State: reservationStateBooked}
+	handler := newTestApp(&fakeStore{reservations: map[string]ReservationDetails{"r1": reservationDetails}})
+
+	recorder := serve(handler, http.MethodGet, "/api/reservation/r1", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var found ReservationDetails
+	if err := json.Unmarshal(recorder.Body.Bytes(), &found); err != nil {
+		t.Fatalf("Expected a reservation, got %s: %v", recorder.Body.String(), err)
+	}
+	if found.ReservationID != "r1" || found.BikeID != "b1" {
+		t.Errorf("Expected reservation r1 of bike b1, got %+v", found)
+	}
+}
+
+func TestEmptyListsAreEmptyArrays(t *testing.T) {
+	handler := newTestApp(&fakeStore{reservations: map[string]ReservationDetails{
+		"r1": {ReservationID: "r1", BikeID: "b1", UserID: "someone else", State: reservationStateBooked},
+	}})
+	for _, path := range []string{"/api/user/u1/reservations", "/api/v2/user/u1/reservations"} {
+		recorder := serve(handler, http.MethodGet, path, "")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", path, recorder.Code, recorder.Body.String())
+		}
+		if body := strings.TrimSpace(recorder.Body.String()); body != "[]" {
+			t.Errorf("%s: expected [], got %s", path, body)
+		}
+	}
+
+	handler = newTestApp(&fakeStore{reservations: map[string]ReservationDetails{}})
+	recorder := serve(handler, http.MethodGet, "/api/allReservations", "")
+	if body := strings.TrimSpace(recorder.Body.String()); recorder.Code != http.StatusOK || body != "[]" {
+		t.Errorf("Expected 200 with [], got %d with %s", recorder.Code, body)
+	}
+}
+
+func TestStoreFailureIsServerError(t *testing.T) {
+	handler := newTestApp(&fakeStore{err: errors.New("no reachable servers")})
+	for _, path := range []string{"/api/reservation/r1", "/api/allReservations", "/api/user/u1/reservations"} {
+		recorder := serve(handler, http.MethodGet, path, "")
+		decodeErrorResult(t, recorder, http.StatusInternalServerError)
+	}
+}
+
+func TestInvalidRequestIsBadRequest(t *testing.T) {
+	handler := newTestApp(&fakeStore{reservations: map[string]ReservationDetails{
+		"r1": {ReservationID: "r1", BikeID: "b1", UserID: "u1", State: reservationStateBooked},
+	}})
+	requests := []struct {
+		method, path, body string
+	}{
+		{http.MethodPatch, "/api/reservation/r1", `{"state": `},
+		{http.MethodPatch, "/api/reservation/r1", `{"state": "Unknown"}`},
+		{http.MethodPost, "/api/reservation", `{}`},
+		{http.MethodGet, "/api/allReservations?from=yesterday", ""},
+	}
+	for _, request := range requests {
+		recorder := serve(handler, request.method, request.path, request.body)
+		decodeErrorResult(t, recorder, http.StatusBadRequest)
+	}
+}
+
+func TestCancelledFutureReservationEndsAtItsStart(t *testing.T) {
+	startTime := NewReservationTime(time.Now().Add(time.Hour))
+	handler := newTestApp(&fakeStore{reservations: map[string]ReservationDetails{
+		"r1": {ReservationID: "r1", BikeID: "b1", UserID: "u1", State: reservationStateBooked, StartTime: startTime},
+	}})
+
+	recorder := serve(handler, http.MethodPost, "/api/v2/reservation/r1/cancel", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var cancelled ReservationDetailsV2
+	if err := json.Unmarshal(recorder.Body.Bytes(), &cancelled); err != nil {
+		t.Fatalf("Expected a reservation, got %s: %v", recorder.Body.String(), err)
+	}
+	if cancelled.State != reservationStateCancelled || cancelled.EndTime == nil || !cancelled.EndTime.Equal(startTime.Time) {
+		t.Errorf("Expected a Cancelled reservation ending at %v, got %s ending at %v", startTime.Time, cancelled.State, cancelled.EndTime)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthStatusUp   = "up"
+	healthStatusDown = "down"
+	// healthStatusShuttingDown is reported by /readyz once shutdown has begun
+	healthStatusShuttingDown = "shuttingDown"
+
+	mongoDbDependencyName = "mongodb"
+	healthCheckInterval   = 3 * time.Second
+)
+
+// DependencyStatus is the last known health of a single dependency
+type DependencyStatus struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	LatencyMs float64   `json:"latencyMs"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// HealthMonitor tracks the health of the service's dependencies
+type HealthMonitor struct {
+	clock        Clock
+	mutex        sync.RWMutex
+	dependencies []DependencyStatus
+	shuttingDown bool
+}
+
+// NewHealthMonitor creates a HealthMonitor that timestamps checks with clock
+func NewHealthMonitor(clock Clock) *HealthMonitor {
+	return &HealthMonitor{clock: clock}
+}
+
+// Record stores the result of a dependency check, replacing any previous result for that dependency
+func (monitor *HealthMonitor) Record(name string, latency time.Duration, err error) {
+	status := DependencyStatus{
+		Name:      name,
+		Status:    healthStatusUp,
+		LatencyMs: float64(latency.Nanoseconds()) / float64(time.Millisecond),
+		CheckedAt: monitor.clock.Now().UTC(),
+	}
+	if err != nil {
+		status.Status = healthStatusDown
+		status.Error = err.Error()
+	}
+
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	for i := range monitor.dependencies {
+		if monitor.dependencies[i].Name == name {
+			monitor.dependencies[i] = status
+			return
+		}
+	}
+	monitor.dependencies = append(monitor.dependencies, status)
+}
+
+// SetShuttingDown makes the service report not-ready from now on
+func (monitor *HealthMonitor) SetShuttingDown() {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.shuttingDown = true
+}
+
+// ShuttingDown returns true once SetShuttingDown has been called
+func (monitor *HealthMonitor) ShuttingDown() bool {
+	monitor.mutex.RLock()
+	defer monitor.mutex.RUnlock()
+	return monitor.shuttingDown
+}
+
+// Snapshot returns a copy of the dependency statuses and whether the service is ready to take traffic
+func (monitor *HealthMonitor) Snapshot() ([]DependencyStatus, bool) {
+	monitor.mutex.RLock()
+	defer monitor.mutex.RUnlock()
+
+	dependencies := make([]DependencyStatus, len(monitor.dependencies))
+	copy(dependencies, monitor.dependencies)
+
+	// Nothing has been checked yet, so we can't claim to be ready
+	ready := len(dependencies) > 0 && !monitor.shuttingDown
+	for _, dependency := range dependencies {
+		if dependency.Status != healthStatusUp {
+			ready = false
+		}
+	}
+	return dependencies, ready
+}
+
+// monitorStoreHealth pings the database until ctx is done, recording the results for /readyz.
+// Failed pings refresh the session and are retried with backoff, opening the circuit breaker meanwhile.
+func (app *App) monitorStoreHealth(ctx context.Context) {
+	failedAttempts := 0
+	for {
+		if err := app.pingStore(); err != nil {
+			failedAttempts++
+			app.breaker.RecordFailure()
+			app.Store.Refresh()
+		} else {
+			if failedAttempts > 0 {
+				app.Logger.LogInfo("MongoDb reachable again after %d failed pings", failedAttempts)
+			}
+			failedAttempts = 0
+			app.breaker.RecordSuccess()
+		}
+
+		wait := healthCheckInterval
+		if failedAttempts > 0 {
+			wait = app.Config().MongoDbReconnect.Interval(failedAttempts)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			// Check again
+		}
+	}
+}
+
+func (app *App) pingStore() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			app.Logger.LogError("Panic while pinging MongoDb: %v", r)
+			err = fmt.Errorf("Panic while pinging MongoDb: %v", r)
+			app.health.Record(mongoDbDependencyName, 0, err)
+		}
+	}()
+
+	startTime := time.Now()
+	err = app.Store.Ping()
+	if err != nil {
+		app.Logger.LogError("MongoDb ping failed: %v", err)
+	}
+	app.health.Record(mongoDbDependencyName, time.Since(startTime), err)
+	return err
+}
+
+// LivenessHandler handles the /healthz endpoint. The process is alive as long as it can serve requests.
+func (app *App) LivenessHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":"up"}`)
+}
+
+// ReadinessHandler handles the /readyz endpoint, reporting the status of each dependency
+func (app *App) ReadinessHandler(w http.ResponseWriter, req *http.Request) {
+	dependencies, ready := app.health.Snapshot()
+	response := readinessResponse{Status: healthStatusUp, Dependencies: dependencies}
+	responseCode := http.StatusOK
+	if !ready {
+		response.Status = healthStatusDown
+		if app.health.ShuttingDown() {
+			response.Status = healthStatusShuttingDown
+		}
+		responseCode = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, responseCode, response)
+}
@@ -5,20 +5,36 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
 
 var flags = log.Flags() | log.LUTC | log.Lmicroseconds | log.Lshortfile
-var stdLogger = log.New(os.Stdout, "Reservation Service: ", flags)
-var errLogger = log.New(os.Stderr, "Reservation Service Error: ", flags)
 
-func LogInfo(format string, a ...interface{}) {
+// Logger writes informational messages to one writer and errors to another
+type Logger struct {
+	stdLogger *log.Logger
+	errLogger *log.Logger
+}
+
+// NewLogger creates a Logger writing informational messages to stdOut and errors to errOut
+func NewLogger(stdOut, errOut io.Writer) *Logger {
+	return &Logger{
+		stdLogger: log.New(stdOut, "Reservation Service: ", flags),
+		errLogger: log.New(errOut, "Reservation Service Error: ", flags),
+	}
+}
+
+// defaultLogger writes to the process's standard output and error
+var defaultLogger = NewLogger(os.Stdout, os.Stderr)
+
+func (logger *Logger) LogInfo(format string, a ...interface{}) {
 	str := fmt.Sprintf(format, a...)
-	stdLogger.Output(3, str)
+	logger.stdLogger.Output(2, str)
 }
 
-func LogError(format string, a ...interface{}) {
+func (logger *Logger) LogError(format string, a ...interface{}) {
 	str := fmt.Sprintf(format, a...)
-	errLogger.Output(3, str)
+	logger.errLogger.Output(2, str)
 }
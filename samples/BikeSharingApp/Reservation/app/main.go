@@ -4,100 +4,70 @@
 package main
 
 import (
-	"net/http"
+	"context"
+	"os"
 	"os/signal"
 	"syscall"
-	"time"
-
-	"fmt"
-	"os"
-	"sync"
-
-	"github.com/gorilla/mux"
 )
 
-var (
-	DbConnection   *MongoHelper
-	ShutdownSignal = sync.NewCond(&sync.Mutex{})
-	ShutdownWg     = &sync.WaitGroup{}
-	Port           = 80
-)
-
-func init() {
-	DbConnection = CreateMongoConnection()
-	ShutdownWg.Add(1)
-	go listenForUnexpectedMongoDbShutdown(DbConnection)
+func main() {
+	logger := defaultLogger
 
-	// Define a channel that will be called when the OS wants the program to exit
-	// This will be used to gracefully shutdown the app
-	osChan := make(chan os.Signal, 5)
-	signal.Notify(osChan, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGABRT, syscall.SIGQUIT)
-	go func() {
-		fmt.Fprintf(os.Stderr, "OS signal received: %v\n", <-osChan)
-		shutdown()
-	}()
-}
+	config, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		logger.LogError("Invalid configuration: %v", err)
+		os.Exit(1)
+	}
+	logger.LogInfo("Effective configuration: %s", config.Redacted())
 
-func main() {
-	r := mux.NewRouter()
-	r.HandleFunc("/hello", HelloHandler).Methods(http.MethodGet)
-	r.HandleFunc("/api/allReservations", getAllReservationsHandler).Methods(http.MethodGet)
-	r.HandleFunc("/api/reservation", addReservationHandler).Methods(http.MethodPost)
-	r.HandleFunc("/api/reservation/{reservationId}", getReservationHandler).Methods(http.MethodGet)
-	r.HandleFunc("/api/user/{userId}/reservations", listReservationsHandler).Methods(http.MethodGet)
-	go func() {
-		LogInfo("Listening on port: %d", Port)
-		fmt.Fprintf(os.Stderr, "%v\n", http.ListenAndServe(fmt.Sprintf(":%d", Port), r))
-		shutdown()
-	}()
+	store, err := CreateMongoConnection(config, logger)
+	if err != nil {
+		logger.LogError("%v", err)
+		os.Exit(1)
+	}
 
-	ShutdownWg.Wait()
-	fmt.Println("Graceful shutdown.")
-}
+	if err := migrateReservationTimes(context.Background(), store, logger); err != nil {
+		logger.LogError("Couldn't migrate reservation times: %v", err)
+		os.Exit(1)
+	}
+	if err := migrateDuplicateReservations(context.Background(), store, logger); err != nil {
+		logger.LogError("Couldn't migrate duplicate reservations: %v", err)
+		os.Exit(1)
+	}
+	if err := store.EnsureIndexes(); err != nil {
+		logger.LogError("Failed to create indexes: %v", err)
+		os.Exit(1)
+	}
 
-var unexpectedShutdownOnce sync.Once
+	app := NewApp(config, store, logger, SystemClock)
 
-func listenForUnexpectedMongoDbShutdown(conn *MongoHelper) {
-	shutdownChan := make(chan struct{}, 1)
+	// Cancel the app's context when the OS wants the program to exit
+	ctx, cancel := context.WithCancel(context.Background())
+	osChan := make(chan os.Signal, 1)
+	signal.Notify(osChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
-		ShutdownSignal.L.Lock()
-		ShutdownSignal.Wait()
-		ShutdownSignal.L.Unlock()
-		shutdownChan <- struct{}{}
+		logger.LogError("OS signal received: %v", <-osChan)
+		cancel()
 	}()
 
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Fprintf(os.Stderr, "Panic while pinging MongoDb: %v\n", r)
-			unexpectedShutdownOnce.Do(shutdown)
+	// Re-read the configuration sources on SIGHUP, applying the settings that can change at runtime
+	hangupChan := make(chan os.Signal, 1)
+	signal.Notify(hangupChan, syscall.SIGHUP)
+	go func() {
+		for range hangupChan {
+			reloaded, err := LoadConfig(os.Args[1:])
+			if err != nil {
+				logger.LogError("Ignoring SIGHUP, invalid configuration: %v", err)
+				continue
+			}
+			app.Reload(reloaded)
 		}
 	}()
 
-checkLoop:
-	for {
-		timer := time.NewTimer(3 * time.Second)
-		select {
-		case <-shutdownChan:
-			timer.Stop()
-			break checkLoop
-		case <-timer.C:
-			// Do nothing
-		}
-
-		if err := conn.session.Ping(); err != nil {
-			fmt.Fprintln(os.Stderr, "MongoDbConnection shut down unexpectedly!")
-			unexpectedShutdownOnce.Do(shutdown)
-		}
+	err = app.Run(ctx)
+	app.Close()
+	if err != nil {
+		os.Exit(1)
 	}
+	logger.LogInfo("Graceful shutdown.")
 }
-
-func shutdown() {
-	fmt.Println("Shutting down!")
-	ShutdownSignal.Broadcast()
-
-	if DbConnection != nil {
-		DbConnection.session.Close()
-	}
-
-	ShutdownWg.Done()
-}
\ No newline at end of file
@@ -0,0 +1,130 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// bsonTypeString is the $type of BSON strings
+const bsonTypeString = 2
+
+// reservationTimeFields were stored as strings before reservation times were typed
+var reservationTimeFields = []string{"requestTime", "startTime", "endTime"}
+
+// migrateReservationTimes converts reservation times still stored as strings to BSON dates, and empty
+// ones to null. It only touches string values, so every replica can safely run it at startup.
+func migrateReservationTimes(ctx context.Context, store Store, logger *Logger) error {
+	var stringTimes []bson.M
+	for _, field := range reservationTimeFields {
+		stringTimes = append(stringTimes, bson.M{field: bson.M{"$type": bsonTypeString}})
+	}
+
+	var documents []bson.M
+	if err := store.QueryAll(ctx, bson.M{"$or": stringTimes}, &documents); err != nil {
+		return err
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+
+	logger.LogInfo("Migrating the times of %d reservations to dates", len(documents))
+	migrated := 0
+	for _, document := range documents {
+		selector := bson.M{"_id": document["_id"]}
+		fields := bson.M{}
+		for _, field := range reservationTimeFields {
+			value, ok := document[field].(string)
+			if !ok {
+				continue
+			}
+			parsed, err := ParseReservationTime(value)
+			if err != nil {
+				logger.LogError("Not migrating reservationId: %v, %s: %v", document["reservationId"], field, err)
+				fields = nil
+				break
+			}
+			// Only replace the value that was read, in case another replica migrated it meanwhile
+			selector[field] = value
+			fields[field] = parsed
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		if err := store.UpdateOne(ctx, selector, bson.M{"$set": fields}); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		migrated++
+	}
+	logger.LogInfo("Migrated the times of %d reservations", migrated)
+	return nil
+}
+
+// duplicateReservation is what migrateDuplicateReservations reads of each reservation
+type duplicateReservation struct {
+	ID            interface{} `bson:"_id"`
+	ReservationID string      `bson:"reservationId"`
+	// RequestID is nil when the reservation has none
+	RequestID *string `bson:"requestId"`
+}
+
+// migrateDuplicateReservations resolves the reservations stored twice before reservationId and requestId
+// were unique, so that their unique indexes can be built. Reservations are read in the order they were
+// inserted, and the first one of a reservationId or requestId is kept as it is. A later reservation with
+// the same reservationId, which a replayed request stored again, is archived in the duplicates collection;
+// reads and updates only ever found the first one. A later reservation with another reservationId but the
+// same requestId loses its requestId, which no longer identifies one request. Each resolved reservation is
+// logged, and every replica can safely run it at startup.
+func migrateDuplicateReservations(ctx context.Context, store Store, logger *Logger) error {
+	reservationIDs := map[string]bool{}
+	requestIDs := map[string]string{}
+	var archived, reused []duplicateReservation
+
+	var reservation duplicateReservation
+	err := store.QueryEach(ctx, bson.M{}, "_id", 0, &reservation, func() error {
+		switch {
+		case reservationIDs[reservation.ReservationID]:
+			archived = append(archived, reservation)
+		case reservation.RequestID != nil && requestIDs[*reservation.RequestID] != "":
+			reused = append(reused, reservation)
+			reservationIDs[reservation.ReservationID] = true
+		default:
+			reservationIDs[reservation.ReservationID] = true
+			if reservation.RequestID != nil {
+				requestIDs[*reservation.RequestID] = reservation.ReservationID
+			}
+		}
+		// Fields missing from the next document mustn't keep this one's values
+		reservation = duplicateReservation{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(archived) == 0 && len(reused) == 0 {
+		return nil
+	}
+
+	logger.LogInfo("Resolving %d duplicate reservations and %d reused requestIds", len(archived), len(reused))
+	for _, duplicate := range archived {
+		if err := store.ArchiveDocument(ctx, duplicate.ID); err != nil {
+			return err
+		}
+		logger.LogInfo("Archived a duplicate of reservationId: %s (_id: %v)", duplicate.ReservationID, duplicate.ID)
+	}
+	for _, duplicate := range reused {
+		requestID := *duplicate.RequestID
+		selector := bson.M{"_id": duplicate.ID, "requestId": requestID}
+		if err := store.UpdateOne(ctx, selector, bson.M{"$unset": bson.M{"requestId": ""}}); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		logger.LogInfo("Removed requestId: %q from reservationId: %s, it created reservationId: %s first", requestID, duplicate.ReservationID, requestIDs[requestID])
+	}
+	logger.LogInfo("Resolved %d duplicate reservations and %d reused requestIds", len(archived), len(reused))
+	return nil
+}
@@ -4,10 +4,10 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
-	"os"
 	"strings"
 	"time"
 
@@ -15,25 +15,56 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
-const (
-	mongoDbConnectionStringEnvName = "mongo_connectionstring"
-	mongoDbNameEnvName             = "mongo_dbname"
-	mongoDbCollectionEnvName       = "mongo_collection"
-)
+// Store is the persistence used by the Reservation handlers
+type Store interface {
+	// InsertDocument returns an error satisfying mgo.IsDup if doc duplicates a unique key
+	InsertDocument(ctx context.Context, doc interface{}) error
+	QueryOne(ctx context.Context, query bson.M, result interface{}) error
+	QueryAll(ctx context.Context, query bson.M, result interface{}) error
+	// QueryEach decodes the documents matching query into result one at a time, ordered by sortField and
+	// at most limit of them (0 for all), calling each after every document. It stops once each fails.
+	QueryEach(ctx context.Context, query bson.M, sortField string, limit int, result interface{}, each func() error) error
+	// UpdateOne applies update to the first document matching selector, returning mgo.ErrNotFound if none does
+	UpdateOne(ctx context.Context, selector bson.M, update bson.M) error
+	// ArchiveDocument moves the document with the _id id into the duplicates collection. Archiving a
+	// document that was archived already succeeds.
+	ArchiveDocument(ctx context.Context, id interface{}) error
+
+	// AcquireLock takes the named lock for owner until ttl after now, returning false if another owner holds it
+	AcquireLock(ctx context.Context, name, owner string, now time.Time, ttl time.Duration) (bool, error)
+	// ReleaseLock releases the named lock if owner still holds it
+	ReleaseLock(ctx context.Context, name, owner string) error
+
+	Ping() error
+	Refresh()
+	Close()
+}
 
-// MongoDB details with session, db and collection
+// MongoDB details with session, db and collection. Each operation copies its own session from
+// the pool, so concurrent requests don't serialize on one socket.
 type MongoHelper struct {
-	session    *mgo.Session
-	database   *mgo.Database
-	collection *mgo.Collection
+	session        *mgo.Session
+	databaseName   string
+	collectionName string
+	// lockCollectionName holds the locks serializing writes across replicas
+	lockCollectionName string
+	// duplicateCollectionName keeps the reservations the migrations archived as duplicates
+	duplicateCollectionName string
 }
 
-// Connect to the MongoDB
-func CreateMongoConnection() *MongoHelper {
-	uri := os.Getenv(mongoDbConnectionStringEnvName)
-	if uri == "" {
-		uri = reservationMongoDBConnectionString
-	}
+// queryEachBatchSize is how many documents QueryEach fetches from MongoDb at a time
+const queryEachBatchSize = 500
+
+// lockDocument is a lock held by Owner until ExpiresAt
+type lockDocument struct {
+	Name      string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// Connect to the MongoDB, retrying with the configured backoff until it succeeds or the attempts run out
+func CreateMongoConnection(config Config, logger *Logger) (*MongoHelper, error) {
+	uri := config.MongoDbConnectionString
 
 	useSsl := false
 	if strings.Contains(uri, "?ssl=true") {
@@ -43,8 +74,7 @@ func CreateMongoConnection() *MongoHelper {
 
 	dialInfo, err := mgo.ParseURL(uri)
 	if err != nil {
-		fmt.Println("failed to parse URI: ", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to parse URI: %v", err)
 	}
 
 	if useSsl {
@@ -56,70 +86,237 @@ func CreateMongoConnection() *MongoHelper {
 		}
 	}
 
+	if dialInfo.Timeout == 0 {
+		dialInfo.Timeout = mongoDialTimeout
+	}
+	dialInfo.PoolLimit = config.MongoDbPoolLimit
+
+	reconnect := config.MongoDbReconnect
 	var mongoSession *mgo.Session
-	maxTries := 5
-	fmt.Printf("Connecting to Mongo: %s\n", uri)
-	for i := 1; i <= maxTries; i++ {
+	logger.LogInfo("Connecting to Mongo: %q", dialInfo.Addrs)
+	for attempt := 1; ; attempt++ {
 		mongoSession, err = mgo.DialWithInfo(dialInfo)
 		if err == nil {
 			break
 		}
 
-		if i < maxTries {
-			fmt.Printf("%d/%d - Couldn't connect, sleeping and trying again\n", i, maxTries)
-			time.Sleep(1 * time.Second)
-		} else {
-			fmt.Printf("%d/%d - Couldn't connect.\n", i, maxTries)
+		if reconnect.Exhausted(attempt) {
+			logger.LogError("%d/%d - Couldn't connect.", attempt, reconnect.MaxAttempts)
+			break
 		}
+		wait := reconnect.Interval(attempt)
+		logger.LogError("Attempt %d - Couldn't connect, trying again in %v: %v", attempt, wait, err)
+		time.Sleep(wait)
 	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to connect to mongodb: %s\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to connect to mongodb: %v", err)
 	}
-	fmt.Println("Connected to Mongo")
+	logger.LogInfo("Connected to Mongo")
+
+	mongoHelper := &MongoHelper{
+		session:            mongoSession,
+		databaseName:       config.MongoDbDatabase,
+		collectionName:     config.MongoDbCollection,
+		lockCollectionName: config.MongoDbCollection + lockCollectionSuffix,
 
-	db := os.Getenv(mongoDbNameEnvName)
-	if db == "" {
-		db = reservationMongoDBDatabase
+		duplicateCollectionName: config.MongoDbCollection + duplicateCollectionSuffix,
 	}
 
-	collection := os.Getenv(mongoDbCollectionEnvName)
-	if collection == "" {
-		collection = reservationMongoDBCollection
+	return mongoHelper, nil
+}
+
+// EnsureIndexes creates the indexes the queries rely on, if they don't exist yet. The unique ones can only
+// be built once migrateDuplicateReservations resolved the duplicates stored before they existed.
+func (mongoHelper *MongoHelper) EnsureIndexes() error {
+	session := mongoHelper.session.Copy()
+	defer session.Close()
+
+	collection := session.DB(mongoHelper.databaseName).C(mongoHelper.collectionName)
+	indexes := []mgo.Index{
+		{Key: []string{"reservationId"}, Unique: true},
+		// A replayed request finds the reservation it created. Reservations whose requestId was reused
+		// before it was unique have none.
+		{Key: []string{"requestId"}, Unique: true, Sparse: true},
+		// Finding a bike's overlapping reservations
+		{Key: []string{"bikeId", "startTime"}, Background: true},
 	}
+	for _, index := range indexes {
+		if err := collection.EnsureIndex(index); err != nil {
+			return fmt.Errorf("index on %v: %v", index.Key, err)
+		}
+	}
+	return nil
+}
 
-	mongoHelper := &MongoHelper{
-		session:    mongoSession,
-		database:   mongoSession.DB(db),
-		collection: mongoSession.DB(db).C(collection),
+// copySession copies a session from the pool for one operation. The context's deadline bounds
+// the session's socket timeouts. Close the session once the operation is done.
+func (mongoHelper *MongoHelper) copySession(ctx context.Context) (*mgo.Session, *mgo.Collection) {
+	session := mongoHelper.session.Copy()
+	if timeout, ok := timeUntilDeadline(ctx); ok {
+		session.SetSocketTimeout(timeout)
+		session.SetSyncTimeout(timeout)
 	}
+	return session, session.DB(mongoHelper.databaseName).C(mongoHelper.collectionName)
+}
 
-	return mongoHelper
+// timeUntilDeadline returns how long is left before the context's deadline, if it has one
+func timeUntilDeadline(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	if timeout := time.Until(deadline); timeout > 0 {
+		return timeout, true
+	}
+	// Already expired, runWithContext fails the operation with the context's error
+	return time.Millisecond, true
 }
 
-func InsertDocument(doc interface{}) error {
-	mongoHelper := DbConnection
-	if err := mongoHelper.collection.Insert(doc); err != nil {
+// runWithContext runs operation unless ctx is already done. The operation isn't abandoned when ctx is
+// done meanwhile, as its session is closed once it returns; the socket timeouts and server-side time
+// limit set from ctx's deadline bound it instead. A failure once ctx is done reports ctx's error.
+func runWithContext(ctx context.Context, operation func() error) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	return nil
+	err := operation()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
-func QueryOne(query bson.M, result interface{}) error {
-	mongoHelper := DbConnection
-	if err := mongoHelper.collection.Find(query).One(result); err != nil {
-		return err
+// limitQuery stops the server working on the query once the context's deadline passes
+func limitQuery(ctx context.Context, query *mgo.Query) *mgo.Query {
+	if timeout, ok := timeUntilDeadline(ctx); ok {
+		return query.SetMaxTime(timeout)
 	}
+	return query
+}
 
-	return nil
+func (mongoHelper *MongoHelper) InsertDocument(ctx context.Context, doc interface{}) error {
+	session, collection := mongoHelper.copySession(ctx)
+	defer session.Close()
+
+	return runWithContext(ctx, func() error {
+		return collection.Insert(doc)
+	})
+}
+
+func (mongoHelper *MongoHelper) QueryOne(ctx context.Context, query bson.M, result interface{}) error {
+	session, collection := mongoHelper.copySession(ctx)
+	defer session.Close()
+
+	return runWithContext(ctx, func() error {
+		return limitQuery(ctx, collection.Find(query)).One(result)
+	})
+}
+
+func (mongoHelper *MongoHelper) QueryAll(ctx context.Context, query bson.M, result interface{}) error {
+	session, collection := mongoHelper.copySession(ctx)
+	defer session.Close()
+
+	return runWithContext(ctx, func() error {
+		return limitQuery(ctx, collection.Find(query)).All(result)
+	})
+}
+
+func (mongoHelper *MongoHelper) QueryEach(ctx context.Context, query bson.M, sortField string, limit int, result interface{}, each func() error) error {
+	session, collection := mongoHelper.copySession(ctx)
+	defer session.Close()
+
+	// Only one batch is held in memory at a time. Fetching the next is bounded by the socket timeout.
+	iter := limitQuery(ctx, collection.Find(query).Sort(sortField).Limit(limit).Batch(queryEachBatchSize)).Iter()
+	for iter.Next(result) {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return err
+		}
+		if err := each(); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func (mongoHelper *MongoHelper) UpdateOne(ctx context.Context, selector bson.M, update bson.M) error {
+	session, collection := mongoHelper.copySession(ctx)
+	defer session.Close()
+
+	return runWithContext(ctx, func() error {
+		return collection.Update(selector, update)
+	})
 }
 
-func QueryAll(query bson.M, result interface{}) error {
-	mongoHelper := DbConnection
-	if err := mongoHelper.collection.Find(query).All(result); err != nil {
+func (mongoHelper *MongoHelper) ArchiveDocument(ctx context.Context, id interface{}) error {
+	session, collection := mongoHelper.copySession(ctx)
+	defer session.Close()
+	duplicates := session.DB(mongoHelper.databaseName).C(mongoHelper.duplicateCollectionName)
+
+	return runWithContext(ctx, func() error {
+		var document bson.M
+		err := collection.FindId(id).One(&document)
+		if err == mgo.ErrNotFound {
+			// Another replica archived it
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Copy it before removing it, so that it's never lost. A copy left by a failed attempt is kept.
+		if err := duplicates.Insert(document); err != nil && !mgo.IsDup(err) {
+			return err
+		}
+		if err := collection.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+func (mongoHelper *MongoHelper) AcquireLock(ctx context.Context, name, owner string, now time.Time, ttl time.Duration) (bool, error) {
+	session, _ := mongoHelper.copySession(ctx)
+	defer session.Close()
+	locks := session.DB(mongoHelper.databaseName).C(mongoHelper.lockCollectionName)
+
+	// Matches only a free or expired lock. If it's held, the upsert's insert fails on the unique _id.
+	selector := bson.M{"_id": name, "expiresAt": bson.M{"$lte": now}}
+	lock := lockDocument{Name: name, Owner: owner, ExpiresAt: now.Add(ttl)}
+	err := runWithContext(ctx, func() error {
+		_, err := locks.Upsert(selector, lock)
 		return err
+	})
+	if mgo.IsDup(err) {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	return nil
+func (mongoHelper *MongoHelper) ReleaseLock(ctx context.Context, name, owner string) error {
+	session, _ := mongoHelper.copySession(ctx)
+	defer session.Close()
+	locks := session.DB(mongoHelper.databaseName).C(mongoHelper.lockCollectionName)
+
+	err := runWithContext(ctx, func() error {
+		return locks.Remove(bson.M{"_id": name, "owner": owner})
+	})
+	if err == mgo.ErrNotFound {
+		// It expired and was taken over
+		return nil
+	}
+	return err
+}
+
+func (mongoHelper *MongoHelper) Ping() error {
+	return mongoHelper.session.Ping()
+}
+
+// Refresh discards the session's sockets so the next operation reconnects to the cluster
+func (mongoHelper *MongoHelper) Refresh() {
+	mongoHelper.session.Refresh()
+}
+
+func (mongoHelper *MongoHelper) Close() {
+	mongoHelper.session.Close()
 }
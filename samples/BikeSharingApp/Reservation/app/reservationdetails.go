@@ -4,20 +4,24 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 // ReservationDetails for bike reservations as read from the mongoDB.
 type ReservationDetails struct {
-	ReservationID string `bson:"reservationId" json:"reservationId"`
-	BikeID        string `bson:"bikeId" json:"bikeId"`
-	UserID        string `bson:"userId" json:"userId"`
-	RequestTime   string `bson:"requestTime" json:"requestTime"`
-	StartTime     string `bson:"startTime" json:"startTime"`
-	EndTime       string `bson:"endTime" json:"endTime"`
-	State         string `bson:"state" json:"state"`
-	RequestId	  string `bson:"requestId" json:"requestId"`
+	ReservationID string           `bson:"reservationId" json:"reservationId" openapi:"required"`
+	BikeID        string           `bson:"bikeId" json:"bikeId" openapi:"required"`
+	UserID        string           `bson:"userId" json:"userId" openapi:"required"`
+	RequestTime   ReservationTime  `bson:"requestTime" json:"requestTime" openapi:"required"`
+	StartTime     ReservationTime  `bson:"startTime" json:"startTime" openapi:"required"`
+	EndTime       ReservationTime  `bson:"endTime" json:"endTime"`
+	State         ReservationState `bson:"state" json:"state" openapi:"required"`
+	RequestId     string           `bson:"requestId" json:"requestId" openapi:"required"`
+	// Transitions is the history of the reservation's state, oldest first
+	Transitions []StateTransition `bson:"transitions,omitempty" json:"transitions,omitempty"`
 }
 
 func (reservationDetails ReservationDetails) Validate() error {
@@ -33,23 +37,170 @@ func (reservationDetails ReservationDetails) Validate() error {
 	if reservationDetails.UserID == zeroString {
 		errorSlice = append(errorSlice, "Must specify userId string")
 	}
-	if reservationDetails.RequestTime == zeroString {
-		errorSlice = append(errorSlice, "Must specify requestTime string")
+	if reservationDetails.RequestTime.IsZero() {
+		errorSlice = append(errorSlice, "Must specify requestTime time")
+	}
+	if reservationDetails.StartTime.IsZero() {
+		errorSlice = append(errorSlice, "Must specify startTime time")
+	} else if reservationDetails.StartTime.Before(reservationDetails.RequestTime.Time) {
+		errorSlice = append(errorSlice, "startTime must not be before requestTime")
 	}
-	if reservationDetails.StartTime == zeroString {
-		errorSlice = append(errorSlice, "Must specify startTime string")
+	if !reservationDetails.EndTime.IsZero() && reservationDetails.EndTime.Before(reservationDetails.StartTime.Time) {
+		errorSlice = append(errorSlice, "endTime must not be before startTime")
 	}
-	if reservationDetails.State == zeroString {
+	if reservationDetails.State == "" {
 		errorSlice = append(errorSlice, "Must specify state string")
+	} else if reservationDetails.State != reservationInitialState {
+		errorSlice = append(errorSlice, fmt.Sprintf("New reservations must be in state %s", reservationInitialState))
 	}
 	if reservationDetails.RequestId == zeroString {
 		errorSlice = append(errorSlice, "Must specify requestId string")
 	}
 
 	if len(errorSlice) > 0 {
-		errorBytes, _ := json.Marshal(errorSlice)
-		return errors.New(string(errorBytes))
+		return ValidationError(errorSlice)
 	}
 
 	return nil
 }
+
+// ReservationUpdate is the body of PATCH /api/reservation/{reservationId}. Fields left empty are unchanged.
+type ReservationUpdate struct {
+	State   ReservationState `json:"state"`
+	EndTime ReservationTime  `json:"endTime"`
+}
+
+func (update ReservationUpdate) Validate() error {
+	var errorSlice []string
+
+	if update.State == "" && update.EndTime.IsZero() {
+		errorSlice = append(errorSlice, "Must specify state string or endTime time")
+	}
+	if update.State != "" && !update.State.IsValid() {
+		errorSlice = append(errorSlice, fmt.Sprintf("state must be one of %s", reservationStateNames()))
+	}
+	if update.State == reservationStateCancelled {
+		errorSlice = append(errorSlice, "Use POST /api/reservation/{reservationId}/cancel to cancel a reservation")
+	}
+
+	if len(errorSlice) > 0 {
+		return ValidationError(errorSlice)
+	}
+
+	return nil
+}
+
+// validateFor returns a non-nil error if the update can't apply to current
+func (update ReservationUpdate) validateFor(current ReservationDetails) error {
+	if !update.EndTime.IsZero() && update.EndTime.Before(current.StartTime.Time) {
+		return ValidationError{"endTime must not be before the reservation's startTime"}
+	}
+	return nil
+}
+
+// changesState returns true if the update moves the reservation out of its current state
+func (update ReservationUpdate) changesState(current ReservationDetails) bool {
+	return update.State != "" && update.State != current.State
+}
+
+// changesEndTime returns true if the update gives the reservation another end time
+func (update ReservationUpdate) changesEndTime(current ReservationDetails) bool {
+	return !update.EndTime.IsZero() && !update.EndTime.Equal(current.EndTime.Time)
+}
+
+// applyTo returns the Mongo update applying the update to current, and current as it will be after it.
+// A change of state is appended to the reservation's transitions, timestamped with at.
+func (update ReservationUpdate) applyTo(current ReservationDetails, at time.Time) (bson.M, ReservationDetails) {
+	fields := bson.M{}
+	mongoUpdate := bson.M{"$set": fields}
+	if update.changesState(current) {
+		transition := StateTransition{From: current.State, To: update.State, At: at}
+		fields["state"] = update.State
+		mongoUpdate["$push"] = bson.M{"transitions": transition}
+		current.State = update.State
+		current.Transitions = append(current.Transitions, transition)
+	}
+	if !update.EndTime.IsZero() {
+		fields["endTime"] = update.EndTime
+		current.EndTime = update.EndTime
+	}
+	return mongoUpdate, current
+}
+
+// ReservationDetailsV2 is a reservation as API v2 reads and writes it. Times must include their zone,
+// unset ones are null rather than "", and transitions are always listed.
+type ReservationDetailsV2 struct {
+	ReservationID string            `json:"reservationId" openapi:"required"`
+	BikeID        string            `json:"bikeId" openapi:"required"`
+	UserID        string            `json:"userId" openapi:"required"`
+	RequestTime   time.Time         `json:"requestTime" openapi:"required"`
+	StartTime     time.Time         `json:"startTime" openapi:"required"`
+	EndTime       *time.Time        `json:"endTime"`
+	State         ReservationState  `json:"state" openapi:"required"`
+	RequestId     string            `json:"requestId" openapi:"required"`
+	Transitions   []StateTransition `json:"transitions"`
+}
+
+// NewReservationDetailsV2 returns reservationDetails in its API v2 shape
+func NewReservationDetailsV2(reservationDetails ReservationDetails) ReservationDetailsV2 {
+	transitions := reservationDetails.Transitions
+	if transitions == nil {
+		transitions = []StateTransition{}
+	}
+	return ReservationDetailsV2{
+		ReservationID: reservationDetails.ReservationID,
+		BikeID:        reservationDetails.BikeID,
+		UserID:        reservationDetails.UserID,
+		RequestTime:   reservationDetails.RequestTime.Time,
+		StartTime:     reservationDetails.StartTime.Time,
+		EndTime:       reservationTimeV2(reservationDetails.EndTime),
+		State:         reservationDetails.State,
+		RequestId:     reservationDetails.RequestId,
+		Transitions:   transitions,
+	}
+}
+
+// ReservationDetails returns the internal ReservationDetails
+func (reservationDetails ReservationDetailsV2) ReservationDetails() ReservationDetails {
+	return ReservationDetails{
+		ReservationID: reservationDetails.ReservationID,
+		BikeID:        reservationDetails.BikeID,
+		UserID:        reservationDetails.UserID,
+		RequestTime:   NewReservationTime(reservationDetails.RequestTime),
+		StartTime:     NewReservationTime(reservationDetails.StartTime),
+		EndTime:       reservationTimeV1(reservationDetails.EndTime),
+		State:         reservationDetails.State,
+		RequestId:     reservationDetails.RequestId,
+		Transitions:   reservationDetails.Transitions,
+	}
+}
+
+// ReservationUpdateV2 is the body of PATCH /api/v2/reservation/{reservationId}
+type ReservationUpdateV2 struct {
+	State   ReservationState `json:"state"`
+	EndTime *time.Time       `json:"endTime"`
+}
+
+// NewReservationUpdateV2 returns update in its API v2 shape
+func NewReservationUpdateV2(update ReservationUpdate) ReservationUpdateV2 {
+	return ReservationUpdateV2{State: update.State, EndTime: reservationTimeV2(update.EndTime)}
+}
+
+// ReservationUpdate returns the internal ReservationUpdate
+func (update ReservationUpdateV2) ReservationUpdate() ReservationUpdate {
+	return ReservationUpdate{State: update.State, EndTime: reservationTimeV1(update.EndTime)}
+}
+
+func reservationTimeV2(t ReservationTime) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t.Time
+}
+
+func reservationTimeV1(t *time.Time) ReservationTime {
+	if t == nil {
+		return ReservationTime{}
+	}
+	return NewReservationTime(*t)
+}
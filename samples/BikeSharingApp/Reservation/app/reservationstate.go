@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// ReservationState is where a reservation is in its lifecycle. ReservationEngine drives Booking to
+// Booked and Completing to Completed or Failed; users may cancel a reservation until it's in use.
+type ReservationState string
+
+const (
+	reservationStateBooking    ReservationState = "Booking"
+	reservationStateBooked     ReservationState = "Booked"
+	reservationStateCompleting ReservationState = "Completing"
+	reservationStateCompleted  ReservationState = "Completed"
+	reservationStateFailed     ReservationState = "Failed"
+	reservationStateCancelled  ReservationState = "Cancelled"
+)
+
+// reservationInitialState is the only state a reservation can be created in
+const reservationInitialState = reservationStateBooking
+
+// reservationTransitions lists the states each state may move to. States without an entry are final.
+var reservationTransitions = map[ReservationState][]ReservationState{
+	reservationStateBooking:    {reservationStateBooked, reservationStateFailed, reservationStateCancelled},
+	reservationStateBooked:     {reservationStateCompleting, reservationStateFailed, reservationStateCancelled},
+	reservationStateCompleting: {reservationStateCompleted, reservationStateFailed},
+}
+
+var reservationStates = []ReservationState{
+	reservationStateBooking,
+	reservationStateBooked,
+	reservationStateCompleting,
+	reservationStateCompleted,
+	reservationStateFailed,
+	reservationStateCancelled,
+}
+
+// StateTransition records a reservation moving between states. From is empty for the initial state.
+type StateTransition struct {
+	From ReservationState `bson:"from,omitempty" json:"from,omitempty"`
+	To   ReservationState `bson:"to" json:"to"`
+	At   time.Time        `bson:"at" json:"at"`
+}
+
+// IsValid returns true for the known states
+func (state ReservationState) IsValid() bool {
+	for _, known := range reservationStates {
+		if state == known {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenAPISchema describes the states as an enum in the OpenAPI specification
+func (ReservationState) OpenAPISchema() *OpenAPISchema {
+	schema := &OpenAPISchema{Type: "string"}
+	for _, state := range reservationStates {
+		schema.Enum = append(schema.Enum, string(state))
+	}
+	return schema
+}
+
+// IsFinal returns true once the reservation can't change state any more
+func (state ReservationState) IsFinal() bool {
+	return len(reservationTransitions[state]) == 0
+}
+
+// CanTransitionTo returns true if the reservation may move from state to next
+func (state ReservationState) CanTransitionTo(next ReservationState) bool {
+	for _, allowed := range reservationTransitions[state] {
+		if next == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// reservationStateNames lists the known states for error messages
+func reservationStateNames() string {
+	names := make([]string, len(reservationStates))
+	for i, state := range reservationStates {
+		names[i] = string(state)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// reservationTimeLayout is how the other services format times without a zone, meaning UTC
+const reservationTimeLayout = "2006-01-02T15:04:05"
+
+// ReservationTime is a reservation timestamp, stored as a BSON date and written to JSON as RFC 3339 in UTC.
+// The zero value means unset, and is stored as null and written to JSON as "".
+type ReservationTime struct {
+	time.Time
+}
+
+// ParseReservationTime parses an RFC 3339 time. Times without a zone, as ReservationEngine and the
+// Gateway write them, are taken to be UTC.
+func ParseReservationTime(value string) (ReservationTime, error) {
+	if value == "" {
+		return ReservationTime{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return ReservationTime{parsed.UTC()}, nil
+	}
+	parsed, err := time.Parse(reservationTimeLayout, value)
+	if err != nil {
+		return ReservationTime{}, fmt.Errorf("'%s' isn't an RFC 3339 time", value)
+	}
+	return ReservationTime{parsed}, nil
+}
+
+// NewReservationTime returns t in UTC, truncated to the millisecond precision of BSON dates
+func NewReservationTime(t time.Time) ReservationTime {
+	return ReservationTime{t.UTC().Truncate(time.Millisecond)}
+}
+
+func (t ReservationTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return json.Marshal("")
+	}
+	return json.Marshal(t.UTC().Format(time.RFC3339Nano))
+}
+
+func (t *ReservationTime) UnmarshalJSON(data []byte) error {
+	var value *string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("times must be RFC 3339 strings: %v", err)
+	}
+	if value == nil {
+		*t = ReservationTime{}
+		return nil
+	}
+
+	parsed, err := ParseReservationTime(*value)
+	if err != nil {
+		return err
+	}
+	*t = NewReservationTime(parsed.Time)
+	return nil
+}
+
+// OpenAPISchema describes reservation times in the OpenAPI specification
+func (ReservationTime) OpenAPISchema() *OpenAPISchema {
+	return &OpenAPISchema{Type: "string", Format: "date-time"}
+}
+
+// GetBSON stores the time as a BSON date, or null if it's unset
+func (t ReservationTime) GetBSON() (interface{}, error) {
+	if t.IsZero() {
+		return nil, nil
+	}
+	return t.UTC(), nil
+}
+
+// SetBSON reads a BSON date. Strings written before times were typed are parsed too.
+func (t *ReservationTime) SetBSON(raw bson.Raw) error {
+	var value interface{}
+	if err := raw.Unmarshal(&value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case nil:
+		*t = ReservationTime{}
+	case time.Time:
+		*t = ReservationTime{value.UTC()}
+	case string:
+		parsed, err := ParseReservationTime(value)
+		if err != nil {
+			return err
+		}
+		*t = parsed
+	default:
+		return fmt.Errorf("can't read a reservation time from %T", value)
+	}
+	return nil
+}
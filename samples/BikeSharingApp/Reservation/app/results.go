@@ -0,0 +1,92 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorResult is the JSON body of every error response
+type ErrorResult struct {
+	Status int `json:"status"`
+	// Error names the status without spaces, e.g. "NotFound"
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	// Details lists each problem found validating the request
+	Details []string `json:"details,omitempty"`
+}
+
+// ValidationError lists every problem found validating a request. Its text is the JSON array of the problems.
+type ValidationError []string
+
+func (err ValidationError) Error() string {
+	errorBytes, _ := json.Marshal([]string(err))
+	return string(errorBytes)
+}
+
+// writeJSON writes value as the JSON body of a response with the given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	jsonResponse, err := json.Marshal(value)
+	if err != nil {
+		status = http.StatusInternalServerError
+		jsonResponse, _ = json.Marshal(newErrorResult(status, fmt.Sprintf("Couldn't encode the response: %v", err)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+func newErrorResult(status int, message string) ErrorResult {
+	return ErrorResult{
+		Status:  status,
+		Error:   strings.Replace(http.StatusText(status), " ", "", -1),
+		Message: message,
+	}
+}
+
+// writeError writes an ErrorResult with the given status and message
+func writeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, newErrorResult(status, fmt.Sprintf(format, a...)))
+}
+
+// writeBadRequest writes a 400, listing the problems if err is a ValidationError
+func writeBadRequest(w http.ResponseWriter, err error) {
+	result := newErrorResult(http.StatusBadRequest, err.Error())
+	if validationErr, ok := err.(ValidationError); ok {
+		result.Message = "The request is invalid"
+		result.Details = validationErr
+	}
+	writeJSON(w, http.StatusBadRequest, result)
+}
+
+// writeStoreError logs and writes a failed database operation. Running out of time is a 504, the client
+// going away a 503, and anything else a 500.
+func (app *App) writeStoreError(w http.ResponseWriter, req *http.Request, err error, format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	app.Logger.LogError("%s. Reason: %v", message, err)
+
+	status := http.StatusInternalServerError
+	switch req.Context().Err() {
+	case context.DeadlineExceeded:
+		status = http.StatusGatewayTimeout
+	case context.Canceled:
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, "%s: %v", message, err)
+}
+
+// notFoundHandler answers requests for unknown routes
+func notFoundHandler(w http.ResponseWriter, req *http.Request) {
+	writeError(w, http.StatusNotFound, "No route for %s", req.URL.Path)
+}
+
+// methodNotAllowedHandler answers requests using a method the route doesn't support
+func methodNotAllowedHandler(w http.ResponseWriter, req *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, "%s isn't supported on %s", req.Method, req.URL.Path)
+}
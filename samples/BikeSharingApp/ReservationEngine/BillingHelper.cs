@@ -2,6 +2,7 @@
 // Licensed under the MIT License.
 
 using System;
+using System.Globalization;
 using System.Net.Http;
 using System.Text;
 using System.Threading.Tasks;
@@ -16,7 +17,8 @@ namespace app
     {
         private static string _billingService { get; set; }
 
-        private const string DateTimeFormat = "yyyy-MM-ddTHH:mm:ss";
+        // Reservation returns RFC 3339 times; times without a zone are UTC
+        private const DateTimeStyles TimeStyles = DateTimeStyles.AssumeUniversal | DateTimeStyles.AdjustToUniversal;
 
         public static void Init(CustomConfiguration customConfiguration)
         {
@@ -29,8 +31,8 @@ namespace app
         {
             LogUtility.LogWithContext(requestId, "Creating an invoice");
             var bikeDetails = await BikesHelper.GetBike(requestId, reservationDetails.BikeId, originRequest);
-            var startTime = DateTime.ParseExact(reservationDetails.StartTime, DateTimeFormat, null);
-            var endTime = DateTime.ParseExact(reservationDetails.EndTime, DateTimeFormat, null);
+            var startTime = DateTime.Parse(reservationDetails.StartTime, CultureInfo.InvariantCulture, TimeStyles);
+            var endTime = DateTime.Parse(reservationDetails.EndTime, CultureInfo.InvariantCulture, TimeStyles);
             double amount = 0;
             if (endTime > startTime)
             {
@@ -45,7 +47,10 @@ namespace app
                 BikeId = reservationDetails.BikeId,
                 CustomerId = reservationDetails.UserId,
                 VendorId = bikeDetails.OwnerUserId,
-                ReservationId = reservationDetails.ReservationId
+                ReservationId = reservationDetails.ReservationId,
+                // Billing calculates the amount from the ride's times, the one above is only audited
+                StartTime = startTime,
+                EndTime = endTime
             };
 
             var response = await HttpHelper.PostAsync(requestId, createInvoiceUrl, new StringContent(
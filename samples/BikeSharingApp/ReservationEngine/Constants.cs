@@ -5,16 +5,12 @@ namespace app
 {
     public class Constants
     {
-        public const string MongoDbConnectionStringEnv = "mongo_connectionstring";
-
-        public const string MongoDbDatabaseEnv = "mongo_dbname";
-
-        public const string MongoDbCollectionEnv = "mongo_collection";
-
         public const string BikesMicroserviceEnv = "bikes_dnsname";
 
         public const string BillingMicroserviceEnv = "billing_dnsname";
 
+        public const string ReservationMicroserviceEnv = "reservation_dnsname";
+
         public const string RequestIdHeaderName = "x-contoso-request-id";
 
         public const string KubernetesRouteAsHeaderName = "kubernetes-route-as";
@@ -55,17 +55,16 @@ namespace app.Controllers
             if (!createBookingResponse.IsSuccessStatusCode)
             {
                 LogUtility.LogErrorWithContext(requestId, "Error response from Bikes! ResponseCode: {0}, Content: {1}", createBookingResponse.StatusCode.ToString(), await createBookingResponse.Content.ReadAsStringAsync());
-                await _failBooking(requestId, reservationDetails);
+                await _failBooking(requestId, reservationDetails, originRequest);
                 return;
             }
 
             reservationDetails.State = ReservationStatus.Booked.ToString();
-            var result = await MongoHelper.UpdateReservationStateAndEndTime(requestId, reservationDetails);
-
-            if (result.ModifiedCount == 0)
+            var bookedResponse = await ReservationHelper.UpdateReservation(requestId, reservationDetails, originRequest);
+            if (!bookedResponse.IsSuccessStatusCode)
             {
-                LogUtility.LogErrorWithContext(requestId, "Reservation not updated! MatchedCount: {0}, ModifiedCount: {1}", result.MatchedCount.ToString(), result.ModifiedCount.ToString());
-                await _failBooking(requestId, reservationDetails);
+                LogUtility.LogErrorWithContext(requestId, "Reservation not updated to 'Booked'! ResponseCode: {0}, Content: {1}", bookedResponse.StatusCode.ToString(), await bookedResponse.Content.ReadAsStringAsync());
+                await _failBooking(requestId, reservationDetails, originRequest);
                 return;
             }
 
@@ -78,11 +77,11 @@ namespace app.Controllers
             reservationDetails.State = ReservationStatus.Completing.ToString();
             reservationDetails.EndTime = string.Empty;
 
-            var reservationCompletingResult = await MongoHelper.UpdateReservationStateAndEndTime(requestId, reservationDetails);
-            if (reservationCompletingResult.ModifiedCount == 0)
+            var completingResponse = await ReservationHelper.UpdateReservation(requestId, reservationDetails, originRequest);
+            if (!completingResponse.IsSuccessStatusCode)
             {
-                LogUtility.LogErrorWithContext(requestId, "Reservation not updated to 'Completing'! MatchedCount: {0}, ModifiedCount: {1}", reservationCompletingResult.MatchedCount.ToString(), reservationCompletingResult.ModifiedCount.ToString());
-                await _failBooking(requestId, reservationDetails);
+                LogUtility.LogErrorWithContext(requestId, "Reservation not updated to 'Completing'! ResponseCode: {0}, Content: {1}", completingResponse.StatusCode.ToString(), await completingResponse.Content.ReadAsStringAsync());
+                await _failBooking(requestId, reservationDetails, originRequest);
                 return;
             }
 
@@ -90,7 +89,7 @@ namespace app.Controllers
             if (!freeBikeResponse.IsSuccessStatusCode)
             {
                 LogUtility.LogErrorWithContext(requestId, "Error response from Bikes! ResponseCode: {0}, Content: {1}", freeBikeResponse.StatusCode.ToString(), await freeBikeResponse.Content.ReadAsStringAsync());
-                await _failBooking(requestId, reservationDetails);
+                await _failBooking(requestId, reservationDetails, originRequest);
                 return;
             }
 
@@ -103,27 +102,31 @@ namespace app.Controllers
                 // Rollback
                 reservationDetails.EndTime = string.Empty;
                 await BikesHelper.ReserveBike(requestId, reservationDetails.BikeId, originRequest);
-                await _failBooking(requestId, reservationDetails);
+                await _failBooking(requestId, reservationDetails, originRequest);
                 return;
             }
             reservationDetails.InvoiceId = createInvoiceResponse.InvoiceId;
 
-            var reservationCompletedResult = await MongoHelper.UpdateReservationStateAndEndTime(requestId, reservationDetails);
-            if (reservationCompletedResult.ModifiedCount == 0)
+            var completedResponse = await ReservationHelper.UpdateReservation(requestId, reservationDetails, originRequest);
+            if (!completedResponse.IsSuccessStatusCode)
             {
-                LogUtility.LogErrorWithContext(requestId, "Reservation not updated to 'Completed'! MatchedCount: {0}, ModifiedCount: {1}", reservationCompletedResult.MatchedCount.ToString(), reservationCompletedResult.ModifiedCount.ToString());
-                await _failBooking(requestId, reservationDetails);
+                LogUtility.LogErrorWithContext(requestId, "Reservation not updated to 'Completed'! ResponseCode: {0}, Content: {1}", completedResponse.StatusCode.ToString(), await completedResponse.Content.ReadAsStringAsync());
+                await _failBooking(requestId, reservationDetails, originRequest);
                 return;
             }
 
             LogUtility.LogWithContext(requestId, "Complete booking succeeded");
         }
 
-        private static async Task _failBooking(Guid requestId, Reservation reservationDetails)
+        private static async Task _failBooking(Guid requestId, Reservation reservationDetails, HttpRequest originRequest)
         {
             LogUtility.LogErrorWithContext(requestId, "_failBooking start");
             reservationDetails.State = ReservationStatus.Failed.ToString();
-            await MongoHelper.UpdateReservationStateAndEndTime(requestId, reservationDetails);
+            var failedResponse = await ReservationHelper.UpdateReservation(requestId, reservationDetails, originRequest);
+            if (!failedResponse.IsSuccessStatusCode)
+            {
+                LogUtility.LogErrorWithContext(requestId, "Reservation not updated to 'Failed'! ResponseCode: {0}, Content: {1}", failedResponse.StatusCode.ToString(), await failedResponse.Content.ReadAsStringAsync());
+            }
             LogUtility.LogErrorWithContext(requestId, "_failBooking end");
         }
     }
@@ -1,6 +1,7 @@
 ﻿// Copyright (c) Microsoft Corporation. All rights reserved.
 // Licensed under the MIT License.
 
+using System;
 using Newtonsoft.Json;
 
 namespace app.Models
@@ -21,5 +22,11 @@ namespace app.Models
 
         [JsonProperty("amount")]
         public float Amount { get; set; }
+
+        [JsonProperty("startTime")]
+        public DateTime StartTime { get; set; }
+
+        [JsonProperty("endTime")]
+        public DateTime EndTime { get; set; }
     }
 }
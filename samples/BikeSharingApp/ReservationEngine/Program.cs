@@ -23,7 +23,7 @@ namespace app
 
             BikesHelper.Init(_customConfiguration);
             BillingHelper.Init(_customConfiguration);
-            MongoHelper.Init(_customConfiguration);         
+            ReservationHelper.Init(_customConfiguration);
             
             var host = WebHost.CreateDefaultBuilder<Startup>(args).Build();
             host.Run();    
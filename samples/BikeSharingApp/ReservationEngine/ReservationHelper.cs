@@ -0,0 +1,49 @@
+﻿// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+using System;
+using System.Globalization;
+using System.Net.Http;
+using System.Text;
+using System.Threading.Tasks;
+using app.Models;
+using Microsoft.AspNetCore.Http;
+using Newtonsoft.Json.Linq;
+
+namespace app
+{
+    public static class ReservationHelper
+    {
+        private static string _reservationService { get; set; }
+
+        // Reservation times without a zone are UTC
+        private const DateTimeStyles TimeStyles = DateTimeStyles.AssumeUniversal | DateTimeStyles.AdjustToUniversal;
+
+        public static void Init(CustomConfiguration customConfiguration)
+        {
+            LogUtility.Log("ReservationHelper init start");
+            _reservationService = Environment.GetEnvironmentVariable(Constants.ReservationMicroserviceEnv) ?? customConfiguration.Services.Reservation;
+            LogUtility.Log("ReservationHelper init end");
+        }
+
+        /// <summary>
+        /// Moves the reservation to its State, and sets its EndTime when it has one, through the Reservation
+        /// service. Reservation rejects a move its state machine doesn't allow with 409 and records the others.
+        /// </summary>
+        public static async Task<HttpResponseMessage> UpdateReservation(Guid requestId, Reservation reservationDetails, HttpRequest originRequest)
+        {
+            LogUtility.LogWithContext(requestId, "Moving reservationID " + reservationDetails.ReservationId + " to " + reservationDetails.State);
+            var update = new JObject { ["state"] = reservationDetails.State };
+            if (!string.IsNullOrEmpty(reservationDetails.EndTime))
+            {
+                var endTime = DateTime.Parse(reservationDetails.EndTime, CultureInfo.InvariantCulture, TimeStyles);
+                update["endTime"] = endTime.ToString("yyyy-MM-ddTHH:mm:ssZ", CultureInfo.InvariantCulture);
+            }
+
+            string updateReservationUrl = $"http://{_reservationService}/api/v2/reservation/{Uri.EscapeDataString(reservationDetails.ReservationId)}";
+            var response = await HttpHelper.PatchAsync(requestId, updateReservationUrl, new StringContent(
+                    update.ToString(), Encoding.UTF8, "application/json"), originRequest);
+            return response;
+        }
+    }
+}